@@ -0,0 +1,160 @@
+// Command rotate-token-keys re-encrypts stored Gmail tokens and SMTP passwords
+// with the current token encryption key. Configure the new key next to the old
+// ones in TOKEN_ENCRYPTION_KEYS (or TOKEN_ENCRYPTION_KEYS_FILE), run this
+// command, then remove the old keys once no row uses them any more. Plaintext
+// secrets stored before encryption was enabled are encrypted as well.
+//
+// Rotation is safe while the server is running: a row is only rewritten if it
+// still holds the values read by this command, so a token the server refreshed
+// in the meantime is skipped instead of being overwritten with the stale one.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/utils"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	batchSize := flag.Int("batch", 100, "number of rows re-encrypted per query")
+	dryRun := flag.Bool("dry-run", false, "only report how many rows would be re-encrypted")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found, using system environment variables")
+	}
+
+	version, err := utils.TokenKeyVersion()
+	if err != nil {
+		log.Fatal("Invalid token encryption keys: ", err)
+	}
+	if version == 0 {
+		log.Fatal("TOKEN_ENCRYPTION_KEYS is not set, there is no key to rotate to")
+	}
+
+	config.ConnectDatabase()
+
+	failed := rotateGmailTokens(version, *batchSize, *dryRun)
+	failed += rotateMailSettings(version, *batchSize, *dryRun)
+	if failed > 0 {
+		log.Fatal("Some rows were not re-encrypted; run the command again after fixing the errors")
+	}
+}
+
+// rotateGmailTokens re-encrypts the Gmail tokens and returns how many failed
+func rotateGmailTokens(version, batchSize int, dryRun bool) int {
+	// Soft deleted tokens still hold secrets, so they are rotated too
+	query := config.DB.Unscoped().Model(&models.GmailToken{}).Where("key_version <> ?", version)
+
+	var stale int64
+	if err := query.Count(&stale).Error; err != nil {
+		log.Fatal("Failed to count tokens: ", err)
+	}
+	log.Printf("%d Gmail tokens are not encrypted with key version %d", stale, version)
+	if dryRun || stale == 0 {
+		return 0
+	}
+
+	rotated, skipped, failed := 0, 0, 0
+	var lastID uint
+	for {
+		// Page by ID so rows that fail to update are not loaded again
+		var tokens []models.GmailToken
+		if err := config.DB.Unscoped().
+			Where("key_version <> ? AND id > ?", version, lastID).
+			Order("id").Limit(batchSize).Find(&tokens).Error; err != nil {
+			log.Fatal("Failed to load tokens (is every old key still configured?): ", err)
+		}
+		if len(tokens) == 0 {
+			break
+		}
+
+		for _, token := range tokens {
+			lastID = token.ID
+
+			// Columns are written directly so updated_at keeps meaning the last OAuth change.
+			// A token refreshed since it was read has a new updated_at (and, once the
+			// server uses the new key, key version) and is left alone.
+			result := config.DB.Unscoped().Model(&models.GmailToken{}).
+				Where("id = ? AND key_version <> ? AND updated_at = ?", token.ID, version, token.UpdatedAt).
+				UpdateColumns(map[string]interface{}{
+					"access_token":  token.AccessToken,
+					"refresh_token": token.RefreshToken,
+					"key_version":   version,
+				})
+			if result.Error != nil {
+				log.Printf("Failed to re-encrypt token %d: %v", token.ID, result.Error)
+				failed++
+				continue
+			}
+			if result.RowsAffected == 0 {
+				log.Printf("Token %d changed while rotating, skipped", token.ID)
+				skipped++
+				continue
+			}
+			rotated++
+		}
+	}
+
+	log.Printf("Re-encrypted %d Gmail tokens with key version %d, %d changed meanwhile, %d failed", rotated, version, skipped, failed)
+	return failed
+}
+
+// rotateMailSettings re-encrypts the SMTP passwords and returns how many failed
+func rotateMailSettings(version, batchSize int, dryRun bool) int {
+	query := config.DB.Model(&models.MailSettings{}).Where("key_version <> ?", version)
+
+	var stale int64
+	if err := query.Count(&stale).Error; err != nil {
+		log.Fatal("Failed to count mail settings: ", err)
+	}
+	log.Printf("%d SMTP passwords are not encrypted with key version %d", stale, version)
+	if dryRun || stale == 0 {
+		return 0
+	}
+
+	rotated, skipped, failed := 0, 0, 0
+	var lastID uint
+	for {
+		var settings []models.MailSettings
+		if err := config.DB.
+			Where("key_version <> ? AND id > ?", version, lastID).
+			Order("id").Limit(batchSize).Find(&settings).Error; err != nil {
+			log.Fatal("Failed to load mail settings (is every old key still configured?): ", err)
+		}
+		if len(settings) == 0 {
+			break
+		}
+
+		for _, setting := range settings {
+			lastID = setting.ID
+
+			// Settings the user saved since they were read are left alone
+			result := config.DB.Model(&models.MailSettings{}).
+				Where("id = ? AND key_version <> ? AND updated_at = ?", setting.ID, version, setting.UpdatedAt).
+				UpdateColumns(map[string]interface{}{
+					"smtp_password": setting.SMTPPassword,
+					"key_version":   version,
+				})
+			if result.Error != nil {
+				log.Printf("Failed to re-encrypt mail settings %d: %v", setting.ID, result.Error)
+				failed++
+				continue
+			}
+			if result.RowsAffected == 0 {
+				log.Printf("Mail settings %d changed while rotating, skipped", setting.ID)
+				skipped++
+				continue
+			}
+			rotated++
+		}
+	}
+
+	log.Printf("Re-encrypted %d SMTP passwords with key version %d, %d changed meanwhile, %d failed", rotated, version, skipped, failed)
+	return failed
+}
@@ -41,12 +41,30 @@ func ConnectDatabase() {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
-	// Auto migrate the schema
-	err = database.AutoMigrate(&models.User{}, &models.GmailToken{}, &models.EmailHistory{})
-	if err != nil {
+	if err := MigrateDatabase(database); err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
 
 	DB = database
 	log.Println("Database connected successfully")
 }
+
+// MigrateDatabase creates or updates the tables of every model
+func MigrateDatabase(database *gorm.DB) error {
+	return database.AutoMigrate(
+		&models.User{},
+		&models.GmailToken{},
+		&models.GmailSendAs{},
+		&models.MailSettings{},
+		&models.EmailHistory{},
+		&models.BulkJob{},
+		&models.BulkJobRecipient{},
+		&models.ScheduledEmail{},
+		&models.CapturedEmail{},
+		&models.IdempotencyKey{},
+		&models.EmailTemplate{},
+		&models.EmailTemplateVersion{},
+		&models.EventStreamToken{},
+		&models.SendQuotaReservation{},
+	)
+}
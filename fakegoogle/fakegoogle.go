@@ -0,0 +1,317 @@
+// Package fakegoogle is an in-process fake of the Google endpoints the server
+// calls: the OAuth consent page and token exchange, userinfo, tokeninfo, and
+// the Gmail messages.send and settings.sendAs.list methods. It lets tests
+// drive the whole API end to end without network access:
+//
+//	fake := fakegoogle.New()
+//	defer fake.Close()
+//	defer fake.Install()()
+//
+//	fake.AddAccount("me@gmail.com", "Me")
+//	code := fake.AuthCode("me@gmail.com") // Connect it with POST /api/gmail/accounts
+//	fake.Fail(fakegoogle.Send, fakegoogle.RateLimit, 2)
+//
+// Failures are injected per endpoint and consumed in order, one per request.
+package fakegoogle
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	"email-app-backend/utils"
+)
+
+// Endpoint identifies a faked Google endpoint, for injecting failures and counting calls
+type Endpoint string
+
+const (
+	Token     Endpoint = "token"     // OAuth code exchange and refresh
+	UserInfo  Endpoint = "userinfo"  // oauth2/v2/userinfo
+	TokenInfo Endpoint = "tokeninfo" // oauth2/v2/tokeninfo
+	Send      Endpoint = "send"      // gmail users.messages.send
+	SendAs    Endpoint = "sendas"    // gmail users.settings.sendAs.list
+)
+
+// Failure is an error the fake replies with instead of handling a request
+type Failure string
+
+const (
+	// RateLimit replies 429 with a rateLimitExceeded reason and Retry-After of one second
+	RateLimit Failure = "rate_limit"
+
+	// DailyLimit replies 403 with Gmail's dailyLimitExceeded reason
+	DailyLimit Failure = "daily_limit"
+
+	// ServerError replies 500 with a backendError reason
+	ServerError Failure = "server_error"
+
+	// InvalidGrant replies 400 invalid_grant on the token endpoint, as Google
+	// does for a revoked grant, and 401 Invalid Credentials on the others
+	InvalidGrant Failure = "invalid_grant"
+)
+
+// Scopes are the scopes the fake grants every token
+const Scopes = "https://www.googleapis.com/auth/gmail.send https://www.googleapis.com/auth/gmail.settings.basic https://www.googleapis.com/auth/userinfo.email"
+
+// tokenLifetime is the expires_in of the access tokens the fake issues, in seconds
+const tokenLifetime = 3599
+
+// Alias is a send-as address of a fake account
+type Alias struct {
+	Email       string
+	DisplayName string
+	ReplyTo     string
+	Verified    bool // Unverified aliases are listed with verificationStatus "pending"
+}
+
+// Message is a message sent through the fake Gmail API
+type Message struct {
+	ID       string
+	ThreadID string
+	Account  string // Email of the account it was sent from
+	Raw      []byte // Decoded RFC 5322 message
+}
+
+// account is a Google account known to the fake
+type account struct {
+	id      string
+	email   string
+	name    string
+	aliases []Alias
+}
+
+// Server is a running fake. Its methods are safe for concurrent use.
+type Server struct {
+	URL string
+
+	server *httptest.Server
+
+	mu            sync.Mutex
+	accounts      map[string]*account // By email
+	order         []string            // Emails in the order they were added
+	codes         map[string]string   // Authorization code to email
+	accessTokens  map[string]string   // Access token to email
+	refreshTokens map[string]string   // Refresh token to email
+	idTokens      map[string]string   // ID token to email
+	failures      map[Endpoint][]Failure
+	calls         map[Endpoint]int
+	sent          []Message
+}
+
+// New starts a fake on a local port
+func New() *Server {
+	s := &Server{
+		accounts:      make(map[string]*account),
+		codes:         make(map[string]string),
+		accessTokens:  make(map[string]string),
+		refreshTokens: make(map[string]string),
+		idTokens:      make(map[string]string),
+		failures:      make(map[Endpoint][]Failure),
+		calls:         make(map[Endpoint]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/o/oauth2/auth", s.handleAuth)
+	mux.HandleFunc("/token", s.handleToken)
+	mux.HandleFunc("/oauth2/v2/userinfo", s.handleUserInfo)
+	mux.HandleFunc("/oauth2/v2/tokeninfo", s.handleTokenInfo)
+	mux.HandleFunc("/gmail/v1/users/", s.handleGmail)
+
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts the fake down
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Endpoints returns the Google endpoints served by the fake
+func (s *Server) Endpoints() utils.GoogleEndpoints {
+	return utils.GoogleEndpoints{
+		AuthURL:  s.URL + "/o/oauth2/auth",
+		TokenURL: s.URL + "/token",
+		APIURL:   s.URL + "/",
+		GmailURL: s.URL + "/",
+	}
+}
+
+// Install points the server at the fake and returns a function restoring the
+// configured Google endpoints
+func (s *Server) Install() func() {
+	endpoints := s.Endpoints()
+	utils.SetGoogleEndpoints(&endpoints)
+	return func() { utils.SetGoogleEndpoints(nil) }
+}
+
+// AddAccount adds a Google account, or renames an existing one
+func (s *Server) AddAccount(email, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addAccount(email, name)
+}
+
+func (s *Server) addAccount(email, name string) *account {
+	key := strings.ToLower(email)
+	if acct, ok := s.accounts[key]; ok {
+		if name != "" {
+			acct.name = name
+		}
+		return acct
+	}
+
+	acct := &account{id: randomID(), email: email, name: name}
+	s.accounts[key] = acct
+	s.order = append(s.order, key)
+	return acct
+}
+
+// AddAlias adds a send-as address to an account, adding the account if needed
+func (s *Server) AddAlias(email string, alias Alias) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acct := s.addAccount(email, "")
+	acct.aliases = append(acct.aliases, alias)
+}
+
+// AuthCode returns a one-time authorization code granting access to an
+// account, adding the account if needed
+func (s *Server) AuthCode(email string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addAccount(email, "")
+	code := "code-" + randomID()
+	s.codes[code] = strings.ToLower(email)
+	return code
+}
+
+// IssueTokens grants access to an account without the OAuth flow, for
+// seeding stored tokens, and adds the account if needed
+func (s *Server) IssueTokens(email string) (accessToken, refreshToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addAccount(email, "")
+	return s.issueTokens(strings.ToLower(email))
+}
+
+func (s *Server) issueTokens(key string) (accessToken, refreshToken string) {
+	accessToken = "access-" + randomID()
+	refreshToken = "refresh-" + randomID()
+	s.accessTokens[accessToken] = key
+	s.refreshTokens[refreshToken] = key
+	return accessToken, refreshToken
+}
+
+// IDToken returns a Google Sign-In credential for an account, accepted by
+// tokeninfo, adding the account if needed
+func (s *Server) IDToken(email string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addAccount(email, "")
+	token := "id-" + randomID()
+	s.idTokens[token] = strings.ToLower(email)
+	return token
+}
+
+// Revoke invalidates every token of an account, as when the user removes the
+// app's access: refreshes fail with invalid_grant and API calls with 401
+func (s *Server) Revoke(email string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(email)
+	for _, tokens := range []map[string]string{s.accessTokens, s.refreshTokens, s.idTokens} {
+		for token, owner := range tokens {
+			if owner == key {
+				delete(tokens, token)
+			}
+		}
+	}
+}
+
+// Fail makes the next times requests to endpoint fail with failure, after
+// any failures injected before
+func (s *Server) Fail(endpoint Endpoint, failure Failure, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < times; i++ {
+		s.failures[endpoint] = append(s.failures[endpoint], failure)
+	}
+}
+
+// Calls returns how many requests endpoint received, failed ones included
+func (s *Server) Calls(endpoint Endpoint) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[endpoint]
+}
+
+// Sent returns the messages sent so far, oldest first
+func (s *Server) Sent() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sent := make([]Message, len(s.sent))
+	copy(sent, s.sent)
+	return sent
+}
+
+// SentTo returns the messages sent to a recipient, going by the To, Cc and
+// Bcc headers of the raw message
+func (s *Server) SentTo(recipient string) []Message {
+	var matching []Message
+	for _, msg := range s.Sent() {
+		if messageRecipients(msg.Raw)[strings.ToLower(recipient)] {
+			matching = append(matching, msg)
+		}
+	}
+	return matching
+}
+
+// Accounts returns the emails of the fake's accounts, sorted
+func (s *Server) Accounts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	emails := make([]string, 0, len(s.accounts))
+	for _, acct := range s.accounts {
+		emails = append(emails, acct.email)
+	}
+	sort.Strings(emails)
+	return emails
+}
+
+// begin counts a request and returns the failure injected for it, if any
+func (s *Server) begin(endpoint Endpoint) Failure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls[endpoint]++
+	queue := s.failures[endpoint]
+	if len(queue) == 0 {
+		return ""
+	}
+	s.failures[endpoint] = queue[1:]
+	return queue[0]
+}
+
+func randomID() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,352 @@
+package fakegoogle
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+)
+
+// handleAuth stands in for the consent page: it grants access to the account
+// named by login_hint, or the first account added, and redirects back with a code
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	redirectURI, err := url.Parse(r.URL.Query().Get("redirect_uri"))
+	if err != nil || redirectURI.String() == "" {
+		http.Error(w, "redirect_uri is required", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	key := strings.ToLower(r.URL.Query().Get("login_hint"))
+	if _, ok := s.accounts[key]; !ok && len(s.order) > 0 {
+		key = s.order[0]
+	}
+	_, ok := s.accounts[key]
+	code := "code-" + randomID()
+	if ok {
+		s.codes[code] = key
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "the fake has no Google account to sign in with", http.StatusBadRequest)
+		return
+	}
+
+	query := redirectURI.Query()
+	query.Set("code", code)
+	query.Set("state", r.URL.Query().Get("state"))
+	query.Set("scope", Scopes)
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// handleToken exchanges authorization codes and refresh tokens for access tokens
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	switch s.begin(Token) {
+	case RateLimit, DailyLimit:
+		writeOAuthError(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Rate limit exceeded")
+		return
+	case ServerError:
+		writeOAuthError(w, http.StatusInternalServerError, "internal_failure", "Backend Error")
+		return
+	case InvalidGrant:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Token has been expired or revoked.")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request", "Token requests must be POST")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response := map[string]interface{}{
+		"expires_in": tokenLifetime,
+		"scope":      Scopes,
+		"token_type": "Bearer",
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		key, ok := s.codes[r.PostForm.Get("code")]
+		if !ok {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Malformed auth code.")
+			return
+		}
+		delete(s.codes, r.PostForm.Get("code"))
+		response["access_token"], response["refresh_token"] = s.issueTokens(key)
+	case "refresh_token":
+		key, ok := s.refreshTokens[r.PostForm.Get("refresh_token")]
+		if !ok {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Token has been expired or revoked.")
+			return
+		}
+		accessToken := "access-" + randomID()
+		s.accessTokens[accessToken] = key
+		response["access_token"] = accessToken
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Invalid grant_type: "+r.PostForm.Get("grant_type"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleUserInfo returns the profile of the account an access token belongs to
+func (s *Server) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	if failure := s.begin(UserInfo); failure != "" {
+		writeFailure(w, failure)
+		return
+	}
+
+	acct := s.authenticate(r)
+	if acct == nil {
+		writeAPIError(w, http.StatusUnauthorized, "authError", "Invalid Credentials", "UNAUTHENTICATED")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":             acct.id,
+		"email":          acct.email,
+		"verified_email": true,
+		"name":           acct.name,
+	})
+}
+
+// handleTokenInfo describes an ID token or access token
+func (s *Server) handleTokenInfo(w http.ResponseWriter, r *http.Request) {
+	if failure := s.begin(TokenInfo); failure != "" {
+		writeFailure(w, failure)
+		return
+	}
+	r.ParseForm()
+
+	s.mu.Lock()
+	var key string
+	var ok bool
+	if token := r.Form.Get("id_token"); token != "" {
+		key, ok = s.idTokens[token]
+	} else if token := r.Form.Get("access_token"); token != "" {
+		key, ok = s.accessTokens[token]
+	}
+	acct := s.accounts[key]
+	s.mu.Unlock()
+
+	if !ok || acct == nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_token", "Invalid Value")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issued_to":      "fakegoogle",
+		"audience":       "fakegoogle",
+		"user_id":        acct.id,
+		"scope":          Scopes,
+		"expires_in":     tokenLifetime,
+		"email":          acct.email,
+		"verified_email": true,
+	})
+}
+
+// handleGmail serves users.messages.send and users.settings.sendAs.list
+func (s *Server) handleGmail(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/"), "/", 2)
+	if len(parts) != 2 {
+		writeAPIError(w, http.StatusNotFound, "notFound", "Not Found", "NOT_FOUND")
+		return
+	}
+
+	var endpoint Endpoint
+	switch {
+	case parts[1] == "messages/send" && r.Method == http.MethodPost:
+		endpoint = Send
+	case parts[1] == "settings/sendAs" && r.Method == http.MethodGet:
+		endpoint = SendAs
+	default:
+		writeAPIError(w, http.StatusNotFound, "notFound", "Not Found", "NOT_FOUND")
+		return
+	}
+
+	if failure := s.begin(endpoint); failure != "" {
+		writeFailure(w, failure)
+		return
+	}
+
+	acct := s.authenticate(r)
+	if acct == nil {
+		writeAPIError(w, http.StatusUnauthorized, "authError", "Invalid Credentials", "UNAUTHENTICATED")
+		return
+	}
+	if parts[0] != "me" && !strings.EqualFold(parts[0], acct.email) {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "Delegation denied for "+acct.email, "PERMISSION_DENIED")
+		return
+	}
+
+	if endpoint == SendAs {
+		s.listSendAs(w, acct)
+		return
+	}
+	s.sendMessage(w, r, acct)
+}
+
+func (s *Server) sendMessage(w http.ResponseWriter, r *http.Request, acct *account) {
+	var body struct {
+		Raw      string `json:"raw"`
+		ThreadID string `json:"threadId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "parseError", "Parse Error", "INVALID_ARGUMENT")
+		return
+	}
+
+	raw, err := decodeRaw(body.Raw)
+	if err != nil || len(raw) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalidArgument", "Invalid value for ByteString: "+body.Raw, "INVALID_ARGUMENT")
+		return
+	}
+	if len(messageRecipients(raw)) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalidArgument", "Recipient address required", "INVALID_ARGUMENT")
+		return
+	}
+
+	msg := Message{ID: randomID()[:16], ThreadID: body.ThreadID, Account: acct.email, Raw: raw}
+	if msg.ThreadID == "" {
+		msg.ThreadID = msg.ID
+	}
+
+	s.mu.Lock()
+	s.sent = append(s.sent, msg)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":       msg.ID,
+		"threadId": msg.ThreadID,
+		"labelIds": []string{"SENT"},
+	})
+}
+
+func (s *Server) listSendAs(w http.ResponseWriter, acct *account) {
+	s.mu.Lock()
+	sendAs := []map[string]interface{}{{
+		"sendAsEmail": acct.email,
+		"displayName": acct.name,
+		"isPrimary":   true,
+		"isDefault":   true,
+	}}
+	for _, alias := range acct.aliases {
+		status := "pending"
+		if alias.Verified {
+			status = "accepted"
+		}
+		sendAs = append(sendAs, map[string]interface{}{
+			"sendAsEmail":        alias.Email,
+			"displayName":        alias.DisplayName,
+			"replyToAddress":     alias.ReplyTo,
+			"verificationStatus": status,
+		})
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sendAs": sendAs})
+}
+
+// authenticate returns the account of the request's access token, from the
+// Authorization header or the access_token parameter
+func (s *Server) authenticate(r *http.Request) *account {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.accessTokens[token]
+	if !ok {
+		return nil
+	}
+	return s.accounts[key]
+}
+
+// decodeRaw decodes the base64url raw field, padded or not
+func decodeRaw(value string) ([]byte, error) {
+	if raw, err := base64.URLEncoding.DecodeString(value); err == nil {
+		return raw, nil
+	}
+	return base64.RawURLEncoding.DecodeString(value)
+}
+
+// messageRecipients returns the lower-cased addresses in the To, Cc and Bcc headers of raw
+func messageRecipients(raw []byte) map[string]bool {
+	recipients := make(map[string]bool)
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return recipients
+	}
+
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		addresses, err := msg.Header.AddressList(field)
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			recipients[strings.ToLower(address.Address)] = true
+		}
+	}
+	return recipients
+}
+
+// writeFailure replies with an injected failure in the Google API error format
+func writeFailure(w http.ResponseWriter, failure Failure) {
+	switch failure {
+	case RateLimit:
+		w.Header().Set("Retry-After", "1")
+		writeAPIError(w, http.StatusTooManyRequests, "rateLimitExceeded", "User-rate limit exceeded.", "RESOURCE_EXHAUSTED")
+	case DailyLimit:
+		writeAPIError(w, http.StatusForbidden, "dailyLimitExceeded", "Daily user sending limit exceeded.", "PERMISSION_DENIED")
+	case ServerError:
+		writeAPIError(w, http.StatusInternalServerError, "backendError", "Backend Error", "INTERNAL")
+	default:
+		writeAPIError(w, http.StatusUnauthorized, "authError", "Invalid Credentials", "UNAUTHENTICATED")
+	}
+}
+
+// writeAPIError replies in the error format of Google's JSON APIs
+func writeAPIError(w http.ResponseWriter, code int, reason, message, status string) {
+	writeJSON(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"status":  status,
+			"errors": []map[string]string{{
+				"message": message,
+				"domain":  "global",
+				"reason":  reason,
+			}},
+		},
+	})
+}
+
+// writeOAuthError replies in the RFC 6749 error format of the token endpoint
+func writeOAuthError(w http.ResponseWriter, code int, errorCode, description string) {
+	writeJSON(w, code, map[string]string{
+		"error":             errorCode,
+		"error_description": description,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
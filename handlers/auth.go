@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
 	"net/http"
 	"strings"
 
@@ -144,30 +143,18 @@ func GoogleAuth(c *gin.Context) {
 	// Handle different types of Google auth requests
 	if req.AccessToken != "" {
 		// Handle access token flow (from LoginSocialGoogle)
-		client := &http.Client{}
-		resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + req.AccessToken)
+		userInfo, err := utils.GetGoogleUserInfo(req.AccessToken)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user info"})
 			return
 		}
-		defer resp.Body.Close()
-
-		var userInfo struct {
-			Email string `json:"email"`
-			Name  string `json:"name"`
-		}
-
-		if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode user info"})
-			return
-		}
 
 		email = userInfo.Email
 		name = userInfo.Name
 	} else if req.Credential != "" {
 		// Handle JWT credential flow (from @react-oauth/google)
 		ctx := context.Background()
-		oauth2Service, err := oauth2.NewService(ctx, option.WithoutAuthentication())
+		oauth2Service, err := oauth2.NewService(ctx, option.WithoutAuthentication(), option.WithEndpoint(utils.GetGoogleEndpoints().APIURL))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create OAuth2 service"})
 			return
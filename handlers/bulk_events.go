@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// eventStreamTokenTTL is how long a stream token can be used to open an event stream
+const eventStreamTokenTTL = time.Minute
+
+// bulkEventKeepAlive is how often an idle event stream sends a ping so proxies keep it open
+const bulkEventKeepAlive = 15 * time.Second
+
+// bulkEventPollInterval is how often an event stream reads the job and its
+// recipients, which may be processed by a worker in another process
+const bulkEventPollInterval = time.Second
+
+// bulkEventSlack is how far before the latest result a stream looks for new
+// ones. A result is committed a moment after its processed_at is taken, and
+// workers on other hosts may have slightly different clocks.
+const bulkEventSlack = 10 * time.Second
+
+// BulkProgressEvent is streamed to clients watching a bulk job
+type BulkProgressEvent struct {
+	JobID          string           `json:"job_id"`
+	Status         string           `json:"status"`
+	Result         *BulkEmailResult `json:"result,omitempty"`
+	TotalEmails    int              `json:"total_emails"`
+	SuccessCount   int              `json:"success_count"`
+	FailureCount   int              `json:"failure_count"`
+	CancelledCount int              `json:"cancelled_count"`
+	Remaining      int              `json:"remaining"`
+	ETASeconds     *float64         `json:"eta_seconds,omitempty"`
+}
+
+// jobProgressEvent builds a progress event from a job as stored in the database
+func jobProgressEvent(job *models.BulkJob) BulkProgressEvent {
+	return BulkProgressEvent{
+		JobID:          job.ID,
+		Status:         job.Status,
+		TotalEmails:    job.TotalCount,
+		SuccessCount:   job.SentCount,
+		FailureCount:   job.FailedCount,
+		CancelledCount: job.CancelledCount,
+		Remaining:      job.TotalCount - job.SentCount - job.FailedCount - job.CancelledCount,
+	}
+}
+
+// isFinishedBulkJob reports whether a job will not send any more emails
+func isFinishedBulkJob(status string) bool {
+	return status == models.BulkJobCompleted || status == models.BulkJobCancelled
+}
+
+// CreateEventStreamToken issues a single-use token that opens the event stream
+// of one of the user's bulk jobs as ?token=, for browsers whose EventSource
+// cannot send the Authorization header
+func CreateEventStreamToken(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	job, ok := findUserBulkJob(c, userID)
+	if !ok {
+		return
+	}
+
+	token, hash, err := utils.GenerateStreamToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create stream token"})
+		return
+	}
+
+	// Tokens that were never used are dropped once expired
+	now := time.Now()
+	config.DB.Where("expires_at <= ?", now).Delete(&models.EventStreamToken{})
+
+	streamToken := models.EventStreamToken{
+		TokenHash: hash,
+		UserID:    userID.(uint),
+		JobID:     job.ID,
+		ExpiresAt: now.Add(eventStreamTokenTTL),
+	}
+	if err := config.DB.Create(&streamToken).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create stream token"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":      token,
+		"expires_at": streamToken.ExpiresAt,
+	})
+}
+
+// bulkJobWatch follows a bulk job in the database for an event stream
+type bulkJobWatch struct {
+	job       models.BulkJob
+	seen      map[uint]bool // Recipients whose result was already streamed or part of the snapshot
+	latest    time.Time     // Latest processed_at among the seen recipients
+	startedAt time.Time
+	processed int // Recipients sent or failed when the stream opened, for the ETA
+}
+
+func newBulkJobWatch(job *models.BulkJob) (*bulkJobWatch, error) {
+	w := &bulkJobWatch{job: *job, seen: make(map[uint]bool), startedAt: time.Now()}
+	w.processed = job.SentCount + job.FailedCount
+	if _, err := w.newResults(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// newResults loads the recipients processed since the last call
+func (w *bulkJobWatch) newResults() ([]models.BulkJobRecipient, error) {
+	query := config.DB.Where("job_id = ? AND status <> ?", w.job.ID, models.RecipientPending)
+	if !w.latest.IsZero() {
+		query = query.Where("processed_at >= ?", w.latest.Add(-bulkEventSlack))
+	}
+	var recipients []models.BulkJobRecipient
+	if err := query.Order("processed_at, id").Find(&recipients).Error; err != nil {
+		return nil, err
+	}
+
+	results := recipients[:0]
+	for _, recipient := range recipients {
+		if w.seen[recipient.ID] {
+			continue
+		}
+		w.seen[recipient.ID] = true
+		if recipient.ProcessedAt != nil && recipient.ProcessedAt.After(w.latest) {
+			w.latest = *recipient.ProcessedAt
+		}
+		results = append(results, recipient)
+	}
+	return results, nil
+}
+
+// poll reloads the job and streams the results of the recipients processed
+// since the last poll, followed by a "status" event if the job changed state.
+// It reports whether the stream should go on.
+func (w *bulkJobWatch) poll(c *gin.Context) bool {
+	// The job is read before its recipients, so every result recorded before
+	// the job was finished is streamed ahead of the final status
+	var job models.BulkJob
+	if err := config.DB.First(&job, "id = ?", w.job.ID).Error; err != nil {
+		return !errors.Is(err, gorm.ErrRecordNotFound)
+	}
+	results, err := w.newResults()
+	if err != nil {
+		fmt.Printf("Bulk job %s event stream failed to load results: %v\n", job.ID, err)
+		return true
+	}
+
+	for i := range results {
+		result := bulkEmailResult(&results[i])
+		event := jobProgressEvent(&job)
+		event.Status = models.BulkJobRunning
+		event.Result = &result
+		event.ETASeconds = w.eta(&job)
+		c.SSEvent("result", event)
+	}
+
+	changed := job.Status != w.job.Status
+	w.job = job
+	if changed {
+		c.SSEvent("status", jobProgressEvent(&job))
+		return !isFinishedBulkJob(job.Status)
+	}
+	return true
+}
+
+// eta estimates the seconds left from the average time per recipient since the stream opened
+func (w *bulkJobWatch) eta(job *models.BulkJob) *float64 {
+	processed := job.SentCount + job.FailedCount - w.processed
+	remaining := job.TotalCount - job.SentCount - job.FailedCount - job.CancelledCount
+	if processed <= 0 || remaining <= 0 {
+		return nil
+	}
+	eta := time.Since(w.startedAt).Seconds() / float64(processed) * float64(remaining)
+	return &eta
+}
+
+// StreamBulkJobEvents streams the progress of a bulk job as Server-Sent Events.
+// A "snapshot" event with the current counts is sent first, followed by a
+// "result" event for each processed recipient and a "status" event whenever
+// the job changes state. Progress is read from the database, so the stream
+// follows the job whichever process runs it, and ends once the job is finished.
+func StreamBulkJobEvents(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	job, ok := findUserBulkJob(c, userID)
+	if !ok {
+		return
+	}
+
+	// Recipients processed before the snapshot are counted in it, not streamed
+	watch, err := newBulkJobWatch(job)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load bulk job"})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	c.SSEvent("snapshot", jobProgressEvent(job))
+	c.Writer.Flush()
+	if isFinishedBulkJob(job.Status) {
+		return
+	}
+
+	poll := time.NewTicker(bulkEventPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(bulkEventKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-poll.C:
+			return watch.poll(c)
+		case <-keepAlive.C:
+			c.SSEvent("ping", gin.H{"time": time.Now()})
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,726 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// BulkJobResponse describes a bulk job along with the results of the recipients processed so far
+type BulkJobResponse struct {
+	models.BulkJob
+	Results []BulkEmailResult `json:"results"`
+}
+
+// bulkTemplate is the subject or a body of a bulk request, parsed as a merge template
+type bulkTemplate struct {
+	field  string // subject, body or html_body
+	tmpl   *utils.Template
+	escape func(string) string // Applied to the values filled in
+}
+
+// bulkComposer personalizes the message of a bulk request for each recipient.
+// The subject and bodies are merge templates filled in with the recipient's
+// email, name and fields.
+type bulkComposer struct {
+	req           *BulkEmailRequest
+	from, replyTo utils.EmailAddress
+	templates     []bulkTemplate
+	attachments   []utils.EmailAttachment // Decoded once for all recipients
+}
+
+// bodyEscapes escapes the values filled into a body written in each format
+var bodyEscapes = map[string]func(string) string{
+	utils.BodyFormatMarkdown: utils.EscapeMarkdown,
+	utils.BodyFormatHTML:     html.EscapeString,
+}
+
+// newBulkComposer parses the templates of a bulk request, reporting syntax
+// errors on the subject, body and html_body fields
+func newBulkComposer(req *BulkEmailRequest, from, replyTo utils.EmailAddress) (*bulkComposer, error) {
+	composer := &bulkComposer{req: req, from: from, replyTo: replyTo, attachments: utils.DecodeAttachments(req.Attachments)}
+
+	errs := utils.ValidateBodyFormat(req.BodyFormat, req.HTMLBody)
+	parse := func(field, text string, escape func(string) string) {
+		tmpl, err := utils.ParseTemplate(text)
+		if err != nil {
+			errs.Add(field, "%v", err)
+			return
+		}
+		composer.templates = append(composer.templates, bulkTemplate{field: field, tmpl: tmpl, escape: escape})
+	}
+	parse("subject", req.Subject, utils.SanitizeHeaderText)
+	parse("body", req.Body, bodyEscapes[req.BodyFormat])
+	parse("html_body", req.HTMLBody, html.EscapeString)
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return composer, nil
+}
+
+// compose creates the personalized message for one recipient, rendering its
+// body in the request's body format, along with the warnings about its HTML.
+// If the recipient has no value for a variable, the error wraps a
+// *utils.TemplateError and names the template that needs it.
+func (b *bulkComposer) compose(record BulkEmailRecord) (*utils.EmailMessage, []utils.HTMLWarning, error) {
+	data := bulkRecordVariables(record)
+
+	rendered := make(map[string]string, len(b.templates))
+	for _, t := range b.templates {
+		content, err := t.tmpl.Execute(data, t.escape)
+		if err != nil {
+			return nil, nil, &bulkTemplateError{field: t.field, err: err}
+		}
+		rendered[t.field] = content
+	}
+
+	body, err := utils.RenderBody(b.req.BodyFormat, rendered["body"], rendered["html_body"])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &utils.EmailMessage{
+		From:        b.from,
+		To:          []utils.EmailAddress{{Name: record.Name, Email: record.Email}},
+		ReplyTo:     b.replyTo,
+		Subject:     rendered["subject"],
+		TextBody:    body.Text,
+		HTMLBody:    body.HTML,
+		Attachments: b.attachments,
+	}, body.Warnings, nil
+}
+
+// checkVariables reports the variables the templates use that none of the
+// records has, on the field of the template using them
+func (b *bulkComposer) checkVariables(records []BulkEmailRecord) error {
+	known := map[string]bool{"email": true, "name": true}
+	for _, record := range records {
+		for key := range record.Fields {
+			known[utils.NormalizeTemplateVariable(key)] = true
+		}
+	}
+
+	var errs utils.ValidationErrors
+	for _, t := range b.templates {
+		for _, variable := range t.tmpl.Variables() {
+			if !known[variable] {
+				errs.Add(t.field, "unknown variable %s: no recipient has a field of that name", variable)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// bulkTemplateError is a template of a bulk request failing for a recipient
+type bulkTemplateError struct {
+	field string // subject, body or html_body
+	err   error
+}
+
+func (e *bulkTemplateError) Error() string {
+	return e.field + ": " + e.err.Error()
+}
+
+func (e *bulkTemplateError) Unwrap() error {
+	return e.err
+}
+
+// bulkRecordVariables returns the template variables of a recipient: their
+// fields, plus email and name
+func bulkRecordVariables(record BulkEmailRecord) map[string]interface{} {
+	data := make(map[string]interface{}, len(record.Fields)+2)
+	for key, value := range record.Fields {
+		data[utils.NormalizeTemplateVariable(key)] = value
+	}
+	data["email"] = record.Email
+	if record.Name != "" || data["name"] == nil {
+		data["name"] = record.Name
+	}
+	return data
+}
+
+// preflightBulkEmails validates the personalized message of every recipient
+// before anything is sent. A variable no recipient has is reported on the
+// template using it, and a recipient without a value for a variable as
+// emails[i].fields.<variable>. Errors on the recipient address are reported as
+// emails[i].email, and errors shared by all messages are reported once.
+func preflightBulkEmails(req *BulkEmailRequest, from, replyTo utils.EmailAddress) error {
+	composer, err := newBulkComposer(req, from, replyTo)
+	if err != nil {
+		return err
+	}
+
+	if err := composer.checkVariables(req.Emails); err != nil {
+		return err
+	}
+
+	var errs utils.ValidationErrors
+	seen := make(map[string]bool)
+	for i, record := range req.Emails {
+		var recordErrs utils.ValidationErrors
+
+		message, _, err := composer.compose(record)
+		var templateErr *utils.TemplateError
+		switch {
+		case errors.As(err, &templateErr):
+			recordErrs.Add(fmt.Sprintf("emails[%d].fields.%s", i, templateErr.Variable), "%v", err)
+		case err != nil:
+			return err
+		case i == 0:
+			// Fully compose the first message to check attachments and the size limit
+			if _, err := utils.BuildMIMEMessage(message); err != nil && !errors.As(err, &recordErrs) {
+				return err
+			}
+		default:
+			message.Attachments = nil
+			recordErrs = utils.ValidateEmailMessage(message)
+		}
+
+		for _, fieldError := range recordErrs {
+			if strings.HasPrefix(fieldError.Field, "to[0]") {
+				fieldError.Field = fmt.Sprintf("emails[%d]", i) + strings.TrimPrefix(fieldError.Field, "to[0]")
+			}
+			if key := fieldError.Field + ": " + fieldError.Message; !seen[key] {
+				seen[key] = true
+				errs = append(errs, fieldError)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// SendBulkEmails validates a batch and queues it as a bulk job. The background
+// worker sends the emails, so the response only carries the job ID. With
+// send_at the batch is scheduled instead and queued by the scheduler.
+func SendBulkEmails(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var req BulkEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Emails) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No emails provided"})
+		return
+	}
+
+	// Limit number of emails
+	const maxBulkEmails = 100
+	if len(req.Emails) > maxBulkEmails {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Maximum %d emails allowed per batch", maxBulkEmails)})
+		return
+	}
+
+	sendAt, err := parseSendAt(req.SendAt, req.TimeZone)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	from, err := parseFrom(req.From)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	replyTo, err := parseReplyTo(req.ReplyTo)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	if err := applyBulkTemplate(userID, &req); err != nil {
+		respondEmailTemplateError(c, err)
+		return
+	}
+
+	// Preflight every personalized message so nothing is sent from an invalid batch
+	if err := preflightBulkEmails(&req, from, replyTo); err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	if err := validateBulkSenders(&req); err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	// Make sure the job can actually be sent before queueing it
+	if len(req.Senders) > 0 {
+		for _, bulkSender := range req.Senders {
+			if _, err := loadGmailAccount(userID, bulkSender.AccountID); err != nil {
+				respondGmailTokenError(c, err)
+				return
+			}
+		}
+	} else {
+		sender, err := loadMailSender(userID, req.FromAccountID)
+		if err != nil {
+			respondMailSenderError(c, err)
+			return
+		}
+		req.FromAccountID = sender.accountID()
+
+		if from, err = resolveSendAs(sender, req.From); err != nil {
+			respondSendAsError(c, err)
+			return
+		}
+		if from.Email != "" {
+			req.From = from.String()
+		}
+	}
+
+	if sendAt != nil {
+		// The send time is kept on the scheduled email, where it can be changed,
+		// and the account is kept even if another one becomes the default
+		timeZone := req.TimeZone
+		req.SendAt, req.TimeZone = "", ""
+		scheduleEmail(c, userID.(uint), models.ScheduledBulk, *sendAt, timeZone, req.Subject, len(req.Emails), &req)
+		return
+	}
+
+	job, err := newBulkJob(userID.(uint), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare bulk job"})
+		return
+	}
+
+	if err := config.DB.Create(job).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue bulk job"})
+		return
+	}
+
+	wakeBulkWorker()
+
+	fmt.Printf("User %v queued bulk job %s with %d emails\n", userID, job.ID, job.TotalCount)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":      "Bulk email job queued",
+		"job_id":       job.ID,
+		"batch_id":     job.ID,
+		"status":       job.Status,
+		"total_emails": job.TotalCount,
+	})
+}
+
+// newBulkJob creates a queued job, with one pending recipient per email, from a bulk request
+func newBulkJob(userID uint, req *BulkEmailRequest) (*models.BulkJob, error) {
+	attachments, err := json.Marshal(req.Attachments)
+	if err != nil {
+		return nil, err
+	}
+
+	senders := ""
+	if len(req.Senders) > 0 {
+		encoded, err := json.Marshal(req.Senders)
+		if err != nil {
+			return nil, err
+		}
+		senders = string(encoded)
+	}
+
+	job := &models.BulkJob{
+		ID:           uuid.New().String(),
+		UserID:       userID,
+		Status:       models.BulkJobQueued,
+		Subject:      req.Subject,
+		Body:         req.Body,
+		BodyFormat:   req.BodyFormat,
+		HTMLBody:     req.HTMLBody,
+		From:         req.From,
+		ReplyTo:      req.ReplyTo,
+		GmailTokenID: req.FromAccountID,
+		Senders:      senders,
+		Rotation:     req.Rotation,
+		Attachments:  string(attachments),
+		TotalCount:   len(req.Emails),
+	}
+	if req.TemplateID != 0 {
+		templateID := req.TemplateID
+		job.TemplateID, job.TemplateVersion = &templateID, req.TemplateVersion
+	}
+
+	for i, record := range req.Emails {
+		fields, err := encodeRecordFields(record.Fields)
+		if err != nil {
+			return nil, err
+		}
+		job.Recipients = append(job.Recipients, models.BulkJobRecipient{
+			Position: i,
+			Email:    record.Email,
+			Name:     record.Name,
+			Fields:   fields,
+			Status:   models.RecipientPending,
+		})
+	}
+
+	return job, nil
+}
+
+// encodeRecordFields encodes the merge fields of a recipient for storing, empty if there are none
+func encodeRecordFields(fields map[string]interface{}) (string, error) {
+	if len(fields) == 0 {
+		return "", nil
+	}
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// bulkRecipientRecord rebuilds the record a job recipient was created from
+func bulkRecipientRecord(recipient *models.BulkJobRecipient) (BulkEmailRecord, error) {
+	record := BulkEmailRecord{Email: recipient.Email, Name: recipient.Name}
+	if recipient.Fields != "" {
+		if err := json.Unmarshal([]byte(recipient.Fields), &record.Fields); err != nil {
+			return record, fmt.Errorf("failed to decode recipient fields: %v", err)
+		}
+	}
+	return record, nil
+}
+
+// bulkRequestFromJob rebuilds the bulk request a job was created from, without its recipients
+func bulkRequestFromJob(job *models.BulkJob) (*BulkEmailRequest, error) {
+	req := &BulkEmailRequest{
+		From:            job.From,
+		ReplyTo:         job.ReplyTo,
+		Subject:         job.Subject,
+		Body:            job.Body,
+		BodyFormat:      job.BodyFormat,
+		HTMLBody:        job.HTMLBody,
+		TemplateVersion: job.TemplateVersion,
+	}
+	if job.TemplateID != nil {
+		req.TemplateID = *job.TemplateID
+	}
+
+	if job.Attachments != "" {
+		if err := json.Unmarshal([]byte(job.Attachments), &req.Attachments); err != nil {
+			return nil, fmt.Errorf("failed to decode job attachments: %v", err)
+		}
+	}
+
+	return req, nil
+}
+
+// findUserBulkJob loads a bulk job owned by the user in the request context
+func findUserBulkJob(c *gin.Context, userID interface{}) (*models.BulkJob, bool) {
+	var job models.BulkJob
+	if err := config.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&job).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Bulk job not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load bulk job"})
+		}
+		return nil, false
+	}
+	return &job, true
+}
+
+// ListBulkJobs lists the user's bulk jobs, most recent first
+func ListBulkJobs(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	query := config.DB.Where("user_id = ?", userID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var jobs []models.BulkJob
+	if err := query.Order("created_at DESC").Limit(50).Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load bulk jobs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+}
+
+// GetBulkJob returns a bulk job with the result of every processed recipient
+func GetBulkJob(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	job, ok := findUserBulkJob(c, userID)
+	if !ok {
+		return
+	}
+
+	var recipients []models.BulkJobRecipient
+	config.DB.Where("job_id = ? AND status <> ?", job.ID, models.RecipientPending).Order("position").Find(&recipients)
+
+	results := make([]BulkEmailResult, 0, len(recipients))
+	for _, recipient := range recipients {
+		results = append(results, bulkEmailResult(&recipient))
+	}
+
+	c.JSON(http.StatusOK, BulkJobResponse{
+		BulkJob: *job,
+		Results: results,
+	})
+}
+
+// bulkEmailResult converts a processed recipient into the result reported to clients
+func bulkEmailResult(recipient *models.BulkJobRecipient) BulkEmailResult {
+	return BulkEmailResult{
+		Email:     recipient.Email,
+		Success:   recipient.Status == models.RecipientSent,
+		Status:    recipient.Status,
+		Error:     recipient.ErrorMessage,
+		AccountID: recipient.GmailTokenID,
+	}
+}
+
+// transitionBulkJob atomically moves a job from one of the from statuses to the status in updates
+func transitionBulkJob(jobID string, from []string, updates map[string]interface{}) (bool, error) {
+	result := config.DB.Model(&models.BulkJob{}).
+		Where("id = ? AND status IN ?", jobID, from).
+		Updates(updates)
+	return result.RowsAffected > 0, result.Error
+}
+
+// respondBulkJobTransition replies to a pause, resume or cancel request with the job's current state
+func respondBulkJobTransition(c *gin.Context, job *models.BulkJob, changed bool, err error, action, pastTense string) {
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to %s bulk job", action)})
+		return
+	}
+
+	// Reload into a fresh struct so columns cleared by the transition read back empty
+	current := models.BulkJob{}
+	config.DB.First(&current, "id = ?", job.ID)
+	job = &current
+	if !changed {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  fmt.Sprintf("Bulk job is %s and cannot be %s", job.Status, pastTense),
+			"status": job.Status,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Bulk job %s", job.Status),
+		"job":     job,
+	})
+}
+
+// PauseBulkJob stops dispatching a queued or running job. Emails already being
+// sent finish, the remaining recipients stay pending until the job is resumed.
+// A job running in another process stops before its next recipient.
+func PauseBulkJob(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	job, ok := findUserBulkJob(c, userID)
+	if !ok {
+		return
+	}
+
+	changed, err := transitionBulkJob(job.ID,
+		[]string{models.BulkJobQueued, models.BulkJobRunning},
+		map[string]interface{}{"status": models.BulkJobPaused, "pause_reason": models.PauseReasonManual})
+	if changed {
+		stopBulkJob(job.ID)
+	}
+
+	respondBulkJobTransition(c, job, changed, err, "pause", "paused")
+}
+
+// ResumeBulkJob queues a paused job again so the worker sends its pending recipients
+func ResumeBulkJob(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	job, ok := findUserBulkJob(c, userID)
+	if !ok {
+		return
+	}
+
+	changed, err := transitionBulkJob(job.ID,
+		[]string{models.BulkJobPaused},
+		map[string]interface{}{"status": models.BulkJobQueued, "pause_reason": "", "resume_at": nil})
+	if changed {
+		wakeBulkWorker()
+	}
+
+	respondBulkJobTransition(c, job, changed, err, "resume", "resumed")
+}
+
+// CancelBulkJob stops a job for good and records its remaining recipients as cancelled
+func CancelBulkJob(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	job, ok := findUserBulkJob(c, userID)
+	if !ok {
+		return
+	}
+
+	changed, err := transitionBulkJob(job.ID,
+		[]string{models.BulkJobQueued, models.BulkJobRunning, models.BulkJobPaused},
+		map[string]interface{}{"status": models.BulkJobCancelled, "completed_at": time.Now()})
+
+	// A job running in this process, or leased to another one, cancels its
+	// own pending recipients once its in-flight sends are done; otherwise they
+	// are cancelled right here
+	if changed && !stopBulkJob(job.ID) && !bulkJobLeasedElsewhere(job.ID) {
+		closePendingRecipients(job, "cancelled", "Cancelled before sending")
+	}
+
+	respondBulkJobTransition(c, job, changed, err, "cancel", "cancelled")
+}
+
+// RetryBulkJobRequest selects which failed recipients of a batch are sent again
+type RetryBulkJobRequest struct {
+	TransientOnly bool `json:"transient_only"` // Only retry rate limit, server and network failures
+}
+
+// RetryBulkJob queues a new job that re-sends the failed recipients of a batch
+// with the original subject, body and attachments. Each recipient is linked to
+// the failed history row it retries, so a failure is only retried once unless
+// its retry was cancelled.
+func RetryBulkJob(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var req RetryBulkJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	job, ok := findUserBulkJob(c, userID)
+	if !ok {
+		return
+	}
+
+	query := config.DB.Where("user_id = ? AND batch_id = ? AND status = ?", userID, job.ID, "failed").
+		Where("id NOT IN (?)", config.DB.Model(&models.BulkJobRecipient{}).
+			Select("retry_of_id").
+			Where("retry_of_id IS NOT NULL AND status <> ?", models.RecipientCancelled))
+	if req.TransientOnly {
+		query = query.Where("retryable = ?", true)
+	}
+
+	var failed []models.EmailHistory
+	if err := query.Order("id").Find(&failed).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load failed recipients"})
+		return
+	}
+
+	if len(failed) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "No failed recipients to retry"})
+		return
+	}
+
+	if _, err := loadBulkJobSenders(job); err != nil {
+		respondMailSenderError(c, err)
+		return
+	}
+
+	retry := &models.BulkJob{
+		ID:              uuid.New().String(),
+		UserID:          job.UserID,
+		Status:          models.BulkJobQueued,
+		Subject:         job.Subject,
+		Body:            job.Body,
+		BodyFormat:      job.BodyFormat,
+		HTMLBody:        job.HTMLBody,
+		From:            job.From,
+		ReplyTo:         job.ReplyTo,
+		GmailTokenID:    job.GmailTokenID,
+		Senders:         job.Senders,
+		Rotation:        job.Rotation,
+		RetryOfJobID:    job.ID,
+		Attachments:     job.Attachments,
+		TemplateID:      job.TemplateID,
+		TemplateVersion: job.TemplateVersion,
+		TotalCount:      len(failed),
+	}
+
+	// The history rows do not keep the merge fields, so take them from the job's recipients
+	var original []models.BulkJobRecipient
+	if err := config.DB.Select("email", "fields").Where("job_id = ? AND fields <> ?", job.ID, "").Find(&original).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load failed recipients"})
+		return
+	}
+	fieldsByEmail := make(map[string]string, len(original))
+	for _, recipient := range original {
+		fieldsByEmail[strings.ToLower(recipient.Email)] = recipient.Fields
+	}
+
+	for i := range failed {
+		retry.Recipients = append(retry.Recipients, models.BulkJobRecipient{
+			Position:  i,
+			Email:     failed[i].RecipientEmail,
+			Name:      failed[i].RecipientName,
+			Fields:    fieldsByEmail[strings.ToLower(failed[i].RecipientEmail)],
+			Status:    models.RecipientPending,
+			RetryOfID: &failed[i].ID,
+		})
+	}
+
+	if err := config.DB.Create(retry).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue retry job"})
+		return
+	}
+
+	wakeBulkWorker()
+
+	fmt.Printf("User %v queued retry job %s for %d failed emails of bulk job %s\n", userID, retry.ID, retry.TotalCount, job.ID)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":         "Retry job queued",
+		"job_id":          retry.ID,
+		"batch_id":        retry.ID,
+		"retry_of_job_id": job.ID,
+		"status":          retry.Status,
+		"total_emails":    retry.TotalCount,
+	})
+}
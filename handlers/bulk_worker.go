@@ -0,0 +1,588 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/transport"
+	"email-app-backend/utils"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// bulkWorkerPollInterval is how often the worker checks for queued jobs when it is not woken up
+	bulkWorkerPollInterval = 5 * time.Second
+
+	// maxRunningBulkJobs limits how many jobs are sent at the same time
+	maxRunningBulkJobs = 3
+
+	// maxConcurrentSends limits the concurrent Gmail API calls of a single job
+	maxConcurrentSends = 5
+
+	// bulkJobLeaseDuration is how long a process holds a job it runs without
+	// renewing it; another process only takes the job over once it expires
+	bulkJobLeaseDuration = time.Minute
+
+	// bulkJobHeartbeatInterval is how often a running job's lease is renewed
+	bulkJobHeartbeatInterval = 15 * time.Second
+)
+
+// errRecipientProcessed is returned when recording a recipient that is no longer pending
+var errRecipientProcessed = errors.New("recipient already processed")
+
+var (
+	// bulkWorkerID identifies this process as the owner of the jobs it runs
+	bulkWorkerID = newBulkWorkerID()
+
+	bulkWorkerWakeup  = make(chan struct{}, 1)
+	runningBulkJobs   = make(map[string]context.CancelFunc)
+	runningBulkJobsMu sync.Mutex
+)
+
+// newBulkWorkerID names this process after its host and pid, with a random
+// suffix so a restarted process with the same pid is told apart
+func newBulkWorkerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), uuid.NewString()[:8])
+}
+
+// StartBulkWorker starts draining the bulk job queue in the background.
+// Jobs whose process stopped renewing their lease, e.g. because it was
+// restarted, are queued again, so their pending recipients are picked up
+// where they stopped. Jobs other processes are still running are left alone.
+func StartBulkWorker() {
+	go func() {
+		ticker := time.NewTicker(bulkWorkerPollInterval)
+		defer ticker.Stop()
+
+		for {
+			startQueuedBulkJobs()
+
+			select {
+			case <-ticker.C:
+			case <-bulkWorkerWakeup:
+			}
+		}
+	}()
+}
+
+// wakeBulkWorker makes the worker look for queued jobs immediately
+func wakeBulkWorker() {
+	select {
+	case bulkWorkerWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// startQueuedBulkJobs claims queued jobs, oldest first, while there is room to
+// run them. Jobs paused by the daily limit are queued again once it resets.
+func startQueuedBulkJobs() {
+	requeueExpiredBulkJobs()
+	closeAbandonedBulkJobs()
+	resumeDueBulkJobs()
+
+	runningBulkJobsMu.Lock()
+	available := maxRunningBulkJobs - len(runningBulkJobs)
+	runningBulkJobsMu.Unlock()
+
+	if available <= 0 {
+		return
+	}
+
+	var jobs []models.BulkJob
+	if err := config.DB.Where("status = ?", models.BulkJobQueued).Order("created_at").Limit(available).Find(&jobs).Error; err != nil {
+		fmt.Printf("Bulk worker failed to load queued jobs: %v\n", err)
+		return
+	}
+
+	for i := range jobs {
+		job := jobs[i]
+		if !claimBulkJob(&job) {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		runningBulkJobsMu.Lock()
+		runningBulkJobs[job.ID] = cancel
+		runningBulkJobsMu.Unlock()
+
+		go func() {
+			done := make(chan struct{})
+			defer func() {
+				close(done)
+				releaseBulkJob(job.ID)
+				runningBulkJobsMu.Lock()
+				delete(runningBulkJobs, job.ID)
+				runningBulkJobsMu.Unlock()
+				cancel()
+				wakeBulkWorker()
+			}()
+
+			go heartbeatBulkJob(job.ID, done)
+			runBulkJob(ctx, &job)
+		}()
+	}
+}
+
+// stopBulkJob stops dispatching a job running in this process. It reports
+// whether the job was running here; if so, its runner records the outcome
+// of the pending recipients once every in-flight send has finished.
+func stopBulkJob(jobID string) bool {
+	runningBulkJobsMu.Lock()
+	defer runningBulkJobsMu.Unlock()
+
+	cancel, running := runningBulkJobs[jobID]
+	if running {
+		cancel()
+	}
+	return running
+}
+
+// claimBulkJob atomically moves a queued job to running, leased to this
+// process, so it is only sent once. A job paused and resumed while its
+// previous runner is still finishing in-flight sends is claimed once that
+// runner releases it, or its lease expires.
+func claimBulkJob(job *models.BulkJob) bool {
+	now := time.Now()
+	result := config.DB.Model(&models.BulkJob{}).
+		Where("id = ? AND status = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?)", job.ID, models.BulkJobQueued, now).
+		Updates(map[string]interface{}{
+			"status":           models.BulkJobRunning,
+			"worker_id":        bulkWorkerID,
+			"lease_expires_at": now.Add(bulkJobLeaseDuration),
+			"started_at":       gorm.Expr("COALESCE(started_at, ?)", now),
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+
+	job.Status = models.BulkJobRunning
+	job.WorkerID = bulkWorkerID
+	return true
+}
+
+// heartbeatBulkJob renews the lease of a job this process runs until done is
+// closed. If the lease was lost, because renewing failed for longer than it
+// lasts and another process took the job over, the job stops here.
+func heartbeatBulkJob(jobID string, done <-chan struct{}) {
+	ticker := time.NewTicker(bulkJobHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		result := config.DB.Model(&models.BulkJob{}).
+			Where("id = ? AND worker_id = ? AND lease_expires_at IS NOT NULL", jobID, bulkWorkerID).
+			Update("lease_expires_at", time.Now().Add(bulkJobLeaseDuration))
+		if result.Error != nil {
+			fmt.Printf("Bulk job %s failed to renew its lease: %v\n", jobID, result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			fmt.Printf("Bulk job %s lost its lease, stopping\n", jobID)
+			stopBulkJob(jobID)
+			return
+		}
+	}
+}
+
+// releaseBulkJob gives up this process's lease on a job once its runner is done
+func releaseBulkJob(jobID string) {
+	err := config.DB.Model(&models.BulkJob{}).
+		Where("id = ? AND worker_id = ?", jobID, bulkWorkerID).
+		Updates(map[string]interface{}{"worker_id": "", "lease_expires_at": nil}).Error
+	if err != nil {
+		fmt.Printf("Bulk job %s failed to release its lease: %v\n", jobID, err)
+	}
+}
+
+// closeAbandonedBulkJobs records the pending recipients of jobs cancelled
+// while running in a process that stopped before it could, as cancelled
+func closeAbandonedBulkJobs() {
+	var jobs []models.BulkJob
+	err := config.DB.Where("status = ? AND lease_expires_at < ?", models.BulkJobCancelled, time.Now()).Find(&jobs).Error
+	if err != nil {
+		fmt.Printf("Bulk worker failed to load abandoned jobs: %v\n", err)
+		return
+	}
+
+	for i := range jobs {
+		closePendingRecipients(&jobs[i], "cancelled", "Cancelled before sending")
+		config.DB.Model(&models.BulkJob{}).
+			Where("id = ? AND worker_id = ?", jobs[i].ID, jobs[i].WorkerID).
+			Updates(map[string]interface{}{"worker_id": "", "lease_expires_at": nil})
+	}
+}
+
+// requeueExpiredBulkJobs queues the running jobs whose process stopped
+// renewing their lease, so their pending recipients are sent by whichever
+// process claims them next
+func requeueExpiredBulkJobs() {
+	result := config.DB.Model(&models.BulkJob{}).
+		Where("status = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?)", models.BulkJobRunning, time.Now()).
+		Updates(map[string]interface{}{
+			"status":           models.BulkJobQueued,
+			"worker_id":        "",
+			"lease_expires_at": nil,
+		})
+	if result.Error != nil {
+		fmt.Printf("Bulk worker failed to requeue interrupted jobs: %v\n", result.Error)
+	} else if result.RowsAffected > 0 {
+		fmt.Printf("Bulk worker requeued %d interrupted jobs\n", result.RowsAffected)
+	}
+}
+
+// runBulkJob sends the pending recipients of a running job and marks it completed.
+// Dispatch stops as soon as ctx is cancelled because the job was paused or
+// cancelled here, or once the job is found paused or cancelled between
+// recipients, for a request another process served. If its recipients cannot
+// be loaded the job is left running, so the worker queues it again once this
+// process releases it.
+func runBulkJob(ctx context.Context, job *models.BulkJob) {
+	startTime := time.Now()
+	finish := true
+	defer func() {
+		if finish {
+			finishBulkJob(job, startTime)
+		}
+	}()
+
+	req, err := bulkRequestFromJob(job)
+	if err != nil {
+		closePendingRecipients(job, "failed", err.Error())
+		return
+	}
+
+	// The from and reply-to addresses and the templates were validated when the job was queued
+	from, _ := parseFrom(req.From)
+	replyTo, _ := parseReplyTo(req.ReplyTo)
+	composer, err := newBulkComposer(req, from, replyTo)
+	if err != nil {
+		closePendingRecipients(job, "failed", err.Error())
+		return
+	}
+
+	senders, err := loadBulkJobSenders(job)
+	if errors.Is(err, errGmailRevoked) {
+		// Keep the recipients pending so the job can be resumed after reconnecting
+		pauseRunningBulkJob(job, models.PauseReasonGmailRevoked, nil)
+		return
+	}
+	if errors.Is(err, errGmailService) {
+		closePendingRecipients(job, "failed", "Failed to create Gmail service")
+		return
+	}
+	if isGmailSenderError(err) {
+		closePendingRecipients(job, "failed", "Gmail account not connected")
+		return
+	}
+	if err != nil {
+		closePendingRecipients(job, "failed", err.Error())
+		return
+	}
+	rotation := newSenderRotation(job.Rotation, senders)
+
+	var recipients []models.BulkJobRecipient
+	if err := config.DB.Where("job_id = ? AND status = ?", job.ID, models.RecipientPending).Order("position").Find(&recipients).Error; err != nil {
+		fmt.Printf("Bulk job %s failed to load recipients: %v\n", job.ID, err)
+		finish = false
+		return
+	}
+
+	// Process emails concurrently; each account's send limiter adapts how many
+	// are in flight to the rate limit errors Gmail reports
+	queue := make(chan *models.BulkJobRecipient)
+	var wg sync.WaitGroup
+	for i := 0; i < maxConcurrentSends; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for recipient := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				sendRotatedRecipient(ctx, job, composer, rotation, recipient)
+			}
+		}()
+	}
+
+dispatch:
+	for i := range recipients {
+		if !bulkJobRunningHere(job.ID) {
+			stopBulkJob(job.ID)
+			break
+		}
+
+		select {
+		case queue <- &recipients[i]:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	// Once every in-flight send is done, whatever is left of a cancelled job is recorded as cancelled
+	var current models.BulkJob
+	if err := config.DB.First(&current, "id = ?", job.ID).Error; err == nil && current.Status == models.BulkJobCancelled {
+		closePendingRecipients(job, "cancelled", "Cancelled before sending")
+	}
+}
+
+// bulkJobRunningHere reports whether a job is still running and leased to
+// this process. If the database cannot tell, the job keeps going.
+func bulkJobRunningHere(jobID string) bool {
+	var count int64
+	err := config.DB.Model(&models.BulkJob{}).
+		Where("id = ? AND status = ? AND worker_id = ?", jobID, models.BulkJobRunning, bulkWorkerID).
+		Count(&count).Error
+	if err != nil {
+		fmt.Printf("Bulk job %s failed to check its status: %v\n", jobID, err)
+		return true
+	}
+	return count > 0
+}
+
+// bulkJobLeasedElsewhere reports whether another process holds a live lease on
+// a job, so its runner there records the outcome of the pending recipients
+func bulkJobLeasedElsewhere(jobID string) bool {
+	var count int64
+	config.DB.Model(&models.BulkJob{}).
+		Where("id = ? AND worker_id NOT IN ? AND lease_expires_at >= ?", jobID, []string{"", bulkWorkerID}, time.Now()).
+		Count(&count)
+	return count > 0
+}
+
+// sendRotatedRecipient sends to one recipient from the next account of the
+// rotation. An account that reached its daily limit or lost access is taken out
+// of the rotation and another one is tried; once none is left the job is paused.
+func sendRotatedRecipient(ctx context.Context, job *models.BulkJob, composer *bulkComposer, rotation *senderRotation, recipient *models.BulkJobRecipient) {
+	for ctx.Err() == nil {
+		sender, resetAt := rotation.pick()
+		if sender == nil {
+			if resetAt.IsZero() {
+				pauseRunningBulkJob(job, models.PauseReasonGmailRevoked, nil)
+			} else {
+				pauseRunningBulkJob(job, models.PauseReasonDailyLimit, &resetAt)
+			}
+			return
+		}
+
+		err := sendBulkRecipient(ctx, job, composer, sender, recipient)
+		var limitErr *dailyLimitError
+		switch {
+		case errors.As(err, &limitErr):
+			rotation.limitReached(sender, limitErr.resetAt)
+		case isInvalidGrant(err):
+			rotation.revoked(sender)
+		default:
+			return
+		}
+	}
+}
+
+// sendBulkRecipient sends the personalized email for one recipient and records
+// the outcome. If the daily limit is reached, Gmail access was revoked or ctx
+// ends before the email is sent, the recipient stays pending and the error is returned.
+func sendBulkRecipient(ctx context.Context, job *models.BulkJob, composer *bulkComposer, sender *mailSender, recipient *models.BulkJobRecipient) error {
+	var message *utils.EmailMessage
+	var raw []byte
+	record, err := bulkRecipientRecord(recipient)
+	if err == nil {
+		message, _, err = composer.compose(record)
+	}
+	if err == nil {
+		raw, err = utils.BuildMIMEMessage(message)
+	}
+
+	messageID := ""
+	if err == nil {
+		messageID, err = sendWithRetry(ctx, sender, &transport.Message{Recipients: []string{recipient.Email}, Raw: raw})
+	}
+
+	var limitErr *dailyLimitError
+	if errors.As(err, &limitErr) || isInvalidGrant(err) || (err != nil && ctx.Err() != nil) {
+		return err
+	}
+
+	// Track email history, with the templates if they could not be personalized
+	subject, body := job.Subject, historyBody(job.Body, job.HTMLBody)
+	if message != nil {
+		subject, body = message.Subject, historyBody(message.TextBody, message.HTMLBody)
+	}
+	emailHistory := models.EmailHistory{
+		UserID:          job.UserID,
+		EmailType:       "bulk",
+		RecipientEmail:  recipient.Email,
+		RecipientName:   recipient.Name,
+		RecipientType:   "to",
+		Subject:         subject,
+		Body:            body,
+		Status:          "sent",
+		ErrorMessage:    "",
+		BatchID:         job.ID,
+		GmailMessageID:  messageID,
+		GmailTokenID:    sender.accountID(),
+		SenderEmail:     sender.address(),
+		Transport:       sender.transport.Name(),
+		RetryOfID:       recipient.RetryOfID,
+		TemplateID:      job.TemplateID,
+		TemplateVersion: job.TemplateVersion,
+		SentAt:          time.Now(),
+	}
+
+	if err != nil {
+		emailHistory.Status = "failed"
+		emailHistory.ErrorMessage = fmt.Sprintf("Failed to send: %v", err)
+		emailHistory.Retryable = utils.IsTransientSendError(err)
+	}
+
+	if err := recordBulkResult(job, recipient, &emailHistory); err != nil {
+		if err != errRecipientProcessed {
+			fmt.Printf("Bulk job %s failed to record result for %s: %v\n", job.ID, recipient.Email, err)
+		}
+	}
+	return nil
+}
+
+// pauseRunningBulkJob pauses a running job for reason and stops dispatching
+// its remaining recipients. With resumeAt the worker queues it again at that time.
+func pauseRunningBulkJob(job *models.BulkJob, reason string, resumeAt *time.Time) {
+	changed, err := transitionBulkJob(job.ID,
+		[]string{models.BulkJobRunning},
+		map[string]interface{}{
+			"status":       models.BulkJobPaused,
+			"pause_reason": reason,
+			"resume_at":    resumeAt,
+		})
+	if err != nil || !changed {
+		return
+	}
+
+	stopBulkJob(job.ID)
+	if resumeAt != nil {
+		fmt.Printf("Bulk job %s paused (%s) until %s\n", job.ID, reason, resumeAt.Format(time.RFC3339))
+	} else {
+		fmt.Printf("Bulk job %s paused (%s)\n", job.ID, reason)
+	}
+}
+
+// resumeDueBulkJobs queues the jobs paused by the daily limit whose pause is over
+func resumeDueBulkJobs() {
+	result := config.DB.Model(&models.BulkJob{}).
+		Where("status = ? AND pause_reason = ? AND resume_at <= ?", models.BulkJobPaused, models.PauseReasonDailyLimit, time.Now()).
+		Updates(map[string]interface{}{
+			"status":       models.BulkJobQueued,
+			"pause_reason": "",
+			"resume_at":    nil,
+		})
+	if result.Error != nil {
+		fmt.Printf("Bulk worker failed to resume paused jobs: %v\n", result.Error)
+	}
+}
+
+// recordBulkResult stores the outcome of one recipient: its status, the history
+// row and the job counters. A recipient is only recorded once; if it is no
+// longer pending, e.g. because the job was cancelled meanwhile, nothing is stored.
+func recordBulkResult(job *models.BulkJob, recipient *models.BulkJobRecipient, emailHistory *models.EmailHistory) error {
+	now := time.Now()
+	var counter string
+	switch emailHistory.Status {
+	case "failed":
+		recipient.Status = models.RecipientFailed
+		counter = "failed_count"
+	case "cancelled":
+		recipient.Status = models.RecipientCancelled
+		counter = "cancelled_count"
+	default:
+		recipient.Status = models.RecipientSent
+		counter = "sent_count"
+	}
+	recipient.ErrorMessage = emailHistory.ErrorMessage
+	recipient.GmailTokenID = emailHistory.GmailTokenID
+	recipient.ProcessedAt = &now
+
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.BulkJobRecipient{}).
+			Where("id = ? AND status = ?", recipient.ID, models.RecipientPending).
+			Updates(map[string]interface{}{
+				"status":         recipient.Status,
+				"error_message":  recipient.ErrorMessage,
+				"gmail_token_id": recipient.GmailTokenID,
+				"processed_at":   now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRecipientProcessed
+		}
+
+		if err := tx.Create(emailHistory).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.BulkJob{}).Where("id = ?", job.ID).
+			UpdateColumn(counter, gorm.Expr(counter+" + 1")).Error
+	})
+}
+
+// closePendingRecipients records every pending recipient of a job with status
+// ("failed" or "cancelled") and errorMsg, without sending to them
+func closePendingRecipients(job *models.BulkJob, status, errorMsg string) {
+	var recipients []models.BulkJobRecipient
+	config.DB.Where("job_id = ? AND status = ?", job.ID, models.RecipientPending).Order("position").Find(&recipients)
+
+	for i := range recipients {
+		emailHistory := models.EmailHistory{
+			UserID:         job.UserID,
+			EmailType:      "bulk",
+			RecipientEmail: recipients[i].Email,
+			RecipientName:  recipients[i].Name,
+			RecipientType:  "to",
+			Subject:        job.Subject,
+			Body:           historyBody(job.Body, job.HTMLBody),
+			Status:         status,
+			ErrorMessage:   errorMsg,
+			BatchID:        job.ID,
+			RetryOfID:      recipients[i].RetryOfID,
+			SentAt:         time.Now(),
+		}
+		if err := recordBulkResult(job, &recipients[i], &emailHistory); err != nil {
+			if err != errRecipientProcessed {
+				fmt.Printf("Bulk job %s failed to record result for %s: %v\n", job.ID, recipients[i].Email, err)
+			}
+		}
+	}
+}
+
+// finishBulkJob marks a job that is still running here as completed and logs
+// its totals. Paused and cancelled jobs keep their status, and so does a job
+// another process took over after this one lost its lease.
+func finishBulkJob(job *models.BulkJob, startTime time.Time) {
+	now := time.Now()
+	config.DB.Model(&models.BulkJob{}).
+		Where("id = ? AND status = ? AND worker_id = ?", job.ID, models.BulkJobRunning, bulkWorkerID).
+		Updates(map[string]interface{}{"status": models.BulkJobCompleted, "completed_at": now})
+
+	config.DB.First(job, "id = ?", job.ID)
+
+	fmt.Printf("User %v bulk job %s %s: %d total, %d success, %d failed, %d cancelled, took %v\n",
+		job.UserID, job.ID, job.Status, job.TotalCount, job.SentCount, job.FailedCount, job.CancelledCount, time.Since(startTime))
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/transport"
+	"email-app-backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PreviewEmailRequest is a bulk email to render for one recipient, chosen by
+// its position in emails or given as contact. Subject and bodies can be given
+// directly or by template_id, as for a bulk send.
+type PreviewEmailRequest struct {
+	BulkEmailRequest
+	Index    int              `json:"index"`             // Position in emails of the recipient to render for
+	Contact  *BulkEmailRecord `json:"contact,omitempty"` // Recipient to render for instead, such as one outside the batch
+	SendTest bool             `json:"send_test"`         // Also send the rendered email to the sending account's own address
+}
+
+// EmailPreviewResponse is the email a recipient would get, decoded from the
+// composed message
+type EmailPreviewResponse struct {
+	Recipient       BulkEmailRecord          `json:"recipient"`
+	Headers         map[string][]string      `json:"headers"`
+	Subject         string                   `json:"subject"`
+	TextBody        string                   `json:"text_body"`
+	HTMLBody        string                   `json:"html_body"`
+	Attachments     []utils.ParsedAttachment `json:"attachments"`
+	Size            int                      `json:"size"`     // Size of the encoded message in bytes
+	Warnings        []utils.HTMLWarning      `json:"warnings"` // What was removed from the HTML, and what renders badly in some email clients
+	TemplateID      uint                     `json:"template_id,omitempty"`
+	TemplateVersion int                      `json:"template_version,omitempty"`
+	TestSentTo      string                   `json:"test_sent_to,omitempty"`    // Address the test email was sent to
+	TestMessageID   string                   `json:"test_message_id,omitempty"` // ID the transport gave the test email
+}
+
+// PreviewEmail renders a bulk email for one recipient, with the same checks as
+// a bulk send, and returns the headers and bodies they would get. With
+// send_test it also sends the email to the sending account's own address; the
+// test is recorded in history as a "test" email, outside any batch.
+func PreviewEmail(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var req PreviewEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	record, field, err := previewRecord(&req)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	if err := applyBulkTemplate(userID, &req.BulkEmailRequest); err != nil {
+		respondEmailTemplateError(c, err)
+		return
+	}
+
+	from, err := parseFrom(req.From)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+	replyTo, err := parseReplyTo(req.ReplyTo)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	// The first account of a rotation stands in for the others
+	accountID := req.FromAccountID
+	if len(req.Senders) > 0 {
+		accountID = req.Senders[0].AccountID
+	}
+
+	// The sender is only needed to show the From address, unless a test is sent
+	sender, err := loadMailSender(userID, accountID)
+	if err != nil && req.SendTest {
+		respondMailSenderError(c, err)
+		return
+	}
+	if err == nil {
+		if from, err = resolveSendAs(sender, req.From); err != nil {
+			respondSendAsError(c, err)
+			return
+		}
+		if from.Email == "" {
+			from.Email = sender.address()
+		}
+	} else {
+		sender = nil
+	}
+
+	composer, err := newBulkComposer(&req.BulkEmailRequest, from, replyTo)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+	if err := composer.checkVariables(append(req.Emails, record)); err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	message, warnings, err := composer.compose(record)
+	var templateErr *utils.TemplateError
+	if errors.As(err, &templateErr) {
+		respondValidationError(c, utils.ValidationErrors{{Field: field + ".fields." + templateErr.Variable, Message: err.Error()}})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render email"})
+		return
+	}
+	if warnings == nil {
+		warnings = []utils.HTMLWarning{}
+	}
+
+	raw, err := utils.BuildMIMEMessage(message)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+	parsed, err := utils.ParseMIMEMessage(raw)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render email"})
+		return
+	}
+
+	response := EmailPreviewResponse{
+		Recipient:       record,
+		Headers:         parsed.Header,
+		Subject:         parsed.Subject,
+		TextBody:        parsed.TextBody,
+		HTMLBody:        parsed.HTMLBody,
+		Attachments:     parsed.Attachments,
+		Size:            len(raw),
+		Warnings:        warnings,
+		TemplateID:      req.TemplateID,
+		TemplateVersion: req.TemplateVersion,
+	}
+
+	if req.SendTest {
+		to := sender.address()
+		if to == "" {
+			userEmail, _ := c.Get("user_email")
+			to, _ = userEmail.(string)
+		}
+
+		messageID, err := sendTestEmail(c, userID.(uint), sender, message, to, &req.BulkEmailRequest)
+		if err != nil {
+			var limitErr *dailyLimitError
+			switch {
+			case errors.As(err, &limitErr):
+				respondDailyLimit(c, limitErr)
+			case isInvalidGrant(err):
+				respondGmailTokenError(c, err)
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send test email"})
+			}
+			return
+		}
+		response.TestSentTo, response.TestMessageID = to, messageID
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// previewRecord picks the recipient a preview renders for, and the request
+// field errors about it are reported on
+func previewRecord(req *PreviewEmailRequest) (BulkEmailRecord, string, error) {
+	if req.Contact != nil {
+		return *req.Contact, "contact", nil
+	}
+	if len(req.Emails) == 0 {
+		return BulkEmailRecord{}, "", utils.ValidationErrors{{Field: "emails", Message: "give the batch's emails and an index, or a contact"}}
+	}
+	if req.Index < 0 || req.Index >= len(req.Emails) {
+		return BulkEmailRecord{}, "", utils.ValidationErrors{{Field: "index", Message: fmt.Sprintf("must be between 0 and %d", len(req.Emails)-1)}}
+	}
+	return req.Emails[req.Index], fmt.Sprintf("emails[%d]", req.Index), nil
+}
+
+// sendTestEmail sends a rendered email to the user instead of its recipient
+// and records it in history as a test
+func sendTestEmail(c *gin.Context, userID uint, sender *mailSender, message *utils.EmailMessage, to string, req *BulkEmailRequest) (string, error) {
+	test := *message
+	test.To = []utils.EmailAddress{{Email: to}}
+	raw, err := utils.BuildMIMEMessage(&test)
+	if err != nil {
+		return "", err
+	}
+
+	messageID, err := sendWithRetry(c.Request.Context(), sender, &transport.Message{Recipients: []string{to}, Raw: raw})
+	var limitErr *dailyLimitError
+	if errors.As(err, &limitErr) {
+		return "", err
+	}
+
+	// Recorded so the test counts towards the account's daily limit
+	emailHistory := models.EmailHistory{
+		UserID:         userID,
+		EmailType:      "test",
+		RecipientEmail: to,
+		RecipientType:  "to",
+		Subject:        test.Subject,
+		Body:           historyBody(test.TextBody, test.HTMLBody),
+		Status:         "sent",
+		GmailMessageID: messageID,
+		GmailTokenID:   sender.accountID(),
+		SenderEmail:    sender.address(),
+		Transport:      sender.transport.Name(),
+		SentAt:         time.Now(),
+	}
+	if req.TemplateID != 0 {
+		emailHistory.TemplateID, emailHistory.TemplateVersion = &req.TemplateID, req.TemplateVersion
+	}
+	if err != nil {
+		emailHistory.Status = "failed"
+		emailHistory.ErrorMessage = err.Error()
+		emailHistory.Retryable = utils.IsTransientSendError(err)
+	}
+	config.DB.Create(&emailHistory)
+
+	return messageID, err
+}
@@ -0,0 +1,608 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// errEmailTemplateNotFound is returned for a template_id that is not one of the user's templates
+var errEmailTemplateNotFound = errors.New("template not found")
+
+// errEmailTemplateVersionNotFound is returned for a template_version the template never had
+var errEmailTemplateVersionNotFound = errors.New("template version not found")
+
+// errEmailTemplateChanged is returned when a template is edited by two requests at once
+var errEmailTemplateChanged = errors.New("template was changed by another request")
+
+// EmailTemplateRequest creates a template, or replaces its content with a new version
+type EmailTemplateRequest struct {
+	Name        string             `json:"name" binding:"required"`
+	Description string             `json:"description"`
+	Subject     string             `json:"subject"`
+	Body        string             `json:"body"`
+	BodyFormat  string             `json:"body_format"` // text (default), markdown or html
+	HTMLBody    string             `json:"html_body"`
+	Layout      *utils.EmailLayout `json:"layout"` // Blocks the HTML body is rendered from, instead of body
+}
+
+// EmailTemplateListResponse is a page of templates
+type EmailTemplateListResponse struct {
+	Templates  []models.EmailTemplate `json:"templates"`
+	TotalCount int64                  `json:"total_count"`
+	Page       int                    `json:"page"`
+	PageSize   int                    `json:"page_size"`
+	TotalPages int                    `json:"total_pages"`
+}
+
+// validateEmailTemplate checks a template's name, body format and layout, and
+// that its subject and bodies parse as merge templates
+func validateEmailTemplate(req *EmailTemplateRequest) error {
+	var errs utils.ValidationErrors
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		errs.Add("name", "name is required")
+	}
+	if strings.TrimSpace(req.Subject) == "" {
+		errs.Add("subject", "subject is required")
+	}
+	if req.Layout != nil {
+		fields := []struct{ name, value string }{{"body", req.Body}, {"body_format", req.BodyFormat}, {"html_body", req.HTMLBody}}
+		for _, field := range fields {
+			if field.value != "" {
+				errs.Add(field.name, "cannot be combined with layout")
+			}
+		}
+		if layoutErrs := utils.ValidateEmailLayout("layout", req.Layout); len(layoutErrs) > 0 {
+			return append(errs, layoutErrs...)
+		}
+	} else if req.Body == "" && req.HTMLBody == "" {
+		errs.Add("body", "either body, html_body or layout is required")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	content, err := templateContent(&models.EmailTemplateVersion{
+		Subject: req.Subject, Body: req.Body, BodyFormat: req.BodyFormat, HTMLBody: req.HTMLBody, Layout: req.Layout,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := newBulkComposer(content, utils.EmailAddress{}, utils.EmailAddress{}); err != nil {
+		var templateErrs utils.ValidationErrors
+		if !errors.As(err, &templateErrs) {
+			return err
+		}
+		// The body of a layout is rendered from it, so its errors are the layout's
+		for i := range templateErrs {
+			if req.Layout != nil && templateErrs[i].Field == "body" {
+				templateErrs[i].Field = "layout"
+			}
+		}
+		errs = append(errs, templateErrs...)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// emailTemplateNameTaken reports whether another of the user's templates has the name
+func emailTemplateNameTaken(userID interface{}, name string, exceptID uint) (bool, error) {
+	var count int64
+	err := config.DB.Model(&models.EmailTemplate{}).
+		Where("user_id = ? AND LOWER(name) = ? AND id <> ?", userID, strings.ToLower(name), exceptID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// templateVersion records the current content of a template as its version
+func templateVersion(template *models.EmailTemplate) *models.EmailTemplateVersion {
+	return &models.EmailTemplateVersion{
+		TemplateID:  template.ID,
+		Version:     template.Version,
+		Name:        template.Name,
+		Description: template.Description,
+		Subject:     template.Subject,
+		Body:        template.Body,
+		BodyFormat:  template.BodyFormat,
+		HTMLBody:    template.HTMLBody,
+		Layout:      template.Layout,
+	}
+}
+
+// templateContent returns the subject and bodies of a template version as a
+// bulk request. A layout is rendered as an HTML body, which is personalized
+// like any other when sent.
+func templateContent(version *models.EmailTemplateVersion) (*BulkEmailRequest, error) {
+	content := &BulkEmailRequest{Subject: version.Subject, Body: version.Body, BodyFormat: version.BodyFormat, HTMLBody: version.HTMLBody}
+	if version.Layout != nil {
+		body, err := utils.RenderEmailLayout(version.Layout)
+		if err != nil {
+			return nil, err
+		}
+		content.Body, content.BodyFormat, content.HTMLBody = body, utils.BodyFormatHTML, ""
+	}
+	return content, nil
+}
+
+// layoutColumn is the value of a template's layout column for a map update,
+// which writes values as given rather than through the field's serializer
+func layoutColumn(layout *utils.EmailLayout) (interface{}, error) {
+	if layout == nil {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(layout)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+// sameLayout reports whether two layouts are the same, comparing them as stored
+func sameLayout(a, b *utils.EmailLayout) bool {
+	encodedA, errA := layoutColumn(a)
+	encodedB, errB := layoutColumn(b)
+	return errA == nil && errB == nil && encodedA == encodedB
+}
+
+// loadEmailTemplateVersion loads a version of one of the user's templates,
+// its current one if version is 0
+func loadEmailTemplateVersion(userID interface{}, templateID uint, version int) (*models.EmailTemplateVersion, error) {
+	var template models.EmailTemplate
+	err := config.DB.Where("id = ? AND user_id = ?", templateID, userID).First(&template).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errEmailTemplateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		version = template.Version
+	}
+
+	var templateVersion models.EmailTemplateVersion
+	err = config.DB.Where("template_id = ? AND version = ?", template.ID, version).First(&templateVersion).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errEmailTemplateVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &templateVersion, nil
+}
+
+// checkTemplateContent rejects a subject, body or body format sent along with a template_id
+func checkTemplateContent(subject, body, bodyFormat, htmlBody string) error {
+	var errs utils.ValidationErrors
+	fields := []struct{ name, value string }{{"subject", subject}, {"body", body}, {"body_format", bodyFormat}, {"html_body", htmlBody}}
+	for _, field := range fields {
+		if field.value != "" {
+			errs.Add(field.name, "cannot be combined with template_id")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// applySendTemplate fills in the subject and bodies of a single email sent by
+// template_id. They are personalized with the email and name of the first To
+// recipient and the request's fields; a variable without a value is reported
+// as fields.<variable>. The body is rendered from the template's body format,
+// or layout, so the request is left with a text body and its HTML.
+func applySendTemplate(userID interface{}, req *SendEmailRequest) error {
+	if req.TemplateID == 0 {
+		var errs utils.ValidationErrors
+		if req.TemplateVersion != 0 {
+			errs.Add("template_version", "requires template_id")
+		}
+		if len(req.Fields) > 0 {
+			errs.Add("fields", "requires template_id")
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
+	}
+	if err := checkTemplateContent(req.Subject, req.Body, req.BodyFormat, req.HTMLBody); err != nil {
+		return err
+	}
+
+	version, err := loadEmailTemplateVersion(userID, req.TemplateID, req.TemplateVersion)
+	if err != nil {
+		return err
+	}
+
+	content, err := templateContent(version)
+	if err != nil {
+		return err
+	}
+	composer, err := newBulkComposer(content, utils.EmailAddress{}, utils.EmailAddress{})
+	if err != nil {
+		return err
+	}
+
+	record := BulkEmailRecord{Fields: req.Fields}
+	if len(req.To) > 0 {
+		record.Email, record.Name = req.To[0].Email, req.To[0].Name
+	}
+	message, _, err := composer.compose(record)
+	var templateErr *utils.TemplateError
+	if errors.As(err, &templateErr) {
+		return utils.ValidationErrors{{Field: "fields." + templateErr.Variable, Message: err.Error()}}
+	}
+	if err != nil {
+		return err
+	}
+
+	req.Subject, req.Body, req.HTMLBody = message.Subject, message.TextBody, message.HTMLBody
+	req.TemplateVersion = version.Version
+	return nil
+}
+
+// applyBulkTemplate fills in the subject and bodies of a bulk request sent by
+// template_id, rendering its layout if it has one; they are personalized for
+// each recipient when sent
+func applyBulkTemplate(userID interface{}, req *BulkEmailRequest) error {
+	if req.TemplateID == 0 {
+		if req.TemplateVersion != 0 {
+			return utils.ValidationErrors{{Field: "template_version", Message: "requires template_id"}}
+		}
+		return nil
+	}
+	if err := checkTemplateContent(req.Subject, req.Body, req.BodyFormat, req.HTMLBody); err != nil {
+		return err
+	}
+
+	version, err := loadEmailTemplateVersion(userID, req.TemplateID, req.TemplateVersion)
+	if err != nil {
+		return err
+	}
+
+	content, err := templateContent(version)
+	if err != nil {
+		return err
+	}
+	req.Subject, req.Body, req.BodyFormat, req.HTMLBody = content.Subject, content.Body, content.BodyFormat, content.HTMLBody
+	req.TemplateVersion = version.Version
+	return nil
+}
+
+// respondEmailTemplateError replies to a request whose template could not be used
+func respondEmailTemplateError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errEmailTemplateNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+	case errors.Is(err, errEmailTemplateVersionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template version not found"})
+	case errors.Is(err, errEmailTemplateChanged):
+		c.JSON(http.StatusConflict, gin.H{"error": "Template was changed by another request, load it and try again"})
+	case errors.As(err, new(utils.ValidationErrors)):
+		respondValidationError(c, err)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load template"})
+	}
+}
+
+// findUserEmailTemplate loads a template owned by the user in the request context
+func findUserEmailTemplate(c *gin.Context, userID interface{}) (*models.EmailTemplate, bool) {
+	var template models.EmailTemplate
+	if err := config.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&template).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load template"})
+		}
+		return nil, false
+	}
+	return &template, true
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern, for patterns used with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike makes text match literally inside a LIKE pattern
+func escapeLike(text string) string {
+	return likeEscaper.Replace(text)
+}
+
+// ListEmailTemplates lists the user's templates by name
+func ListEmailTemplates(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	page := 1
+	pageSize := 20
+	search := c.Query("search") // Part of the name, or empty for all
+
+	if p := c.Query("page"); p != "" {
+		if parsed, err := fmt.Sscanf(p, "%d", &page); err != nil || parsed != 1 || page < 1 {
+			page = 1
+		}
+	}
+
+	if ps := c.Query("page_size"); ps != "" {
+		if parsed, err := fmt.Sscanf(ps, "%d", &pageSize); err != nil || parsed != 1 || pageSize < 1 || pageSize > 100 {
+			pageSize = 20
+		}
+	}
+
+	query := config.DB.Model(&models.EmailTemplate{}).Where("user_id = ?", userID)
+	if search != "" {
+		query = query.Where(`LOWER(name) LIKE ? ESCAPE '\'`, "%"+escapeLike(strings.ToLower(search))+"%")
+	}
+
+	var totalCount int64
+	if err := query.Count(&totalCount).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load templates"})
+		return
+	}
+
+	templates := []models.EmailTemplate{}
+	offset := (page - 1) * pageSize
+	if err := query.Order("LOWER(name), id").Limit(pageSize).Offset(offset).Find(&templates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load templates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, EmailTemplateListResponse{
+		Templates:  templates,
+		TotalCount: totalCount,
+		Page:       page,
+		PageSize:   pageSize,
+		TotalPages: int((totalCount + int64(pageSize) - 1) / int64(pageSize)),
+	})
+}
+
+// CreateEmailTemplate saves a new template as its version 1
+func CreateEmailTemplate(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var req EmailTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateEmailTemplate(&req); err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	taken, err := emailTemplateNameTaken(userID, req.Name, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save template"})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "A template with this name already exists"})
+		return
+	}
+
+	template := &models.EmailTemplate{
+		UserID:      userID.(uint),
+		Name:        req.Name,
+		Description: req.Description,
+		Subject:     req.Subject,
+		Body:        req.Body,
+		BodyFormat:  req.BodyFormat,
+		HTMLBody:    req.HTMLBody,
+		Layout:      req.Layout,
+		Version:     1,
+	}
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(template).Error; err != nil {
+			return err
+		}
+		return tx.Create(templateVersion(template)).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save template"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, template)
+}
+
+// GetEmailTemplate returns a template with its current content
+func GetEmailTemplate(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	template, ok := findUserEmailTemplate(c, userID)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, template)
+}
+
+// UpdateEmailTemplate replaces a template's content, keeping the previous
+// content as an earlier version. A request that changes nothing adds no version.
+func UpdateEmailTemplate(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var req EmailTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateEmailTemplate(&req); err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	template, ok := findUserEmailTemplate(c, userID)
+	if !ok {
+		return
+	}
+
+	if req.Name == template.Name && req.Description == template.Description && req.Subject == template.Subject &&
+		req.Body == template.Body && req.BodyFormat == template.BodyFormat && req.HTMLBody == template.HTMLBody &&
+		sameLayout(req.Layout, template.Layout) {
+		c.JSON(http.StatusOK, template)
+		return
+	}
+
+	taken, err := emailTemplateNameTaken(userID, req.Name, template.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save template"})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "A template with this name already exists"})
+		return
+	}
+
+	previousVersion := template.Version
+	template.Name = req.Name
+	template.Description = req.Description
+	template.Subject = req.Subject
+	template.Body = req.Body
+	template.BodyFormat = req.BodyFormat
+	template.HTMLBody = req.HTMLBody
+	template.Layout = req.Layout
+	template.Version = previousVersion + 1
+
+	layout, err := layoutColumn(template.Layout)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save template"})
+		return
+	}
+
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		// Only move from the version that was loaded, so concurrent edits cannot both become version n+1
+		result := tx.Model(&models.EmailTemplate{}).
+			Where("id = ? AND version = ?", template.ID, previousVersion).
+			Updates(map[string]interface{}{
+				"name":        template.Name,
+				"description": template.Description,
+				"subject":     template.Subject,
+				"body":        template.Body,
+				"body_format": template.BodyFormat,
+				"html_body":   template.HTMLBody,
+				"layout":      layout,
+				"version":     template.Version,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errEmailTemplateChanged
+		}
+		return tx.Create(templateVersion(template)).Error
+	})
+	if errors.Is(err, errEmailTemplateChanged) {
+		respondEmailTemplateError(c, err)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save template"})
+		return
+	}
+
+	// Reload for the new updated_at
+	config.DB.First(template, template.ID)
+	c.JSON(http.StatusOK, template)
+}
+
+// DeleteEmailTemplate deletes a template. Its versions are kept, so the
+// history of emails sent from it still refers to existing content.
+func DeleteEmailTemplate(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	template, ok := findUserEmailTemplate(c, userID)
+	if !ok {
+		return
+	}
+
+	if err := config.DB.Delete(template).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete template"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Template deleted"})
+}
+
+// ListEmailTemplateVersions lists every version of a template, newest first
+func ListEmailTemplateVersions(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	template, ok := findUserEmailTemplate(c, userID)
+	if !ok {
+		return
+	}
+
+	versions := []models.EmailTemplateVersion{}
+	if err := config.DB.Where("template_id = ?", template.ID).Order("version DESC").Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load template versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"template_id":     template.ID,
+		"current_version": template.Version,
+		"versions":        versions,
+	})
+}
+
+// GetEmailTemplateVersion returns one version of a template
+func GetEmailTemplateVersion(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	template, ok := findUserEmailTemplate(c, userID)
+	if !ok {
+		return
+	}
+
+	var version models.EmailTemplateVersion
+	err := config.DB.Where("template_id = ? AND version = ?", template.ID, c.Param("version")).First(&version).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template version not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load template version"})
+		return
+	}
+
+	c.JSON(http.StatusOK, version)
+}
@@ -2,27 +2,25 @@ package handlers
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"email-app-backend/config"
 	"email-app-backend/models"
+	"email-app-backend/transport"
 	"email-app-backend/utils"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
 	"google.golang.org/api/option"
 )
@@ -59,12 +57,23 @@ func init() {
 		RedirectURL:  redirectURL,
 		Scopes: []string{
 			gmail.GmailSendScope,
+			// Needed to list the send-as aliases a message may be sent from
+			gmail.GmailSettingsBasicScope,
+			// Needed to record which address each connected account sends from
+			"https://www.googleapis.com/auth/userinfo.email",
 		},
-		Endpoint: google.Endpoint,
 	}
 
 }
 
+// gmailOAuthConfig returns the OAuth config with the current Google endpoints,
+// which tests may point at a fake
+func gmailOAuthConfig() *oauth2.Config {
+	oauthConfig := *googleOAuthConfig
+	oauthConfig.Endpoint = utils.GetGoogleEndpoints().OAuthEndpoint()
+	return &oauthConfig
+}
+
 func GetGmailAuthURL(c *gin.Context) {
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -75,7 +84,7 @@ func GetGmailAuthURL(c *gin.Context) {
 	// Generate state parameter with user ID for security
 	state := fmt.Sprintf("user_%d_%d", userID, time.Now().Unix())
 
-	url := googleOAuthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"))
+	url := gmailOAuthConfig().AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"))
 
 	c.JSON(http.StatusOK, gin.H{
 		"auth_url": url,
@@ -93,7 +102,7 @@ func HandleGmailCallback(c *gin.Context) {
 	}
 
 	// Exchange code for token
-	token, err := googleOAuthConfig.Exchange(context.Background(), code)
+	token, err := gmailOAuthConfig().Exchange(context.Background(), code)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to exchange code for token"})
 		return
@@ -106,124 +115,389 @@ func HandleGmailCallback(c *gin.Context) {
 		return
 	}
 
-	// Save or update Gmail token in database
+	// Save or update the Gmail account in database
 	gmailToken := models.GmailToken{
 		UserID:       userID,
-		AccessToken:  token.AccessToken,
-		RefreshToken: token.RefreshToken,
+		AccessToken:  models.EncryptedString(token.AccessToken),
+		RefreshToken: models.EncryptedString(token.RefreshToken),
 		TokenType:    token.TokenType,
 		ExpiresAt:    token.Expiry,
 		Scope:        "gmail.send",
 	}
 
-	// Check if token already exists for this user
-	var existingToken models.GmailToken
-	if err := config.DB.Where("user_id = ?", userID).First(&existingToken).Error; err == nil {
-		// Update existing token
-		config.DB.Model(&existingToken).Updates(gmailToken)
-	} else {
-		// Create new token
-		config.DB.Create(&gmailToken)
+	// Record the account's address when Google tells it, so a user can connect several
+	if userInfo, err := utils.GetGoogleUserInfo(token.AccessToken); err == nil {
+		gmailToken.Email = userInfo.Email
+	}
+	if err := saveGmailAccount(&gmailToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save Gmail token"})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":    "Gmail account connected successfully",
+		"account_id": gmailToken.ID,
+		"email":      gmailToken.Email,
 		"expires_at": token.Expiry,
 	})
 }
 
+// RecipientList accepts recipients as a comma separated string, a list of
+// strings, or a list of {"email", "name"} objects
+type RecipientList []utils.EmailAddress
+
+func (r *RecipientList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		addresses, err := utils.ParseEmailAddressList(single)
+		if err != nil {
+			return err
+		}
+		*r = addresses
+		return nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("recipients must be a string or a list")
+	}
+
+	addresses := make([]utils.EmailAddress, 0, len(items))
+	for _, item := range items {
+		var value string
+		if err := json.Unmarshal(item, &value); err == nil {
+			address, err := utils.ParseEmailAddress(value)
+			if err != nil {
+				return err
+			}
+			addresses = append(addresses, address)
+			continue
+		}
+
+		var address utils.EmailAddress
+		if err := json.Unmarshal(item, &address); err != nil {
+			return fmt.Errorf("recipient must be a string or an object with an email")
+		}
+		address.Email = strings.TrimSpace(address.Email)
+		addresses = append(addresses, address)
+	}
+
+	*r = addresses
+	return nil
+}
+
 type SendEmailRequest struct {
-	To      string `json:"to" binding:"required,email"`
-	Subject string `json:"subject" binding:"required"`
-	Body    string `json:"body" binding:"required"`
+	To              RecipientList           `json:"to" binding:"required"`
+	Cc              RecipientList           `json:"cc"`
+	Bcc             RecipientList           `json:"bcc"`
+	From            string                  `json:"from,omitempty"` // Send-as address of the account, its own address if unset
+	ReplyTo         string                  `json:"reply_to"`
+	Subject         string                  `json:"subject"`
+	Body            string                  `json:"body"`
+	BodyFormat      string                  `json:"body_format,omitempty"` // text (default), markdown or html
+	HTMLBody        string                  `json:"html_body"`
+	Attachments     []utils.EmailAttachment `json:"attachments"`
+	FromAccountID   uint                    `json:"from_account_id,omitempty"`  // Connected Gmail account to send from, the default one if unset
+	SendAt          string                  `json:"send_at,omitempty"`          // Schedule the email instead of sending it now
+	TimeZone        string                  `json:"time_zone,omitempty"`        // IANA zone for a send_at without UTC offset
+	TemplateID      uint                    `json:"template_id,omitempty"`      // Saved template to send instead of subject and bodies
+	TemplateVersion int                     `json:"template_version,omitempty"` // Version of the template, its current one if unset
+	Fields          map[string]interface{}  `json:"fields,omitempty"`           // Merge fields for the template
 }
 
-func SendEmail(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
-		return
+// newGmailService creates a Gmail API client authorized with the stored token.
+// Refreshed access tokens are written back to gmailToken and the database.
+func newGmailService(ctx context.Context, gmailToken *models.GmailToken) (*gmail.Service, error) {
+	client := oauth2.NewClient(ctx, newPersistingTokenSource(ctx, gmailToken))
+	return gmail.NewService(ctx, option.WithHTTPClient(client), option.WithEndpoint(utils.GetGoogleEndpoints().GmailURL))
+}
+
+// addressEmails lists the email addresses of every recipient, for the message envelope
+func addressEmails(lists ...[]utils.EmailAddress) []string {
+	var emails []string
+	for _, list := range lists {
+		for _, address := range list {
+			emails = append(emails, address.Email)
+		}
 	}
+	return emails
+}
 
-	var req SendEmailRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// recipientHistories creates one history row per To, Cc and Bcc recipient based on base
+func recipientHistories(base models.EmailHistory, to, cc, bcc []utils.EmailAddress) []models.EmailHistory {
+	var histories []models.EmailHistory
+	add := func(recipientType string, addresses []utils.EmailAddress) {
+		for _, address := range addresses {
+			history := base
+			history.RecipientEmail = address.Email
+			history.RecipientName = address.Name
+			history.RecipientType = recipientType
+			histories = append(histories, history)
+		}
+	}
+
+	add("to", to)
+	add("cc", cc)
+	add("bcc", bcc)
+	return histories
+}
+
+// parseReplyTo parses the optional reply_to request field
+func parseReplyTo(value string) (utils.EmailAddress, error) {
+	if strings.TrimSpace(value) == "" {
+		return utils.EmailAddress{}, nil
+	}
+
+	address, err := utils.ParseEmailAddress(value)
+	if err != nil {
+		return utils.EmailAddress{}, utils.ValidationErrors{{Field: "reply_to", Message: err.Error()}}
 	}
+	return address, nil
+}
 
-	// Get user's Gmail token
-	var gmailToken models.GmailToken
-	if err := config.DB.Where("user_id = ?", userID).First(&gmailToken).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Gmail account not connected"})
+// respondValidationError writes the structured field errors of a failed preflight check
+func respondValidationError(c *gin.Context, err error) {
+	var validationErrors utils.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "Message validation failed",
+			"fields": validationErrors,
+		})
 		return
 	}
 
-	// Create OAuth2 token
-	token := &oauth2.Token{
-		AccessToken:  gmailToken.AccessToken,
-		RefreshToken: gmailToken.RefreshToken,
-		TokenType:    gmailToken.TokenType,
-		Expiry:       gmailToken.ExpiresAt,
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+// historyBody picks the body stored in email history, preferring plain text
+func historyBody(textBody, htmlBody string) string {
+	if textBody != "" {
+		return textBody
 	}
+	return htmlBody
+}
 
-	// Create Gmail service
-	ctx := context.Background()
-	client := googleOAuthConfig.Client(ctx, token)
+// errGmailNotConnected is returned when the user has no stored Gmail token
+var errGmailNotConnected = errors.New("Gmail account not connected")
 
-	gmailService, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+// errGmailService is returned when no Gmail API client could be created from the stored token
+var errGmailService = errors.New("failed to create Gmail service")
+
+// composedEmail is the MIME message of a single email and the bodies it was
+// built from, which email history stores
+type composedEmail struct {
+	raw  []byte
+	body *utils.RenderedBody
+}
+
+// buildSendEmailMessage validates a single email request and composes its MIME message
+func buildSendEmailMessage(req *SendEmailRequest) (*composedEmail, error) {
+	from, err := parseFrom(req.From)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create Gmail service"})
-		return
+		return nil, err
 	}
+	replyTo, err := parseReplyTo(req.ReplyTo)
+	if err != nil {
+		return nil, err
+	}
+	if errs := utils.ValidateBodyFormat(req.BodyFormat, req.HTMLBody); len(errs) > 0 {
+		return nil, errs
+	}
+	body, err := utils.RenderBody(req.BodyFormat, req.Body, req.HTMLBody)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := utils.BuildMIMEMessage(&utils.EmailMessage{
+		From:        from,
+		To:          req.To,
+		Cc:          req.Cc,
+		Bcc:         req.Bcc,
+		ReplyTo:     replyTo,
+		Subject:     req.Subject,
+		TextBody:    body.Text,
+		HTMLBody:    body.HTML,
+		Attachments: req.Attachments,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &composedEmail{raw: raw, body: body}, nil
+}
 
-	// Get user email for "from" field
-	userEmail, _ := c.Get("user_email")
-
-	// Create email message
-	emailBody := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s", req.To, req.Subject, req.Body)
-	message := &gmail.Message{
-		Raw: base64.URLEncoding.EncodeToString([]byte(emailBody)),
+// deliverEmail sends a composed single email of the user through sender and
+// records one history row per recipient. A *dailyLimitError is returned without
+// recording anything, since nothing was sent. History stores the rendered
+// body, so Markdown emails are recorded as the text and HTML that was sent.
+func deliverEmail(ctx context.Context, userID uint, sender *mailSender, req *SendEmailRequest, email *composedEmail) (string, error) {
+	// Send email, retrying temporary errors
+	msg := &transport.Message{
+		Recipients: addressEmails(req.To, req.Cc, req.Bcc),
+		Raw:        email.raw,
 	}
+	messageID, err := sendWithRetry(ctx, sender, msg)
 
-	// Send email
-	_, err = gmailService.Users.Messages.Send("me", message).Do()
+	var limitErr *dailyLimitError
+	if errors.As(err, &limitErr) {
+		return "", err
+	}
 
-	// Track email history
+	// Track email history, one row per recipient
 	emailHistory := models.EmailHistory{
-		UserID:         userID.(uint),
+		UserID:         userID,
 		EmailType:      "single",
-		RecipientEmail: req.To,
-		RecipientName:  "", // Single emails don't have names
 		Subject:        req.Subject,
-		Body:           req.Body,
+		Body:           historyBody(email.body.Text, email.body.HTML),
 		Status:         "sent",
 		ErrorMessage:   "",
 		BatchID:        "",
+		GmailMessageID: messageID,
+		GmailTokenID:   sender.accountID(),
+		SenderEmail:    sender.address(),
+		Transport:      sender.transport.Name(),
 		SentAt:         time.Now(),
 	}
 
+	if req.TemplateID != 0 {
+		emailHistory.TemplateID, emailHistory.TemplateVersion = &req.TemplateID, req.TemplateVersion
+	}
+
 	if err != nil {
 		emailHistory.Status = "failed"
 		emailHistory.ErrorMessage = err.Error()
+		emailHistory.Retryable = utils.IsTransientSendError(err)
+	}
+
+	histories := recipientHistories(emailHistory, req.To, req.Cc, req.Bcc)
+	config.DB.Create(&histories)
 
-		// Save failed email to history
-		config.DB.Create(&emailHistory)
+	return messageID, err
+}
 
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send email"})
+// respondGmailTokenError replies to a request that cannot be sent because the
+// user's Gmail account is not connected, not found, or its access was revoked
+func respondGmailTokenError(c *gin.Context, err error) {
+	if errors.Is(err, errGmailAccountNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Gmail account not found"})
 		return
 	}
+	if errors.Is(err, errGmailRevoked) || isInvalidGrant(err) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":   "Gmail access was revoked, please reconnect your Gmail account",
+			"revoked": true,
+		})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Gmail account not connected"})
+}
+
+// respondDailyLimit replies 429 with the time sending resumes
+func respondDailyLimit(c *gin.Context, limitErr *dailyLimitError) {
+	c.Header("Retry-After", strconv.Itoa(int(time.Until(limitErr.resetAt).Seconds())+1))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Daily sending limit reached",
+		"retry_after": limitErr.resetAt,
+	})
+}
 
-	// Save successful email to history
-	config.DB.Create(&emailHistory)
+func SendEmail(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var req SendEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sendAt, err := parseSendAt(req.SendAt, req.TimeZone)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	if err := applySendTemplate(userID, &req); err != nil {
+		respondEmailTemplateError(c, err)
+		return
+	}
+
+	// Preflight: validate and build the MIME message before touching Gmail
+	email, err := buildSendEmailMessage(&req)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	// Get the Gmail account to send from
+	sender, err := loadMailSender(userID, req.FromAccountID)
+	if err != nil {
+		respondMailSenderError(c, err)
+		return
+	}
+
+	// Check the send-as address; the message is rebuilt with the alias name
+	from, err := resolveSendAs(sender, req.From)
+	if err != nil {
+		respondSendAsError(c, err)
+		return
+	}
+	if from.Email != "" {
+		req.From = from.String()
+		if email, err = buildSendEmailMessage(&req); err != nil {
+			respondValidationError(c, err)
+			return
+		}
+	}
+
+	if sendAt != nil {
+		// The send time is kept on the scheduled email, where it can be changed,
+		// and the account is kept even if another one becomes the default
+		timeZone := req.TimeZone
+		req.SendAt, req.TimeZone = "", ""
+		req.FromAccountID = sender.accountID()
+		recipientCount := len(req.To) + len(req.Cc) + len(req.Bcc)
+		scheduleEmail(c, userID.(uint), models.ScheduledSingle, *sendAt, timeZone, req.Subject, recipientCount, &req)
+		return
+	}
+
+	// Get user email for "from" field, unless the sending address is known
+	userEmail, _ := c.Get("user_email")
+	if from.Email != "" {
+		userEmail = from.Email
+	} else if sender.address() != "" {
+		userEmail = sender.address()
+	}
+
+	messageID, err := deliverEmail(c.Request.Context(), userID.(uint), sender, &req, email)
+	if err != nil {
+		var limitErr *dailyLimitError
+		switch {
+		case errors.As(err, &limitErr):
+			respondDailyLimit(c, limitErr)
+		case isInvalidGrant(err):
+			respondGmailTokenError(c, err)
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send email"})
+		}
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Email sent successfully",
-		"to":      req.To,
-		"subject": req.Subject,
-		"from":    userEmail,
+		"message":    "Email sent successfully",
+		"to":         utils.FormatAddressList(req.To),
+		"cc":         utils.FormatAddressList(req.Cc),
+		"subject":    req.Subject,
+		"from":       userEmail,
+		"message_id": messageID,
 	})
 }
 
+// GetGmailStatus reports whether Gmail is connected and whether its token still
+// works. An expired access token is refreshed first, so the reported expiry is
+// the one the next send will use and a revoked grant is detected right away.
 func GetGmailStatus(c *gin.Context) {
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -231,22 +505,51 @@ func GetGmailStatus(c *gin.Context) {
 		return
 	}
 
-	var gmailToken models.GmailToken
-	if err := config.DB.Where("user_id = ?", userID).First(&gmailToken).Error; err != nil {
+	var accountID uint
+	if value := c.Query("account_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account_id"})
+			return
+		}
+		accountID = uint(id)
+	}
+
+	gmailToken, err := loadGmailAccount(userID, accountID)
+	if errors.Is(err, errGmailNotConnected) {
 		c.JSON(http.StatusOK, gin.H{
 			"connected": false,
 			"message":   "Gmail account not connected",
 		})
 		return
 	}
+	if errors.Is(err, errGmailAccountNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Gmail account not found"})
+		return
+	}
 
-	// Always return expired as false for Gmail tokens
-	c.JSON(http.StatusOK, gin.H{
+	status := gin.H{
 		"connected":  true,
-		"expires_at": gmailToken.ExpiresAt,
-		"expired":    false,
+		"account_id": gmailToken.ID,
+		"email":      gmailToken.Email,
 		"scope":      gmailToken.Scope,
-	})
+	}
+	if err == nil && !gmailToken.ExpiresAt.After(time.Now()) {
+		if _, refreshErr := newPersistingTokenSource(c.Request.Context(), gmailToken).Token(); refreshErr != nil && !isInvalidGrant(refreshErr) {
+			status["refresh_error"] = refreshErr.Error()
+		}
+	}
+
+	status["expires_at"] = gmailToken.ExpiresAt
+	status["expired"] = !gmailToken.ExpiresAt.After(time.Now())
+	status["refreshed_at"] = gmailToken.RefreshedAt
+	status["revoked"] = gmailToken.RevokedAt != nil
+	status["revoked_at"] = gmailToken.RevokedAt
+	if gmailToken.RevokedAt != nil {
+		status["message"] = "Gmail access was revoked, please reconnect your Gmail account"
+	}
+
+	c.JSON(http.StatusOK, status)
 }
 
 func DisconnectGmail(c *gin.Context) {
@@ -307,25 +610,12 @@ func HandleGoogleCallback(c *gin.Context) {
 	fmt.Printf("Token exchange successful. Access token: %s...\n", tokenResp.AccessToken[:20])
 
 	// Get user info from Google using the access token
-	userInfoResp, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + tokenResp.AccessToken)
+	userInfo, err := utils.GetGoogleUserInfo(tokenResp.AccessToken)
 	if err != nil {
 		fmt.Printf("Failed to get user info: %v\n", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user info"})
 		return
 	}
-	defer userInfoResp.Body.Close()
-
-	var userInfo struct {
-		Email string `json:"email"`
-		Name  string `json:"name"`
-		ID    string `json:"id"`
-	}
-
-	if err := json.NewDecoder(userInfoResp.Body).Decode(&userInfo); err != nil {
-		fmt.Printf("Failed to decode user info: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode user info"})
-		return
-	}
 
 	fmt.Printf("User info retrieved: %s (%s)\n", userInfo.Name, userInfo.Email)
 
@@ -350,26 +640,19 @@ func HandleGoogleCallback(c *gin.Context) {
 	// Calculate expiry time
 	expiresAt := time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
 
-	// Save Gmail token to database
+	// Save the signed in address as one of the user's Gmail accounts
 	gmailToken := models.GmailToken{
 		UserID:       user.ID,
-		AccessToken:  tokenResp.AccessToken,
-		RefreshToken: tokenResp.RefreshToken,
+		Email:        userInfo.Email,
+		AccessToken:  models.EncryptedString(tokenResp.AccessToken),
+		RefreshToken: models.EncryptedString(tokenResp.RefreshToken),
 		TokenType:    tokenResp.TokenType,
 		ExpiresAt:    expiresAt,
 		Scope:        req.Scope, // Use the scope from the request
 	}
-
-	// Update or create Gmail token
-	var existingToken models.GmailToken
-	if err := config.DB.Where("user_id = ?", user.ID).First(&existingToken).Error; err == nil {
-		// Update existing token
-		fmt.Printf("Updating existing Gmail token for user %d\n", user.ID)
-		config.DB.Model(&existingToken).Updates(gmailToken)
-	} else {
-		// Create new token
-		fmt.Printf("Creating new Gmail token for user %d\n", user.ID)
-		config.DB.Create(&gmailToken)
+	if err := saveGmailAccount(&gmailToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save Gmail token"})
+		return
 	}
 
 	// Generate JWT for the user session
@@ -391,44 +674,50 @@ func HandleGoogleCallback(c *gin.Context) {
 
 // BulkEmailRecord represents a single email record
 type BulkEmailRecord struct {
-	Email string `json:"email"`
-	Name  string `json:"name"`
+	Email  string                 `json:"email"`
+	Name   string                 `json:"name"`
+	Fields map[string]interface{} `json:"fields,omitempty"` // Merge fields for the templates, such as the CSV columns
 }
 
 // ProcessCSVResponse represents the response after processing CSV
 type ProcessCSVResponse struct {
 	TotalRecords int               `json:"total_records"`
+	Columns      []string          `json:"columns"` // Merge field names of the CSV columns
 	ValidEmails  []BulkEmailRecord `json:"valid_emails"`
 	Errors       []string          `json:"errors,omitempty"`
 }
 
 // BulkEmailRequest represents the request for bulk email sending
 type BulkEmailRequest struct {
-	Subject string            `json:"subject" binding:"required"`
-	Body    string            `json:"body" binding:"required"`
-	Emails  []BulkEmailRecord `json:"emails"`
-}
-
-// BulkEmailResponse represents the response for bulk email sending
-type BulkEmailResponse struct {
-	TotalEmails    int               `json:"total_emails"`
-	SuccessCount   int               `json:"success_count"`
-	FailureCount   int               `json:"failure_count"`
-	Results        []BulkEmailResult `json:"results"`
-	ProcessingTime string            `json:"processing_time"`
+	From            string                  `json:"from,omitempty"` // Send-as address of the account, its own address if unset
+	ReplyTo         string                  `json:"reply_to"`
+	Subject         string                  `json:"subject"`
+	Body            string                  `json:"body"`
+	BodyFormat      string                  `json:"body_format,omitempty"` // text (default), markdown or html
+	HTMLBody        string                  `json:"html_body"`
+	Attachments     []utils.EmailAttachment `json:"attachments"`
+	Emails          []BulkEmailRecord       `json:"emails"`
+	FromAccountID   uint                    `json:"from_account_id,omitempty"`  // Connected Gmail account to send from, the default one if unset
+	Senders         []BulkSender            `json:"senders,omitempty"`          // Accounts to spread the recipients across instead
+	Rotation        string                  `json:"rotation,omitempty"`         // round_robin (default), weighted or quota_remaining
+	SendAt          string                  `json:"send_at,omitempty"`          // Schedule the job instead of queueing it now
+	TimeZone        string                  `json:"time_zone,omitempty"`        // IANA zone for a send_at without UTC offset
+	TemplateID      uint                    `json:"template_id,omitempty"`      // Saved template to send instead of subject and bodies
+	TemplateVersion int                     `json:"template_version,omitempty"` // Version of the template, its current one if unset
 }
 
 // BulkEmailResult represents the result of sending a single email
 type BulkEmailResult struct {
-	Email   string `json:"email"`
-	Success bool   `json:"success"`
-	Error   string `json:"error,omitempty"`
+	Email     string `json:"email"`
+	Success   bool   `json:"success"`
+	Status    string `json:"status"` // "sent", "failed" or "cancelled"
+	Error     string `json:"error,omitempty"`
+	AccountID uint   `json:"account_id,omitempty"` // Gmail account the email was sent from
 }
 
-// isValidEmail validates email format using regex
+// isValidEmail validates email format, accepting internationalized addresses
 func isValidEmail(email string) bool {
-	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
-	return emailRegex.MatchString(email)
+	return utils.IsValidEmailAddress(email)
 }
 
 // ProcessCSV handles CSV file upload and processing
@@ -475,9 +764,21 @@ func ProcessCSV(c *gin.Context) {
 		return
 	}
 
-	// Find column indices
+	// Find column indices, and name every column as a merge field
 	emailCol, nameCol := -1, -1
+	columns := make([]string, len(headers))
+	columnIndex := make(map[string]int)
 	for i, header := range headers {
+		column := utils.NormalizeTemplateVariable(header)
+		if column != "" {
+			if first, ok := columnIndex[column]; ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("CSV columns %d and %d are both named '%s'", first+1, i+1, column)})
+				return
+			}
+			columnIndex[column] = i
+		}
+		columns[i] = column
+
 		switch strings.ToLower(strings.TrimSpace(header)) {
 		case "email", "email_address", "to":
 			emailCol = i
@@ -521,15 +822,28 @@ func ProcessCSV(c *gin.Context) {
 			continue
 		}
 
-		// Extract name field
+		// Extract name field, dropping line breaks so it is safe to use in headers
 		name := ""
 		if nameCol != -1 && nameCol < len(record) {
-			name = strings.TrimSpace(record[nameCol])
+			name = utils.SanitizeHeaderText(strings.TrimSpace(record[nameCol]))
+		}
+
+		fields := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if column == "" {
+				continue
+			}
+			value := ""
+			if i < len(record) {
+				value = strings.TrimSpace(record[i])
+			}
+			fields[column] = value
 		}
 
 		validEmails = append(validEmails, BulkEmailRecord{
-			Email: email,
-			Name:  name,
+			Email:  email,
+			Name:   name,
+			Fields: fields,
 		})
 	}
 
@@ -543,186 +857,21 @@ func ProcessCSV(c *gin.Context) {
 	fmt.Printf("User %v processed CSV: %d total records, %d valid emails, %d errors\n",
 		userID, totalRecords, len(validEmails), len(errors))
 
+	mergeFields := make([]string, 0, len(columns))
+	for _, column := range columns {
+		if column != "" {
+			mergeFields = append(mergeFields, column)
+		}
+	}
+
 	c.JSON(http.StatusOK, ProcessCSVResponse{
 		TotalRecords: totalRecords,
+		Columns:      mergeFields,
 		ValidEmails:  validEmails,
 		Errors:       errors,
 	})
 }
 
-// SendBulkEmails handles sending multiple emails
-func SendBulkEmails(c *gin.Context) {
-	startTime := time.Now()
-
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
-		return
-	}
-
-	var req BulkEmailRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	if len(req.Emails) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No emails provided"})
-		return
-	}
-
-	// Limit number of emails
-	const maxBulkEmails = 100
-	if len(req.Emails) > maxBulkEmails {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Maximum %d emails allowed per batch", maxBulkEmails)})
-		return
-	}
-
-	// Get user's Gmail token
-	var gmailToken models.GmailToken
-	if err := config.DB.Where("user_id = ?", userID).First(&gmailToken).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Gmail account not connected"})
-		return
-	}
-
-	// Create OAuth2 token
-	token := &oauth2.Token{
-		AccessToken:  gmailToken.AccessToken,
-		RefreshToken: gmailToken.RefreshToken,
-		TokenType:    gmailToken.TokenType,
-		Expiry:       gmailToken.ExpiresAt,
-	}
-
-	// Create Gmail service
-	ctx := context.Background()
-	client := googleOAuthConfig.Client(ctx, token)
-
-	gmailService, err := gmail.NewService(ctx, option.WithHTTPClient(client))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create Gmail service"})
-		return
-	}
-
-	// Get user email for "from" field (not currently used but available for future features)
-	_, _ = c.Get("user_email")
-
-	// Generate batch ID for grouping bulk emails
-	batchID := uuid.New().String()
-
-	// Process emails concurrently with rate limiting
-	const maxConcurrent = 5
-	semaphore := make(chan struct{}, maxConcurrent)
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-
-	results := make([]BulkEmailResult, len(req.Emails))
-	successCount := 0
-	failureCount := 0
-
-	for i, emailRecord := range req.Emails {
-		wg.Add(1)
-		go func(index int, record BulkEmailRecord) {
-			defer wg.Done()
-
-			// Rate limiting
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
-
-			// Add delay between emails to respect Gmail limits
-			if index > 0 {
-				time.Sleep(100 * time.Millisecond)
-			}
-
-			success := true
-			errorMsg := ""
-
-			// Personalize email body and subject if name is provided
-			personalizedBody := req.Body
-			personalizedSubject := req.Subject
-			if record.Name != "" {
-				personalizedBody = strings.ReplaceAll(personalizedBody, "{{name}}", record.Name)
-				personalizedBody = strings.ReplaceAll(personalizedBody, "{{Name}}", record.Name)
-				personalizedSubject = strings.ReplaceAll(personalizedSubject, "{{name}}", record.Name)
-				personalizedSubject = strings.ReplaceAll(personalizedSubject, "{{Name}}", record.Name)
-			}
-
-			// Validate email
-			if !isValidEmail(record.Email) {
-				success = false
-				errorMsg = "Invalid email format"
-			} else {
-				// Create email message
-				emailBody := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s",
-					record.Email, personalizedSubject, personalizedBody)
-				message := &gmail.Message{
-					Raw: base64.URLEncoding.EncodeToString([]byte(emailBody)),
-				}
-
-				// Send email
-				_, err := gmailService.Users.Messages.Send("me", message).Do()
-				if err != nil {
-					success = false
-					errorMsg = fmt.Sprintf("Failed to send: %v", err)
-				}
-			}
-
-			// Track email history
-			emailHistory := models.EmailHistory{
-				UserID:         userID.(uint),
-				EmailType:      "bulk",
-				RecipientEmail: record.Email,
-				RecipientName:  record.Name,
-				Subject:        req.Subject,
-				Body:           personalizedBody,
-				Status:         "sent",
-				ErrorMessage:   "",
-				BatchID:        batchID,
-				SentAt:         time.Now(),
-			}
-
-			if !success {
-				emailHistory.Status = "failed"
-				emailHistory.ErrorMessage = errorMsg
-			}
-
-			// Save to database (non-blocking)
-			go func(history models.EmailHistory) {
-				config.DB.Create(&history)
-			}(emailHistory)
-
-			// Update results
-			mu.Lock()
-			results[index] = BulkEmailResult{
-				Email:   record.Email,
-				Success: success,
-				Error:   errorMsg,
-			}
-			if success {
-				successCount++
-			} else {
-				failureCount++
-			}
-			mu.Unlock()
-
-		}(i, emailRecord)
-	}
-
-	wg.Wait()
-
-	processingTime := time.Since(startTime)
-
-	fmt.Printf("User %v sent bulk emails: %d total, %d success, %d failed, took %v\n",
-		userID, len(req.Emails), successCount, failureCount, processingTime)
-
-	c.JSON(http.StatusOK, BulkEmailResponse{
-		TotalEmails:    len(req.Emails),
-		SuccessCount:   successCount,
-		FailureCount:   failureCount,
-		Results:        results,
-		ProcessingTime: processingTime.String(),
-	})
-}
-
 // EmailHistoryResponse represents paginated email history
 type EmailHistoryResponse struct {
 	History    []models.EmailHistory `json:"history"`
@@ -736,6 +885,7 @@ type EmailHistoryResponse struct {
 type EmailHistoryStats struct {
 	TotalSent       int64 `json:"total_sent"`
 	TotalFailed     int64 `json:"total_failed"`
+	TotalCancelled  int64 `json:"total_cancelled"`
 	SingleEmails    int64 `json:"single_emails"`
 	BulkEmails      int64 `json:"bulk_emails"`
 	Last7DaysSent   int64 `json:"last_7_days_sent"`
@@ -753,7 +903,9 @@ func GetEmailHistory(c *gin.Context) {
 	// Parse query parameters
 	page := 1
 	pageSize := 20
-	emailType := c.Query("type") // "single", "bulk", or empty for all
+	emailType := c.Query("type")         // "single", "bulk", or empty for all
+	accountID := c.Query("account_id")   // Gmail account the emails were sent from, or empty for all
+	templateID := c.Query("template_id") // Saved template the emails were sent from, or empty for all
 
 	if p := c.Query("page"); p != "" {
 		if parsed, err := fmt.Sscanf(p, "%d", &page); err != nil || parsed != 1 || page < 1 {
@@ -772,6 +924,12 @@ func GetEmailHistory(c *gin.Context) {
 	if emailType != "" {
 		query = query.Where("email_type = ?", emailType)
 	}
+	if accountID != "" {
+		query = query.Where("gmail_token_id = ?", accountID)
+	}
+	if templateID != "" {
+		query = query.Where("template_id = ?", templateID)
+	}
 
 	// Get total count
 	var totalCount int64
@@ -803,9 +961,10 @@ func GetEmailHistoryStats(c *gin.Context) {
 
 	var stats EmailHistoryStats
 
-	// Total sent and failed
+	// Total sent, failed and cancelled
 	config.DB.Model(&models.EmailHistory{}).Where("user_id = ? AND status = ?", userID, "sent").Count(&stats.TotalSent)
 	config.DB.Model(&models.EmailHistory{}).Where("user_id = ? AND status = ?", userID, "failed").Count(&stats.TotalFailed)
+	config.DB.Model(&models.EmailHistory{}).Where("user_id = ? AND status = ?", userID, "cancelled").Count(&stats.TotalCancelled)
 
 	// Single vs bulk emails
 	config.DB.Model(&models.EmailHistory{}).Where("user_id = ? AND email_type = ?", userID, "single").Count(&stats.SingleEmails)
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// errGmailAccountNotFound is returned when a requested Gmail account is not connected to the user
+var errGmailAccountNotFound = errors.New("Gmail account not found")
+
+// GmailAccountResponse describes a connected Gmail account without its tokens
+type GmailAccountResponse struct {
+	ID        uint       `json:"id"`
+	Email     string     `json:"email"`
+	Scope     string     `json:"scope"`
+	Default   bool       `json:"default"` // Used when a request names no from_account_id
+	Revoked   bool       `json:"revoked"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// loadGmailAccount loads one of the user's connected Gmail accounts. Account
+// ID 0 selects the default account, the one connected first. It fails with
+// errGmailNotConnected, errGmailAccountNotFound or errGmailRevoked.
+func loadGmailAccount(userID interface{}, accountID uint) (*models.GmailToken, error) {
+	var account models.GmailToken
+	query := config.DB.Where("user_id = ?", userID)
+	if accountID != 0 {
+		query = query.Where("id = ?", accountID)
+	}
+
+	if err := query.Order("id").First(&account).Error; err != nil {
+		if accountID != 0 {
+			return nil, errGmailAccountNotFound
+		}
+		return nil, errGmailNotConnected
+	}
+	if account.RevokedAt != nil {
+		return &account, errGmailRevoked
+	}
+	return &account, nil
+}
+
+// saveGmailAccount stores the token of a connected Gmail account. Connecting
+// an address again updates its existing row, restoring it if it was
+// disconnected, and a connection saved before addresses were recorded is
+// taken over by the first account connected again.
+func saveGmailAccount(gmailToken *models.GmailToken) error {
+	var existing models.GmailToken
+	err := config.DB.Unscoped().Where("user_id = ? AND email = ?", gmailToken.UserID, gmailToken.Email).First(&existing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) && gmailToken.Email != "" {
+		err = config.DB.Where("user_id = ? AND (email = ? OR email IS NULL)", gmailToken.UserID, "").First(&existing).Error
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return config.DB.Create(gmailToken).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	// Google may omit the refresh token on a new grant, so keep the stored one
+	// and write both token columns, which re-encrypts them together
+	if gmailToken.RefreshToken == "" {
+		gmailToken.RefreshToken = existing.RefreshToken
+	}
+	if gmailToken.Scope == "" {
+		gmailToken.Scope = existing.Scope
+	}
+
+	gmailToken.ID = existing.ID
+	return config.DB.Unscoped().Model(&existing).Updates(map[string]interface{}{
+		"email":         gmailToken.Email,
+		"access_token":  gmailToken.AccessToken,
+		"refresh_token": gmailToken.RefreshToken,
+		"token_type":    gmailToken.TokenType,
+		"expires_at":    gmailToken.ExpiresAt,
+		"scope":         gmailToken.Scope,
+		"revoked_at":    nil, // A new grant lifts a revocation
+		"deleted_at":    nil,
+	}).Error
+}
+
+// gmailAccountResponse describes a connected account to clients
+func gmailAccountResponse(account *models.GmailToken, isDefault bool) GmailAccountResponse {
+	return GmailAccountResponse{
+		ID:        account.ID,
+		Email:     account.Email,
+		Scope:     account.Scope,
+		Default:   isDefault,
+		Revoked:   account.RevokedAt != nil,
+		RevokedAt: account.RevokedAt,
+		ExpiresAt: account.ExpiresAt,
+		CreatedAt: account.CreatedAt,
+	}
+}
+
+// ListGmailAccounts lists the Gmail accounts the user has connected, the default one first
+func ListGmailAccounts(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var accounts []models.GmailToken
+	if err := config.DB.Where("user_id = ?", userID).Order("id").Find(&accounts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load Gmail accounts"})
+		return
+	}
+
+	response := make([]GmailAccountResponse, 0, len(accounts))
+	for i := range accounts {
+		response = append(response, gmailAccountResponse(&accounts[i], i == 0))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"accounts": response})
+}
+
+// ConnectGmailAccount connects another Gmail account to the signed in user
+// from an OAuth authorization code. The code must grant the userinfo.email
+// scope so the account's address can be recorded.
+func ConnectGmailAccount(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var req GoogleCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	redirectURL := os.Getenv("GOOGLE_REDIRECT_URL")
+	if redirectURL == "" {
+		redirectURL = "postmessage" // Default for LoginSocialGoogle
+	}
+
+	tokenResp, err := utils.GetGmailRefreshToken(req.Code, redirectURL)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to exchange code for token", "details": err.Error()})
+		return
+	}
+
+	userInfo, err := utils.GetGoogleUserInfo(tokenResp.AccessToken)
+	if err != nil || userInfo.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get the Gmail address, grant the userinfo.email scope"})
+		return
+	}
+
+	account := models.GmailToken{
+		UserID:       userID.(uint),
+		Email:        userInfo.Email,
+		AccessToken:  models.EncryptedString(tokenResp.AccessToken),
+		RefreshToken: models.EncryptedString(tokenResp.RefreshToken),
+		TokenType:    tokenResp.TokenType,
+		ExpiresAt:    time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
+		Scope:        req.Scope,
+	}
+	if err := saveGmailAccount(&account); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save Gmail account"})
+		return
+	}
+
+	fmt.Printf("User %v connected Gmail account %s\n", userID, account.Email)
+
+	config.DB.First(&account, account.ID)
+	defaultAccount, _ := loadGmailAccount(userID, 0)
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Gmail account connected successfully",
+		"account": gmailAccountResponse(&account, defaultAccount != nil && defaultAccount.ID == account.ID),
+	})
+}
+
+// DisconnectGmailAccount removes one connected Gmail account
+func DisconnectGmailAccount(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	result := config.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).Delete(&models.GmailToken{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disconnect Gmail account"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Gmail account not found"})
+		return
+	}
+	config.DB.Where("gmail_token_id = ?", c.Param("id")).Delete(&models.GmailSendAs{})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Gmail account disconnected successfully"})
+}
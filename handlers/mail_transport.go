@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/transport"
+	"email-app-backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/gmail/v1"
+	"gorm.io/gorm"
+)
+
+// mailSender sends a user's emails through one transport: the Gmail API of a
+// connected account, or the SMTP or file transport configured for the user
+type mailSender struct {
+	account    *models.GmailToken // Gmail account sent from, nil for other transports
+	service    *gmail.Service     // Gmail API client of account
+	transport  transport.Transport
+	from       utils.EmailAddress // From address of transports that do not set one themselves
+	limiterKey string             // Sends sharing a key share a concurrency limiter
+}
+
+// newGmailSender creates a Gmail API client for a connected account
+func newGmailSender(account *models.GmailToken) (*mailSender, error) {
+	service, err := newGmailService(context.Background(), account)
+	if err != nil {
+		return nil, errGmailService
+	}
+	return &mailSender{
+		account:    account,
+		service:    service,
+		transport:  transport.NewGmail(service),
+		limiterKey: fmt.Sprintf("gmail:%d", account.ID),
+	}, nil
+}
+
+// accountID returns the Gmail account the sender sends from, 0 for other transports
+func (s *mailSender) accountID() uint {
+	if s.account == nil {
+		return 0
+	}
+	return s.account.ID
+}
+
+// address returns the address emails are sent from, if known
+func (s *mailSender) address() string {
+	if s.account != nil {
+		return s.account.Email
+	}
+	return s.from.Email
+}
+
+// defaultMailSettings returns the transport of users without their own
+// settings, from MAIL_TRANSPORT ("gmail" by default) and the SMTP_* variables
+func defaultMailSettings() models.MailSettings {
+	settings := models.MailSettings{
+		Transport:    os.Getenv("MAIL_TRANSPORT"),
+		SMTPHost:     os.Getenv("SMTP_HOST"),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: models.EncryptedString(os.Getenv("SMTP_PASSWORD")),
+		SMTPSecurity: os.Getenv("SMTP_SECURITY"),
+		FromEmail:    os.Getenv("MAIL_FROM"),
+		FromName:     os.Getenv("MAIL_FROM_NAME"),
+	}
+	if settings.Transport == "" {
+		settings.Transport = transport.Gmail
+	}
+	settings.SMTPPort, _ = strconv.Atoi(os.Getenv("SMTP_PORT"))
+	return settings
+}
+
+// userMailSettings returns the user's transport settings, or the defaults if they have none
+func userMailSettings(userID interface{}) (models.MailSettings, error) {
+	var settings models.MailSettings
+	err := config.DB.Where("user_id = ?", userID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		settings = defaultMailSettings()
+		settings.UserID, _ = userID.(uint)
+		return settings, nil
+	}
+	return settings, err
+}
+
+// userSMTPPorts are the ports users may send to through their own SMTP server
+var userSMTPPorts = map[int]bool{0: true, 25: true, 465: true, 587: true, 2525: true}
+
+// errFileTransportNotAllowed is returned for users' own settings selecting the
+// file transport, which only the server's MAIL_TRANSPORT may use
+var errFileTransportNotAllowed = errors.New("the file transport can only be configured by the server operator")
+
+// smtpHostAllowed reports whether users may send through host: any host when
+// SMTP_ALLOWED_HOSTS is empty, otherwise one of its comma separated hosts or,
+// for entries starting with a dot, a subdomain of them
+func smtpHostAllowed(host string) bool {
+	allowed := os.Getenv("SMTP_ALLOWED_HOSTS")
+	if strings.TrimSpace(allowed) == "" {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range strings.Split(allowed, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if host == entry || (strings.HasPrefix(entry, ".") && strings.HasSuffix(host, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateUserTransport checks the transport a user selects for themselves,
+// adding errors to errs. Users cannot write files on the server or have it
+// connect to hosts on its own network.
+func validateUserTransport(ctx context.Context, settings *models.MailSettings, errs *utils.ValidationErrors) {
+	switch settings.Transport {
+	case transport.File:
+		errs.Add("transport", "%v", errFileTransportNotAllowed)
+	case transport.SMTP:
+		if !userSMTPPorts[settings.SMTPPort] {
+			errs.Add("smtp_port", "must be 25, 465, 587 or 2525")
+		}
+		if settings.SMTPHost == "" {
+			return
+		}
+		if !smtpHostAllowed(settings.SMTPHost) {
+			errs.Add("smtp_host", "is not an allowed SMTP server")
+			return
+		}
+		if err := transport.CheckPublicHost(ctx, settings.SMTPHost); err != nil {
+			errs.Add("smtp_host", "%v", err)
+		}
+	}
+}
+
+// newTransport creates the SMTP, file or sandbox transport described by
+// settings. Settings saved by a user (with an ID, unlike the server defaults)
+// cannot use the file transport, and their SMTP server must be on a public
+// address. File transports all write to MAIL_FILE_PATH ("mail" by default) in
+// MAIL_FILE_FORMAT, so the operator chooses where the server writes.
+func newTransport(settings *models.MailSettings) (transport.Transport, error) {
+	userSettings := settings.ID != 0
+
+	switch settings.Transport {
+	case transport.Sandbox:
+		return newSandboxTransport(settings.UserID, nil), nil
+	case transport.SMTP:
+		if userSettings && settings.SMTPHost != "" && (!userSMTPPorts[settings.SMTPPort] || !smtpHostAllowed(settings.SMTPHost)) {
+			return nil, fmt.Errorf("SMTP server %s:%d is not allowed", settings.SMTPHost, settings.SMTPPort)
+		}
+		return transport.NewSMTP(transport.SMTPConfig{
+			Host:       settings.SMTPHost,
+			Port:       settings.SMTPPort,
+			Username:   settings.SMTPUsername,
+			Password:   string(settings.SMTPPassword),
+			Security:   settings.SMTPSecurity,
+			PublicOnly: userSettings,
+		})
+	case transport.File:
+		if userSettings {
+			return nil, errFileTransportNotAllowed
+		}
+		path := os.Getenv("MAIL_FILE_PATH")
+		if path == "" {
+			path = "mail"
+		}
+		return transport.NewFile(path, os.Getenv("MAIL_FILE_FORMAT"))
+	}
+	return nil, fmt.Errorf("unknown mail transport %q", settings.Transport)
+}
+
+// loadMailSender returns the sender for a user's email. A Gmail account ID
+// always sends through that account. Account ID 0 uses the user's transport:
+// their default Gmail account, or their SMTP, file or sandbox transport. In
+// sandbox mode every email is captured, and users without a Gmail account
+// send from their own address. Gmail errors are those of loadGmailAccount and
+// newGmailSender.
+func loadMailSender(userID interface{}, accountID uint) (*mailSender, error) {
+	if accountID == 0 {
+		settings, err := userMailSettings(userID)
+		if err != nil {
+			return nil, err
+		}
+
+		if sandboxMode() && settings.Transport == transport.Gmail {
+			if _, err := loadGmailAccount(userID, 0); errors.Is(err, errGmailNotConnected) {
+				settings.Transport = transport.Sandbox
+			}
+		}
+		if settings.Transport != transport.Gmail {
+			return newTransportSender(userID, &settings)
+		}
+	}
+
+	account, err := loadGmailAccount(userID, accountID)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := newGmailSender(account)
+	if err != nil {
+		return nil, err
+	}
+	if sandboxMode() {
+		sender.transport = newSandboxTransport(account.UserID, account)
+	}
+	return sender, nil
+}
+
+// newTransportSender creates the sender of a user's SMTP, file or sandbox
+// transport, which sandbox mode replaces with the sandbox
+func newTransportSender(userID interface{}, settings *models.MailSettings) (*mailSender, error) {
+	if sandboxMode() {
+		settings.Transport = transport.Sandbox
+	}
+	mailTransport, err := newTransport(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	from := utils.EmailAddress{Name: settings.FromName, Email: settings.FromEmail}
+	if from.Email == "" && settings.Transport == transport.SMTP && utils.IsValidEmailAddress(settings.SMTPUsername) {
+		from.Email = settings.SMTPUsername
+	}
+	if from.Email == "" {
+		var user models.User
+		if err := config.DB.First(&user, userID).Error; err == nil {
+			from = utils.EmailAddress{Name: user.Name, Email: user.Email}
+		}
+	}
+
+	limiterKey := settings.Transport
+	if settings.Transport == transport.SMTP {
+		limiterKey = fmt.Sprintf("smtp:%s:%s", settings.SMTPHost, settings.SMTPUsername)
+	}
+	return &mailSender{transport: mailTransport, from: from, limiterKey: limiterKey}, nil
+}
+
+// isGmailSenderError reports whether err is loadMailSender failing to load a Gmail account
+func isGmailSenderError(err error) bool {
+	return errors.Is(err, errGmailNotConnected) || errors.Is(err, errGmailAccountNotFound) || errors.Is(err, errGmailRevoked)
+}
+
+// respondMailSenderError replies to a request whose sender could not be loaded
+func respondMailSenderError(c *gin.Context, err error) {
+	switch {
+	case isGmailSenderError(err):
+		respondGmailTokenError(c, err)
+	case errors.Is(err, errGmailService):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create Gmail service"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Mail transport is not configured correctly", "details": err.Error()})
+	}
+}
+
+// MailSettingsRequest changes the transport a user's emails are sent with
+type MailSettingsRequest struct {
+	Transport    string `json:"transport" binding:"required"` // "gmail", "smtp" or "sandbox"
+	SMTPHost     string `json:"smtp_host"`
+	SMTPPort     int    `json:"smtp_port"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"smtp_password"` // Kept unchanged when empty
+	SMTPSecurity string `json:"smtp_security"` // "starttls" (default), "tls" or "none"
+	FromEmail    string `json:"from_email"`
+	FromName     string `json:"from_name"`
+}
+
+// mailSettingsResponse describes the user's transport without the SMTP
+// password. The server's own SMTP account is not disclosed.
+func mailSettingsResponse(settings *models.MailSettings, custom bool) gin.H {
+	if !custom {
+		return gin.H{"transport": settings.Transport, "custom": false}
+	}
+	return gin.H{
+		"transport":         settings.Transport,
+		"custom":            true, // False when the server default applies
+		"smtp_host":         settings.SMTPHost,
+		"smtp_port":         settings.SMTPPort,
+		"smtp_username":     settings.SMTPUsername,
+		"smtp_password_set": settings.SMTPPassword != "",
+		"smtp_security":     settings.SMTPSecurity,
+		"from_email":        settings.FromEmail,
+		"from_name":         settings.FromName,
+	}
+}
+
+// GetMailSettings returns the transport the user's emails are sent with
+func GetMailSettings(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var settings models.MailSettings
+	err := config.DB.Where("user_id = ?", userID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		settings = defaultMailSettings()
+		c.JSON(http.StatusOK, mailSettingsResponse(&settings, false))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load mail settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, mailSettingsResponse(&settings, true))
+}
+
+// UpdateMailSettings selects the transport the user's emails are sent with
+// when they pick no Gmail account
+func UpdateMailSettings(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var req MailSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var settings models.MailSettings
+	err := config.DB.Where("user_id = ?", userID).First(&settings).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load mail settings"})
+		return
+	}
+
+	settings.UserID = userID.(uint)
+	settings.Transport = strings.ToLower(strings.TrimSpace(req.Transport))
+	settings.SMTPHost = strings.TrimSpace(req.SMTPHost)
+	settings.SMTPPort = req.SMTPPort
+	settings.SMTPUsername = req.SMTPUsername
+	settings.SMTPSecurity = req.SMTPSecurity
+	settings.FromEmail = strings.TrimSpace(req.FromEmail)
+	settings.FromName = req.FromName
+	if req.SMTPPassword != "" {
+		settings.SMTPPassword = models.EncryptedString(req.SMTPPassword)
+	}
+
+	var errs utils.ValidationErrors
+	switch settings.Transport {
+	case transport.Gmail:
+	case transport.SMTP, transport.File, transport.Sandbox:
+		validateUserTransport(c.Request.Context(), &settings, &errs)
+		if len(errs) == 0 {
+			if _, err := newTransport(&settings); err != nil {
+				errs.Add("transport", "%v", err)
+			}
+		}
+	default:
+		errs.Add("transport", "must be %s, %s or %s", transport.Gmail, transport.SMTP, transport.Sandbox)
+	}
+	if settings.FromEmail != "" {
+		errs = append(errs, utils.ValidateAddress("from_email", utils.EmailAddress{Name: settings.FromName, Email: settings.FromEmail})...)
+	}
+	if len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mail settings", "fields": errs})
+		return
+	}
+
+	if err := config.DB.Save(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save mail settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, mailSettingsResponse(&settings, true))
+}
+
+// ResetMailSettings removes the user's transport settings so the server default applies again
+func ResetMailSettings(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	if err := config.DB.Where("user_id = ?", userID).Delete(&models.MailSettings{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset mail settings"})
+		return
+	}
+
+	settings := defaultMailSettings()
+	c.JSON(http.StatusOK, mailSettingsResponse(&settings, false))
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/transport"
+	"email-app-backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// capturedHTMLPolicy keeps captured HTML from running scripts or loading
+// anything but images and inline styles when it is opened in a browser
+const capturedHTMLPolicy = "sandbox; default-src 'none'; img-src * data:; style-src 'unsafe-inline'"
+
+// sandboxMode reports whether SANDBOX_MODE is set, in which case every email
+// is captured in the database instead of being sent
+func sandboxMode() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("SANDBOX_MODE"))
+	return enabled
+}
+
+// newSandboxTransport captures the emails of a user as CapturedEmail rows. If
+// account is set, they are captured as if sent from that Gmail account.
+func newSandboxTransport(userID uint, account *models.GmailToken) transport.Transport {
+	var accountID uint
+	var defaultFrom string
+	if account != nil {
+		accountID, defaultFrom = account.ID, account.Email
+	}
+
+	return transport.NewCapture(defaultFrom, func(ctx context.Context, messageID string, msg *transport.Message) error {
+		captured := models.CapturedEmail{
+			UserID:       userID,
+			GmailTokenID: accountID,
+			MessageID:    messageID,
+			FromEmail:    msg.From,
+			Recipients:   strings.Join(msg.Recipients, ", "),
+			Size:         len(msg.Raw),
+			Raw:          string(msg.Raw),
+		}
+		if parsed, err := utils.ParseMIMEMessage(msg.Raw); err == nil {
+			captured.Subject = parsed.Subject
+		}
+		return config.DB.WithContext(ctx).Create(&captured).Error
+	})
+}
+
+// CapturedEmailListResponse is a page of captured emails
+type CapturedEmailListResponse struct {
+	Messages    []models.CapturedEmail `json:"messages"`
+	SandboxMode bool                   `json:"sandbox_mode"` // Whether every email is being captured
+	TotalCount  int64                  `json:"total_count"`
+	Page        int                    `json:"page"`
+	PageSize    int                    `json:"page_size"`
+	TotalPages  int                    `json:"total_pages"`
+}
+
+// CapturedEmailDetail is a captured email with its parsed headers and bodies
+type CapturedEmailDetail struct {
+	models.CapturedEmail
+	Headers     map[string][]string      `json:"headers"`
+	TextBody    string                   `json:"text_body"`
+	HTMLBody    string                   `json:"html_body"`
+	Attachments []utils.ParsedAttachment `json:"attachments"`
+	ParseError  string                   `json:"parse_error,omitempty"`
+}
+
+// loadCapturedEmail loads one of the user's captured emails, replying with an error if it cannot
+func loadCapturedEmail(c *gin.Context, userID interface{}) (*models.CapturedEmail, bool) {
+	var captured models.CapturedEmail
+	err := config.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&captured).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Captured email not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load captured email"})
+		return nil, false
+	}
+	return &captured, true
+}
+
+// ListCapturedEmails lists the emails the sandbox captured, newest first
+func ListCapturedEmails(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	page := 1
+	pageSize := 20
+	recipient := c.Query("recipient")  // Part of a recipient address, or empty for all
+	accountID := c.Query("account_id") // Gmail account the emails would have been sent from
+
+	if p := c.Query("page"); p != "" {
+		if parsed, err := fmt.Sscanf(p, "%d", &page); err != nil || parsed != 1 || page < 1 {
+			page = 1
+		}
+	}
+
+	if ps := c.Query("page_size"); ps != "" {
+		if parsed, err := fmt.Sscanf(ps, "%d", &pageSize); err != nil || parsed != 1 || pageSize < 1 || pageSize > 100 {
+			pageSize = 20
+		}
+	}
+
+	query := config.DB.Model(&models.CapturedEmail{}).Where("user_id = ?", userID)
+	if recipient != "" {
+		query = query.Where(`LOWER(recipients) LIKE ? ESCAPE '\'`, "%"+escapeLike(strings.ToLower(recipient))+"%")
+	}
+	if accountID != "" {
+		query = query.Where("gmail_token_id = ?", accountID)
+	}
+
+	var totalCount int64
+	if err := query.Count(&totalCount).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load captured emails"})
+		return
+	}
+
+	messages := []models.CapturedEmail{}
+	offset := (page - 1) * pageSize
+	if err := query.Order("created_at DESC, id DESC").Limit(pageSize).Offset(offset).Find(&messages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load captured emails"})
+		return
+	}
+
+	c.JSON(http.StatusOK, CapturedEmailListResponse{
+		Messages:    messages,
+		SandboxMode: sandboxMode(),
+		TotalCount:  totalCount,
+		Page:        page,
+		PageSize:    pageSize,
+		TotalPages:  int((totalCount + int64(pageSize) - 1) / int64(pageSize)),
+	})
+}
+
+// GetCapturedEmail returns a captured email with its headers, bodies and attachments
+func GetCapturedEmail(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	captured, ok := loadCapturedEmail(c, userID)
+	if !ok {
+		return
+	}
+
+	detail := CapturedEmailDetail{CapturedEmail: *captured, Attachments: []utils.ParsedAttachment{}}
+	parsed, err := utils.ParseMIMEMessage([]byte(captured.Raw))
+	if err != nil {
+		detail.ParseError = err.Error()
+	} else {
+		detail.Headers = parsed.Header
+		detail.TextBody = parsed.TextBody
+		detail.HTMLBody = parsed.HTMLBody
+		detail.Attachments = parsed.Attachments
+	}
+
+	c.JSON(http.StatusOK, detail)
+}
+
+// GetCapturedEmailHTML renders a captured email's HTML body, or its text body
+// when it has none, under a policy that blocks scripts
+func GetCapturedEmailHTML(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	captured, ok := loadCapturedEmail(c, userID)
+	if !ok {
+		return
+	}
+
+	parsed, err := utils.ParseMIMEMessage([]byte(captured.Raw))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Captured email cannot be parsed", "details": err.Error()})
+		return
+	}
+
+	body := parsed.HTMLBody
+	if body == "" {
+		body = "<pre>" + html.EscapeString(parsed.TextBody) + "</pre>"
+	}
+
+	c.Header("Content-Security-Policy", capturedHTMLPolicy)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(body))
+}
+
+// GetCapturedEmailRaw returns a captured email's MIME source, as an .eml
+// download with ?download=true
+func GetCapturedEmailRaw(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	captured, ok := loadCapturedEmail(c, userID)
+	if !ok {
+		return
+	}
+
+	if c.Query("download") == "true" {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="captured-%d.eml"`, captured.ID))
+		c.Data(http.StatusOK, "message/rfc822", []byte(captured.Raw))
+		return
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(captured.Raw))
+}
+
+// DeleteCapturedEmail removes one captured email
+func DeleteCapturedEmail(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	result := config.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).Delete(&models.CapturedEmail{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete captured email"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Captured email not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Captured email deleted"})
+}
+
+// PurgeCapturedEmails removes every email the sandbox captured for the user
+func PurgeCapturedEmails(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	result := config.DB.Where("user_id = ?", userID).Delete(&models.CapturedEmail{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge captured emails"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Captured emails purged", "deleted": result.RowsAffected})
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ScheduledEmailResponse describes a scheduled email along with the request it will send
+type ScheduledEmailResponse struct {
+	models.ScheduledEmail
+	Request json.RawMessage `json:"request"`
+}
+
+// RescheduleRequest moves a scheduled email to a new time
+type RescheduleRequest struct {
+	SendAt   string `json:"send_at" binding:"required"`
+	TimeZone string `json:"time_zone"`
+}
+
+// parseSendAt parses the optional send_at request field. It returns nil when
+// the email should be sent right away.
+func parseSendAt(sendAt, timeZone string) (*time.Time, error) {
+	if strings.TrimSpace(sendAt) == "" {
+		if timeZone != "" {
+			return nil, utils.ValidationErrors{{Field: "time_zone", Message: "time_zone requires send_at"}}
+		}
+		return nil, nil
+	}
+
+	if timeZone != "" {
+		if _, err := time.LoadLocation(timeZone); err != nil {
+			return nil, utils.ValidationErrors{{Field: "time_zone", Message: fmt.Sprintf("unknown time zone %q", timeZone)}}
+		}
+	}
+
+	t, err := utils.ParseScheduleTime(sendAt, timeZone)
+	if err != nil {
+		return nil, utils.ValidationErrors{{Field: "send_at", Message: err.Error()}}
+	}
+	if !t.After(time.Now()) {
+		return nil, utils.ValidationErrors{{Field: "send_at", Message: "send_at must be in the future"}}
+	}
+	return &t, nil
+}
+
+// scheduleEmail stores a validated send request to be dispatched at sendAt and replies 202
+func scheduleEmail(c *gin.Context, userID uint, kind string, sendAt time.Time, timeZone, subject string, recipientCount int, req interface{}) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare scheduled email"})
+		return
+	}
+
+	scheduled := models.ScheduledEmail{
+		UserID:         userID,
+		Kind:           kind,
+		Status:         models.ScheduledPending,
+		SendAt:         sendAt.UTC(),
+		TimeZone:       timeZone,
+		Subject:        subject,
+		RecipientCount: recipientCount,
+		Payload:        string(payload),
+	}
+	if err := config.DB.Create(&scheduled).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule email"})
+		return
+	}
+
+	wakeScheduler()
+
+	fmt.Printf("User %v scheduled %s email %d for %s\n", userID, kind, scheduled.ID, scheduled.SendAt.Format(time.RFC3339))
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":      "Email scheduled",
+		"scheduled_id": scheduled.ID,
+		"kind":         scheduled.Kind,
+		"status":       scheduled.Status,
+		"send_at":      scheduled.SendAt,
+	})
+}
+
+// findUserScheduledEmail loads a scheduled email owned by the user in the request context
+func findUserScheduledEmail(c *gin.Context, userID interface{}) (*models.ScheduledEmail, bool) {
+	var scheduled models.ScheduledEmail
+	if err := config.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&scheduled).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled email not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load scheduled email"})
+		}
+		return nil, false
+	}
+	return &scheduled, true
+}
+
+// ListScheduledEmails lists the user's scheduled emails, next to be sent first.
+// Only pending ones are listed unless ?status= asks for another status or "all".
+func ListScheduledEmails(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	query := config.DB.Where("user_id = ?", userID)
+	if status := c.DefaultQuery("status", models.ScheduledPending); status != "all" {
+		query = query.Where("status = ?", status)
+	}
+
+	var scheduled []models.ScheduledEmail
+	if err := query.Order("send_at").Limit(100).Find(&scheduled).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load scheduled emails"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"scheduled": scheduled})
+}
+
+// GetScheduledEmail returns a scheduled email with the request it will send
+func GetScheduledEmail(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	scheduled, ok := findUserScheduledEmail(c, userID)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, ScheduledEmailResponse{
+		ScheduledEmail: *scheduled,
+		Request:        json.RawMessage(scheduled.Payload),
+	})
+}
+
+// RescheduleEmail moves a pending scheduled email to a new send time
+func RescheduleEmail(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var req RescheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sendAt, err := parseSendAt(req.SendAt, req.TimeZone)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	scheduled, ok := findUserScheduledEmail(c, userID)
+	if !ok {
+		return
+	}
+
+	result := config.DB.Model(&models.ScheduledEmail{}).
+		Where("id = ? AND status = ?", scheduled.ID, models.ScheduledPending).
+		Updates(map[string]interface{}{"send_at": sendAt.UTC(), "time_zone": req.TimeZone})
+	respondScheduledTransition(c, scheduled, result, "reschedule", "rescheduled")
+	if result.Error == nil && result.RowsAffected > 0 {
+		wakeScheduler()
+	}
+}
+
+// CancelScheduledEmail cancels a scheduled email that has not been sent yet
+func CancelScheduledEmail(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	scheduled, ok := findUserScheduledEmail(c, userID)
+	if !ok {
+		return
+	}
+
+	result := config.DB.Model(&models.ScheduledEmail{}).
+		Where("id = ? AND status = ?", scheduled.ID, models.ScheduledPending).
+		Update("status", models.ScheduledCancelled)
+	respondScheduledTransition(c, scheduled, result, "cancel", "cancelled")
+}
+
+// respondScheduledTransition replies to a reschedule or cancel request with the scheduled email's current state
+func respondScheduledTransition(c *gin.Context, scheduled *models.ScheduledEmail, result *gorm.DB, action, pastTense string) {
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to %s email", action)})
+		return
+	}
+
+	current := models.ScheduledEmail{}
+	config.DB.First(&current, "id = ?", scheduled.ID)
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  fmt.Sprintf("Scheduled email is %s and cannot be %s", current.Status, pastTense),
+			"status": current.Status,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   fmt.Sprintf("Scheduled email %s", pastTense),
+		"scheduled": current,
+	})
+}
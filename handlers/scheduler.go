@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// schedulerMaxWait is the longest the scheduler sleeps before looking for due emails again
+	schedulerMaxWait = time.Minute
+
+	// scheduledEmailLeaseDuration is how long a process holds an email it
+	// dispatches without renewing it; another process only recovers the email once it expires
+	scheduledEmailLeaseDuration = time.Minute
+
+	// scheduledEmailHeartbeatInterval is how often the lease of an email being dispatched is renewed
+	scheduledEmailHeartbeatInterval = 15 * time.Second
+)
+
+// errScheduledLeaseLost is returned when recording an email this process no longer holds
+var errScheduledLeaseLost = errors.New("scheduled email lease lost")
+
+var schedulerWakeup = make(chan struct{}, 1)
+
+// StartScheduler starts dispatching scheduled emails when they are due.
+// Emails whose process stopped renewing their lease while dispatching them,
+// e.g. because it was restarted, are recovered; emails other processes are
+// still dispatching are left alone.
+func StartScheduler() {
+	go func() {
+		for {
+			recoverExpiredScheduledEmails()
+
+			wait := schedulerMaxWait
+			if next := dispatchDueScheduledEmails(); next != nil && time.Until(*next) < wait {
+				wait = time.Until(*next)
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-schedulerWakeup:
+				timer.Stop()
+			}
+		}
+	}()
+}
+
+// wakeScheduler makes the scheduler recompute when the next email is due
+func wakeScheduler() {
+	select {
+	case schedulerWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchDueScheduledEmails dispatches every scheduled email that is due and
+// returns when the next one is due, or nil if none is pending
+func dispatchDueScheduledEmails() *time.Time {
+	var due []models.ScheduledEmail
+	if err := config.DB.Where("status = ? AND send_at <= ?", models.ScheduledPending, time.Now()).
+		Order("send_at").Find(&due).Error; err != nil {
+		fmt.Printf("Scheduler failed to load due emails: %v\n", err)
+	}
+
+	for i := range due {
+		scheduled := due[i]
+		if !claimScheduledEmail(&scheduled) {
+			continue
+		}
+		go dispatchScheduledEmail(&scheduled)
+	}
+
+	var next models.ScheduledEmail
+	if err := config.DB.Where("status = ?", models.ScheduledPending).Order("send_at").First(&next).Error; err != nil {
+		return nil
+	}
+	return &next.SendAt
+}
+
+// claimScheduledEmail atomically moves a pending scheduled email to
+// processing, leased to this process, so it is only dispatched once
+func claimScheduledEmail(scheduled *models.ScheduledEmail) bool {
+	result := config.DB.Model(&models.ScheduledEmail{}).
+		Where("id = ? AND status = ?", scheduled.ID, models.ScheduledPending).
+		Updates(map[string]interface{}{
+			"status":           models.ScheduledProcessing,
+			"worker_id":        bulkWorkerID,
+			"lease_expires_at": time.Now().Add(scheduledEmailLeaseDuration),
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+
+	scheduled.Status = models.ScheduledProcessing
+	scheduled.WorkerID = bulkWorkerID
+	return true
+}
+
+// heartbeatScheduledEmail renews the lease of an email this process
+// dispatches until done is closed
+func heartbeatScheduledEmail(id uint, done <-chan struct{}) {
+	ticker := time.NewTicker(scheduledEmailHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		result := config.DB.Model(&models.ScheduledEmail{}).
+			Where("id = ? AND worker_id = ?", id, bulkWorkerID).
+			Update("lease_expires_at", time.Now().Add(scheduledEmailLeaseDuration))
+		if result.Error != nil {
+			fmt.Printf("Scheduled email %d failed to renew its lease: %v\n", id, result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			fmt.Printf("Scheduled email %d lost its lease\n", id)
+			return
+		}
+	}
+}
+
+// recoverExpiredScheduledEmails takes back the emails whose process stopped
+// renewing its lease while dispatching them. Those it had not started sending
+// are scheduled again. The others are marked failed, since it is unknown
+// whether they were sent; they can be rescheduled by the user.
+func recoverExpiredScheduledEmails() {
+	expired := func() *gorm.DB {
+		return config.DB.Model(&models.ScheduledEmail{}).
+			Where("status = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?)", models.ScheduledProcessing, time.Now())
+	}
+
+	result := expired().Where("dispatched_at IS NULL").
+		Updates(map[string]interface{}{
+			"status":           models.ScheduledPending,
+			"worker_id":        "",
+			"lease_expires_at": nil,
+		})
+	if result.Error != nil {
+		fmt.Printf("Scheduler failed to reschedule interrupted emails: %v\n", result.Error)
+	} else if result.RowsAffected > 0 {
+		fmt.Printf("Scheduler rescheduled %d interrupted emails\n", result.RowsAffected)
+	}
+
+	result = expired().
+		Updates(map[string]interface{}{
+			"status":           models.ScheduledFailed,
+			"error_message":    "Interrupted while sending, the email may have been sent",
+			"worker_id":        "",
+			"lease_expires_at": nil,
+		})
+	if result.Error != nil {
+		fmt.Printf("Scheduler failed to recover interrupted emails: %v\n", result.Error)
+	} else if result.RowsAffected > 0 {
+		fmt.Printf("Scheduler marked %d interrupted emails failed\n", result.RowsAffected)
+	}
+}
+
+// dispatchScheduledEmail sends a single scheduled email or queues a scheduled
+// bulk job, and records the outcome while this process still holds the email
+func dispatchScheduledEmail(scheduled *models.ScheduledEmail) {
+	done := make(chan struct{})
+	defer close(done)
+	go heartbeatScheduledEmail(scheduled.ID, done)
+
+	var updates map[string]interface{}
+	var job *models.BulkJob
+	switch scheduled.Kind {
+	case models.ScheduledBulk:
+		updates, job = dispatchScheduledBulk(scheduled)
+	default:
+		updates = dispatchScheduledSingle(scheduled)
+	}
+
+	// The bulk job is created along with the outcome, so if the process stops
+	// before either is stored the email is simply dispatched again
+	err := recordScheduledEmail(scheduled, updates, job)
+	if err != nil && job != nil && err != errScheduledLeaseLost {
+		fmt.Printf("Scheduler failed to queue bulk job for scheduled email %d: %v\n", scheduled.ID, err)
+		updates, job = scheduledFailure("Failed to queue bulk job"), nil
+		err = recordScheduledEmail(scheduled, updates, nil)
+	}
+	if err != nil {
+		fmt.Printf("Scheduler failed to record scheduled email %d: %v\n", scheduled.ID, err)
+		return
+	}
+	if job != nil {
+		wakeBulkWorker()
+	}
+	fmt.Printf("User %v scheduled %s email %d: %v\n", scheduled.UserID, scheduled.Kind, scheduled.ID, updates["status"])
+}
+
+// recordScheduledEmail stores the outcome of dispatching an email this process
+// holds and releases its lease, creating job in the same transaction if set
+func recordScheduledEmail(scheduled *models.ScheduledEmail, updates map[string]interface{}, job *models.BulkJob) error {
+	updates["worker_id"] = ""
+	updates["lease_expires_at"] = nil
+
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		if job != nil {
+			if err := tx.Create(job).Error; err != nil {
+				return err
+			}
+		}
+
+		result := tx.Model(&models.ScheduledEmail{}).
+			Where("id = ? AND worker_id = ?", scheduled.ID, bulkWorkerID).
+			Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errScheduledLeaseLost
+		}
+		return nil
+	})
+}
+
+func dispatchScheduledSingle(scheduled *models.ScheduledEmail) map[string]interface{} {
+	var req SendEmailRequest
+	if err := json.Unmarshal([]byte(scheduled.Payload), &req); err != nil {
+		return scheduledFailure(fmt.Sprintf("Failed to decode scheduled email: %v", err))
+	}
+
+	email, err := buildSendEmailMessage(&req)
+	if err != nil {
+		return scheduledFailure(err.Error())
+	}
+
+	sender, err := loadMailSender(scheduled.UserID, req.FromAccountID)
+	if err != nil {
+		return scheduledFailure(err.Error())
+	}
+
+	// From here on the email may be sent, so it is not dispatched again if this process stops
+	err = config.DB.Model(&models.ScheduledEmail{}).
+		Where("id = ? AND worker_id = ?", scheduled.ID, bulkWorkerID).
+		Update("dispatched_at", time.Now()).Error
+	if err != nil {
+		return scheduledFailure("Failed to record the dispatch")
+	}
+
+	messageID, err := deliverEmail(context.Background(), scheduled.UserID, sender, &req, email)
+	var limitErr *dailyLimitError
+	if errors.As(err, &limitErr) {
+		// Nothing was sent; try again once the daily limit resets
+		wakeScheduler()
+		return map[string]interface{}{
+			"status":        models.ScheduledPending,
+			"send_at":       limitErr.resetAt,
+			"error_message": limitErr.Error(),
+			"dispatched_at": nil,
+		}
+	}
+	if err != nil {
+		return scheduledFailure(err.Error())
+	}
+
+	return map[string]interface{}{
+		"status":           models.ScheduledSent,
+		"gmail_message_id": messageID,
+		"error_message":    "",
+		"dispatched_at":    time.Now(),
+	}
+}
+
+// dispatchScheduledBulk prepares the bulk job of a scheduled batch, which is
+// queued when the outcome is recorded
+func dispatchScheduledBulk(scheduled *models.ScheduledEmail) (map[string]interface{}, *models.BulkJob) {
+	var req BulkEmailRequest
+	if err := json.Unmarshal([]byte(scheduled.Payload), &req); err != nil {
+		return scheduledFailure(fmt.Sprintf("Failed to decode scheduled bulk email: %v", err)), nil
+	}
+
+	// A revoked account pauses the job once it runs, so it can be resumed after
+	// reconnecting. Accounts of a rotation are checked by the worker.
+	if req.FromAccountID != 0 {
+		if _, err := loadGmailAccount(scheduled.UserID, req.FromAccountID); err != nil && !errors.Is(err, errGmailRevoked) {
+			return scheduledFailure(err.Error()), nil
+		}
+	}
+
+	job, err := newBulkJob(scheduled.UserID, &req)
+	if err != nil {
+		return scheduledFailure("Failed to prepare bulk job"), nil
+	}
+
+	return map[string]interface{}{
+		"status":        models.ScheduledSent,
+		"job_id":        job.ID,
+		"error_message": "",
+		"dispatched_at": time.Now(),
+	}, job
+}
+
+func scheduledFailure(message string) map[string]interface{} {
+	return map[string]interface{}{
+		"status":        models.ScheduledFailed,
+		"error_message": message,
+		"dispatched_at": time.Now(),
+	}
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/transport"
+	"email-app-backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/googleapi"
+	"gorm.io/gorm"
+)
+
+// sendAsCacheTTL is how long the send-as addresses fetched from Gmail are reused
+const sendAsCacheTTL = time.Hour
+
+// loadSendAsAliases returns the send-as addresses of the sender's account,
+// fetching them from Gmail when the cache is older than sendAsCacheTTL or
+// refresh is set. A stale cache is used if Gmail cannot be reached. Senders
+// whose emails are captured by the sandbox only use the cache, so sandbox sends
+// never call Gmail.
+func loadSendAsAliases(sender *mailSender, refresh bool) ([]models.GmailSendAs, error) {
+	var cached []models.GmailSendAs
+	if err := config.DB.Where("gmail_token_id = ?", sender.account.ID).Order("is_primary desc, email").Find(&cached).Error; err != nil {
+		return nil, err
+	}
+	if !refresh && len(cached) > 0 && time.Since(cached[0].FetchedAt) < sendAsCacheTTL {
+		return cached, nil
+	}
+	if !refresh && sender.transport.Name() == transport.Sandbox {
+		return cached, nil
+	}
+
+	aliases, err := fetchSendAsAliases(sender)
+	if err != nil {
+		if !refresh && len(cached) > 0 {
+			fmt.Printf("Using cached send-as addresses of Gmail account %d: %v\n", sender.account.ID, err)
+			return cached, nil
+		}
+		return nil, err
+	}
+	return aliases, nil
+}
+
+// fetchSendAsAliases lists the account's send-as addresses from Gmail and replaces the cached ones
+func fetchSendAsAliases(sender *mailSender) ([]models.GmailSendAs, error) {
+	list, err := sender.service.Users.Settings.SendAs.List("me").Do()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	aliases := make([]models.GmailSendAs, 0, len(list.SendAs))
+	for _, sendAs := range list.SendAs {
+		aliases = append(aliases, models.GmailSendAs{
+			GmailTokenID:       sender.account.ID,
+			Email:              sendAs.SendAsEmail,
+			DisplayName:        sendAs.DisplayName,
+			ReplyTo:            sendAs.ReplyToAddress,
+			IsPrimary:          sendAs.IsPrimary,
+			IsDefault:          sendAs.IsDefault,
+			VerificationStatus: sendAs.VerificationStatus,
+			FetchedAt:          now,
+		})
+	}
+
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("gmail_token_id = ?", sender.account.ID).Delete(&models.GmailSendAs{}).Error; err != nil {
+			return err
+		}
+		if len(aliases) == 0 {
+			return nil
+		}
+		return tx.Create(&aliases).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+// parseFrom parses the optional from request field
+func parseFrom(value string) (utils.EmailAddress, error) {
+	if strings.TrimSpace(value) == "" {
+		return utils.EmailAddress{}, nil
+	}
+
+	address, err := utils.ParseEmailAddress(value)
+	if err != nil {
+		return utils.EmailAddress{}, utils.ValidationErrors{{Field: "from", Message: err.Error()}}
+	}
+	return address, nil
+}
+
+// resolveSendAs checks that the sender's account may send as the requested
+// from address and returns it, named after the alias if the request gave no
+// name. An address Gmail does not list fails with ValidationErrors. The
+// account's own address is accepted without asking Gmail. Senders that are not
+// Gmail accounts send from their configured address, which SMTP servers
+// require to be the only one.
+func resolveSendAs(sender *mailSender, value string) (utils.EmailAddress, error) {
+	from, err := parseFrom(value)
+	if err != nil {
+		return from, err
+	}
+	if sender.account == nil {
+		return resolveTransportFrom(sender, from)
+	}
+	if from.Email == "" {
+		return from, nil
+	}
+	if strings.EqualFold(from.Email, sender.account.Email) {
+		return from, nil
+	}
+
+	aliases, err := loadSendAsAliases(sender, false)
+	if err != nil {
+		return utils.EmailAddress{}, err
+	}
+	if len(aliases) == 0 && sender.transport.Name() == transport.Sandbox {
+		// Nothing was fetched from Gmail yet, and the sandbox does not ask it
+		return from, nil
+	}
+
+	for _, alias := range aliases {
+		if !strings.EqualFold(alias.Email, from.Email) {
+			continue
+		}
+		if !alias.CanSend() {
+			return utils.EmailAddress{}, utils.ValidationErrors{{Field: "from", Message: fmt.Sprintf("send-as address %s is not verified in Gmail", alias.Email)}}
+		}
+		if from.Name == "" {
+			from.Name = alias.DisplayName
+		}
+		from.Email = alias.Email
+		return from, nil
+	}
+
+	return utils.EmailAddress{}, utils.ValidationErrors{{Field: "from", Message: fmt.Sprintf("%s is not a send-as address of the Gmail account", from.Email)}}
+}
+
+// resolveTransportFrom picks the From address of a sender that is not a Gmail account
+func resolveTransportFrom(sender *mailSender, from utils.EmailAddress) (utils.EmailAddress, error) {
+	if from.Email == "" {
+		return sender.from, nil
+	}
+	if sender.transport.Name() == transport.SMTP && sender.from.Email != "" && !strings.EqualFold(from.Email, sender.from.Email) {
+		return utils.EmailAddress{}, utils.ValidationErrors{{Field: "from", Message: fmt.Sprintf("the SMTP transport sends from %s only", sender.from.Email)}}
+	}
+	if from.Name == "" {
+		from.Name = sender.from.Name
+	}
+	return from, nil
+}
+
+// respondSendAsError replies to a request whose send-as addresses could not be checked
+func respondSendAsError(c *gin.Context, err error) {
+	var validationErrors utils.ValidationErrors
+	var apiErr *googleapi.Error
+	switch {
+	case errors.As(err, &validationErrors):
+		respondValidationError(c, err)
+	case isInvalidGrant(err):
+		respondGmailTokenError(c, err)
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Gmail did not allow reading send-as addresses, please reconnect your Gmail account"})
+	default:
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to load Gmail send-as addresses", "details": err.Error()})
+	}
+}
+
+// ListSendAsAliases lists the addresses a connected Gmail account can send as.
+// The list is cached; ?refresh=true fetches it from Gmail again.
+func ListSendAsAliases(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var account models.GmailToken
+	if err := config.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&account).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Gmail account not found"})
+		return
+	}
+	if account.RevokedAt != nil {
+		respondGmailTokenError(c, errGmailRevoked)
+		return
+	}
+
+	sender, err := newGmailSender(&account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create Gmail service"})
+		return
+	}
+
+	aliases, err := loadSendAsAliases(sender, c.Query("refresh") == "true")
+	if err != nil {
+		respondSendAsError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account_id": account.ID,
+		"email":      account.Email,
+		"aliases":    aliases,
+	})
+}
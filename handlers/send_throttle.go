@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/transport"
+	"email-app-backend/utils"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// maxSendAttempts is how often a message is tried when Gmail reports a temporary error
+	maxSendAttempts = 5
+
+	// defaultDailySendLimit is Gmail's limit of recipients per day for consumer accounts
+	defaultDailySendLimit = 500
+
+	// dailyLimitFallbackWait is how long to wait when Gmail reports the daily limit without saying until when
+	dailyLimitFallbackWait = time.Hour
+)
+
+// sendBackoff spaces out the retries of a message that hit a temporary error
+var sendBackoff = utils.Backoff{Base: time.Second, Max: time.Minute}
+
+var (
+	sendLimiters   = make(map[string]*utils.AdaptiveLimiter)
+	sendLimitersMu sync.Mutex
+)
+
+// dailyLimitError reports that an account may not send any more emails until resetAt
+type dailyLimitError struct {
+	resetAt time.Time
+}
+
+func (e *dailyLimitError) Error() string {
+	return fmt.Sprintf("daily sending limit reached, sending resumes at %s", e.resetAt.Format(time.RFC3339))
+}
+
+// sendLimiter returns the concurrency limiter shared by every send with the
+// same key: a Gmail account, since Gmail enforces its rate limits per account,
+// or an SMTP server account
+func sendLimiter(key string) *utils.AdaptiveLimiter {
+	sendLimitersMu.Lock()
+	defer sendLimitersMu.Unlock()
+
+	limiter, ok := sendLimiters[key]
+	if !ok {
+		limiter = utils.NewAdaptiveLimiter(2, 1, maxConcurrentSends)
+		sendLimiters[key] = limiter
+	}
+	return limiter
+}
+
+// dailySendLimit returns the number of recipients an account may send to in 24 hours,
+// from GMAIL_DAILY_SEND_LIMIT. Zero or a negative value disables the limit.
+func dailySendLimit() int {
+	if value := os.Getenv("GMAIL_DAILY_SEND_LIMIT"); value != "" {
+		if limit, err := strconv.Atoi(value); err == nil {
+			return limit
+		}
+	}
+	return defaultDailySendLimit
+}
+
+// dailyQuotaUsed counts the recipients an account sent to, or is about to,
+// since the start of the daily window. Emails sent before the account's first
+// reservation are counted from the history instead.
+func dailyQuotaUsed(db *gorm.DB, accountID uint, since time.Time) (int, error) {
+	var reserved int64
+	err := db.Model(&models.SendQuotaReservation{}).
+		Where("gmail_token_id = ? AND reserved_at > ?", accountID, since).
+		Select("COALESCE(SUM(recipients), 0)").Scan(&reserved).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var sent int64
+	err = db.Model(&models.EmailHistory{}).
+		Where("gmail_token_id = ? AND status = ? AND sent_at > ?", accountID, "sent", since).
+		Where("NOT EXISTS (?)", db.Model(&models.SendQuotaReservation{}).
+			Select("1").Where("gmail_token_id = ? AND reserved_at <= email_histories.sent_at", accountID)).
+		Count(&sent).Error
+	return int(reserved + sent), err
+}
+
+// dailyQuotaResetAt returns when the oldest email of an account's daily window
+// is 24 hours old, so sending can resume
+func dailyQuotaResetAt(db *gorm.DB, accountID uint, since time.Time) time.Time {
+	var oldest []time.Time
+	db.Model(&models.SendQuotaReservation{}).
+		Where("gmail_token_id = ? AND reserved_at > ?", accountID, since).
+		Order("reserved_at").Limit(1).Pluck("reserved_at", &oldest)
+
+	var oldestHistory models.EmailHistory
+	if err := db.Where("gmail_token_id = ? AND status = ? AND sent_at > ?", accountID, "sent", since).
+		Order("sent_at").First(&oldestHistory).Error; err == nil {
+		oldest = append(oldest, oldestHistory.SentAt)
+	}
+
+	resetAt := time.Now().Add(dailyLimitFallbackWait)
+	for i, at := range oldest {
+		if i == 0 || at.Add(24*time.Hour).Before(resetAt) {
+			resetAt = at.Add(24 * time.Hour)
+		}
+	}
+	return resetAt
+}
+
+// reserveDailyQuota takes recipients from the account's limit over the last 24
+// hours, or returns a *dailyLimitError if there is not enough left. Reservations
+// of an account are made one at a time, holding a lock on its row, so
+// concurrent sends cannot together exceed the limit. It returns nil without a
+// limit.
+func reserveDailyQuota(accountID uint, recipients int) (*models.SendQuotaReservation, error) {
+	limit := dailySendLimit()
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	var reservation *models.SendQuotaReservation
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		var account models.GmailToken
+		if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&account, accountID).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		since := now.Add(-24 * time.Hour)
+		used, err := dailyQuotaUsed(tx, accountID, since)
+		if err != nil {
+			return err
+		}
+		if used+recipients > limit {
+			return &dailyLimitError{resetAt: dailyQuotaResetAt(tx, accountID, since)}
+		}
+
+		// Reservations that fell out of the window are no longer needed
+		if err := tx.Where("gmail_token_id = ? AND reserved_at <= ?", accountID, since).Delete(&models.SendQuotaReservation{}).Error; err != nil {
+			return err
+		}
+		reservation = &models.SendQuotaReservation{GmailTokenID: accountID, Recipients: recipients, ReservedAt: now}
+		return tx.Create(reservation).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+// releaseDailyQuota gives back the quota reserved for a message that was not sent
+func releaseDailyQuota(reservation *models.SendQuotaReservation) {
+	if reservation == nil {
+		return
+	}
+	if err := config.DB.Delete(reservation).Error; err != nil {
+		fmt.Printf("Failed to release the daily quota reserved for Gmail account %d: %v\n", reservation.GmailTokenID, err)
+	}
+}
+
+// sendWithRetry sends a message once the sender's quota and concurrency limits
+// allow it. Rate limit, server and network errors are retried with exponential
+// backoff; rate limit errors lower the sender's concurrency. When a Gmail
+// account's daily limit is reached a *dailyLimitError is returned, and if ctx
+// ends while waiting its error is returned. The quota reserved for the message
+// is given back if it was not sent.
+func sendWithRetry(ctx context.Context, sender *mailSender, msg *transport.Message) (string, error) {
+	if sender.account == nil {
+		return sendThrottled(ctx, sender, msg)
+	}
+
+	reservation, err := reserveDailyQuota(sender.account.ID, len(msg.Recipients))
+	if err != nil {
+		return "", err
+	}
+	messageID, err := sendThrottled(ctx, sender, msg)
+	if err != nil {
+		releaseDailyQuota(reservation)
+	}
+	return messageID, err
+}
+
+// sendThrottled sends a message within the sender's concurrency limit,
+// retrying temporary errors
+func sendThrottled(ctx context.Context, sender *mailSender, msg *transport.Message) (string, error) {
+	limiter := sendLimiter(sender.limiterKey)
+	for attempt := 0; ; attempt++ {
+		if err := limiter.Acquire(ctx); err != nil {
+			return "", err
+		}
+		// A send that started is finished even if ctx ends, so its outcome is known
+		messageID, err := sender.transport.Send(context.WithoutCancel(ctx), msg)
+		limiter.Release()
+
+		if err == nil {
+			limiter.Success()
+			return messageID, nil
+		}
+
+		switch utils.ClassifyGmailError(err) {
+		case utils.GmailErrorDailyLimit:
+			wait := utils.RetryAfter(err)
+			if wait == 0 {
+				wait = dailyLimitFallbackWait
+			}
+			return "", &dailyLimitError{resetAt: time.Now().Add(wait)}
+		case utils.GmailErrorRateLimit:
+			limiter.Throttled()
+		case utils.GmailErrorServer, utils.GmailErrorNetwork:
+		default:
+			return "", err
+		}
+
+		if attempt+1 >= maxSendAttempts {
+			return "", err
+		}
+		if err := utils.Sleep(ctx, sendBackoff.DelayFor(err, attempt)); err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+	"email-app-backend/utils"
+)
+
+// BulkSender is one Gmail account a bulk job rotates between
+type BulkSender struct {
+	AccountID uint `json:"account_id"`
+	Weight    int  `json:"weight,omitempty"` // Share of the recipients with the weighted rotation, 1 if unset
+}
+
+// rotationSender is an account of a rotation and what the rotation knows about it
+type rotationSender struct {
+	sender       *mailSender
+	weight       int
+	currentScore int       // Smooth weighted round robin state
+	remaining    int       // Daily quota left, for quota_remaining
+	limitedUntil time.Time // Set once the account reached its daily limit
+	revoked      bool
+}
+
+// senderRotation picks the account each email of a bulk job is sent from.
+// Accounts that reach their daily limit or lose access are skipped, so the
+// job keeps going as long as one account can still send.
+type senderRotation struct {
+	mu       sync.Mutex
+	strategy string
+	senders  []*rotationSender
+	next     int
+}
+
+// validateBulkSenders checks the accounts and rotation strategy of a bulk
+// request. Senders replace from_account_id and cannot be combined with a
+// send-as from address, since aliases belong to a single account.
+func validateBulkSenders(req *BulkEmailRequest) error {
+	var errs utils.ValidationErrors
+	switch req.Rotation {
+	case "", models.RotationRoundRobin, models.RotationWeighted, models.RotationQuotaRemaining:
+	default:
+		errs.Add("rotation", "must be %s, %s or %s", models.RotationRoundRobin, models.RotationWeighted, models.RotationQuotaRemaining)
+	}
+
+	if len(req.Senders) > 0 {
+		if req.FromAccountID != 0 {
+			errs.Add("from_account_id", "cannot be combined with senders")
+		}
+		if req.From != "" {
+			errs.Add("from", "cannot be combined with senders")
+		}
+	}
+
+	seen := make(map[uint]bool)
+	for i, sender := range req.Senders {
+		field := fmt.Sprintf("senders[%d]", i)
+		if sender.AccountID == 0 {
+			errs.Add(field+".account_id", "is required")
+		} else if seen[sender.AccountID] {
+			errs.Add(field+".account_id", "account %d is listed more than once", sender.AccountID)
+		}
+		seen[sender.AccountID] = true
+		if sender.Weight < 0 {
+			errs.Add(field+".weight", "must not be negative")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// bulkJobSenders returns the accounts a job is sent from: its rotation
+// senders, or the single account it was queued with
+func bulkJobSenders(job *models.BulkJob) ([]BulkSender, error) {
+	if job.Senders == "" {
+		return []BulkSender{{AccountID: job.GmailTokenID}}, nil
+	}
+
+	var senders []BulkSender
+	if err := json.Unmarshal([]byte(job.Senders), &senders); err != nil {
+		return nil, fmt.Errorf("failed to decode job senders: %v", err)
+	}
+	return senders, nil
+}
+
+// loadBulkJobSenders loads the accounts a job rotates between, leaving out the
+// ones that were disconnected or revoked. A job queued without a Gmail account
+// sends through the user's transport. It fails with errGmailRevoked when only
+// revoked accounts are left and errGmailNotConnected when none is.
+func loadBulkJobSenders(job *models.BulkJob) ([]*rotationSender, error) {
+	senders, err := bulkJobSenders(job)
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded []*rotationSender
+	revoked := false
+	for _, sender := range senders {
+		mailSender, err := loadMailSender(job.UserID, sender.AccountID)
+		switch {
+		case errors.Is(err, errGmailRevoked):
+			revoked = true
+			continue
+		case isGmailSenderError(err):
+			continue
+		case err != nil:
+			return nil, err
+		}
+
+		weight := sender.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		loaded = append(loaded, &rotationSender{sender: mailSender, weight: weight})
+	}
+
+	if len(loaded) == 0 {
+		if revoked {
+			return nil, errGmailRevoked
+		}
+		return nil, errGmailNotConnected
+	}
+	return loaded, nil
+}
+
+// newSenderRotation rotates between senders with strategy, round robin if it
+// is empty. The quota_remaining strategy starts from each account's daily
+// quota left, and works as round robin when the daily limit is disabled.
+func newSenderRotation(strategy string, senders []*rotationSender) *senderRotation {
+	rotation := &senderRotation{strategy: strategy, senders: senders}
+	if strategy != models.RotationQuotaRemaining {
+		return rotation
+	}
+
+	limit := dailySendLimit()
+	if limit <= 0 {
+		rotation.strategy = models.RotationRoundRobin
+		return rotation
+	}
+
+	since := time.Now().Add(-24 * time.Hour)
+	for _, sender := range senders {
+		used, err := dailyQuotaUsed(config.DB, sender.sender.accountID(), since)
+		if err != nil {
+			fmt.Printf("Failed to count the daily quota of Gmail account %d: %v\n", sender.sender.accountID(), err)
+		}
+		sender.remaining = limit - used
+	}
+	return rotation
+}
+
+// pick returns the account the next email is sent from. When no account can
+// send it returns nil and the earliest time an account's daily limit resets,
+// or a zero time if every account was revoked.
+func (r *senderRotation) pick() (*mailSender, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var available []*rotationSender
+	var resetAt time.Time
+	for _, sender := range r.senders {
+		switch {
+		case sender.revoked:
+		case sender.limitedUntil.After(now):
+			if resetAt.IsZero() || sender.limitedUntil.Before(resetAt) {
+				resetAt = sender.limitedUntil
+			}
+		default:
+			available = append(available, sender)
+		}
+	}
+	if len(available) == 0 {
+		return nil, resetAt
+	}
+
+	var chosen *rotationSender
+	switch r.strategy {
+	case models.RotationWeighted:
+		// Smooth weighted round robin spreads each account's share evenly over the job
+		total := 0
+		for _, sender := range available {
+			sender.currentScore += sender.weight
+			total += sender.weight
+			if chosen == nil || sender.currentScore > chosen.currentScore {
+				chosen = sender
+			}
+		}
+		chosen.currentScore -= total
+	case models.RotationQuotaRemaining:
+		for _, sender := range available {
+			if chosen == nil || sender.remaining > chosen.remaining {
+				chosen = sender
+			}
+		}
+		chosen.remaining--
+	default:
+		chosen = available[r.next%len(available)]
+		r.next++
+	}
+
+	return chosen.sender, time.Time{}
+}
+
+// limitReached takes an account out of the rotation until its daily limit resets
+func (r *senderRotation) limitReached(sender *mailSender, resetAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, candidate := range r.senders {
+		if candidate.sender == sender {
+			candidate.limitedUntil = resetAt
+		}
+	}
+}
+
+// revoked takes an account whose access was revoked out of the rotation
+func (r *senderRotation) revoked(sender *mailSender) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, candidate := range r.senders {
+		if candidate.sender == sender {
+			candidate.revoked = true
+		}
+	}
+}
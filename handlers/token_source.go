@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+
+	"golang.org/x/oauth2"
+)
+
+// errGmailRevoked is returned when Google no longer accepts the stored refresh token
+var errGmailRevoked = errors.New("Gmail access was revoked")
+
+// persistingTokenSource refreshes the access token of a stored Gmail token
+// when it expires and writes the new token back, so later requests and other
+// processes reuse it instead of refreshing again. A refresh token rejected with
+// invalid_grant marks the stored token as revoked.
+type persistingTokenSource struct {
+	mu         sync.Mutex
+	gmailToken *models.GmailToken
+	base       oauth2.TokenSource
+	current    *oauth2.Token
+}
+
+func newPersistingTokenSource(ctx context.Context, gmailToken *models.GmailToken) *persistingTokenSource {
+	token := &oauth2.Token{
+		AccessToken:  string(gmailToken.AccessToken),
+		RefreshToken: string(gmailToken.RefreshToken),
+		TokenType:    gmailToken.TokenType,
+		Expiry:       gmailToken.ExpiresAt,
+	}
+
+	return &persistingTokenSource{
+		gmailToken: gmailToken,
+		base:       gmailOAuthConfig().TokenSource(ctx, token),
+		current:    token,
+	}
+}
+
+// Token returns a valid access token, refreshing and persisting it if needed
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, err := s.base.Token()
+	if err != nil {
+		if isInvalidGrant(err) {
+			markGmailTokenRevoked(s.gmailToken)
+		}
+		return nil, err
+	}
+
+	if token.AccessToken != s.current.AccessToken {
+		s.persist(token)
+	}
+	s.current = token
+	return token, nil
+}
+
+// persist writes a refreshed token to the database and to the loaded model
+func (s *persistingTokenSource) persist(token *oauth2.Token) {
+	// Google only sends a refresh token again if it rotated it. Both token
+	// columns are written so they are encrypted with the same key version.
+	refreshToken := s.gmailToken.RefreshToken
+	if token.RefreshToken != "" {
+		refreshToken = models.EncryptedString(token.RefreshToken)
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"access_token":  models.EncryptedString(token.AccessToken),
+		"refresh_token": refreshToken,
+		"expires_at":    token.Expiry,
+		"refreshed_at":  now,
+		"revoked_at":    nil,
+	}
+	if token.TokenType != "" {
+		updates["token_type"] = token.TokenType
+	}
+
+	if err := config.DB.Model(&models.GmailToken{ID: s.gmailToken.ID}).Updates(updates).Error; err != nil {
+		fmt.Printf("Failed to save refreshed Gmail token for user %d: %v\n", s.gmailToken.UserID, err)
+		return
+	}
+
+	s.gmailToken.AccessToken = models.EncryptedString(token.AccessToken)
+	s.gmailToken.RefreshToken = refreshToken
+	s.gmailToken.ExpiresAt = token.Expiry
+	s.gmailToken.RefreshedAt = &now
+	s.gmailToken.RevokedAt = nil
+}
+
+// isInvalidGrant reports whether err is Google rejecting the refresh token,
+// because the user revoked access or the token expired
+func isInvalidGrant(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+	return retrieveErr.ErrorCode == "invalid_grant" || strings.Contains(string(retrieveErr.Body), "invalid_grant")
+}
+
+// markGmailTokenRevoked flags a stored token whose refresh token no longer works
+func markGmailTokenRevoked(gmailToken *models.GmailToken) {
+	now := time.Now()
+	if err := config.DB.Model(&models.GmailToken{}).
+		Where("id = ? AND revoked_at IS NULL", gmailToken.ID).
+		Update("revoked_at", now).Error; err != nil {
+		fmt.Printf("Failed to mark Gmail token of user %d as revoked: %v\n", gmailToken.UserID, err)
+		return
+	}
+
+	gmailToken.RevokedAt = &now
+	fmt.Printf("Gmail access of user %d was revoked\n", gmailToken.UserID)
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"email-app-backend/config"
+	"email-app-backend/handlers"
 	"email-app-backend/routes"
 
 	"github.com/joho/godotenv"
@@ -24,6 +25,12 @@ func main() {
 	// Connect to database
 	config.ConnectDatabase()
 
+	// Start sending queued bulk jobs
+	handlers.StartBulkWorker()
+
+	// Start dispatching scheduled emails
+	handlers.StartScheduler()
+
 	// Setup routes
 	r := routes.SetupRoutes()
 
@@ -3,42 +3,83 @@ package middleware
 import (
 	"net/http"
 	"strings"
+	"time"
 
+	"email-app-backend/config"
+	"email-app-backend/models"
 	"email-app-backend/utils"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
 )
 
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
+		authenticate(c, c.GetHeader("Authorization"))
+	}
+}
+
+// EventStreamAuthMiddleware authenticates the event stream of a bulk job.
+// EventSource cannot set headers, so besides the Authorization header it
+// accepts a ?token= issued by POST /api/gmail/jobs/:id/events/token: it is
+// only valid for that job, for a minute, and once. A login JWT is never
+// accepted in the query string, where access logs and proxies would keep it.
+func EventStreamAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if c.GetHeader("Authorization") != "" || token == "" {
+			authenticate(c, c.GetHeader("Authorization"))
 			return
 		}
 
-		// Check if the header starts with "Bearer "
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header format"})
+		var streamToken models.EventStreamToken
+		result := config.DB.Clauses(clause.Returning{}).
+			Where("token_hash = ? AND job_id = ? AND expires_at > ?", utils.HashStreamToken(token), c.Param("id"), time.Now()).
+			Delete(&streamToken)
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check stream token"})
 			c.Abort()
 			return
 		}
-
-		// Extract the token
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-
-		claims, err := utils.ValidateJWT(token)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired stream token"})
 			c.Abort()
 			return
 		}
 
-		// Set user information in context
-		c.Set("user_id", claims.UserID)
-		c.Set("user_email", claims.Email)
-
+		c.Set("user_id", streamToken.UserID)
 		c.Next()
 	}
 }
+
+// authenticate checks the bearer JWT in authHeader and puts its user in the context
+func authenticate(c *gin.Context, authHeader string) {
+	if authHeader == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+		c.Abort()
+		return
+	}
+
+	// Check if the header starts with "Bearer "
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header format"})
+		c.Abort()
+		return
+	}
+
+	// Extract the token
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+
+	claims, err := utils.ValidateJWT(token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return
+	}
+
+	// Set user information in context
+	c.Set("user_id", claims.UserID)
+	c.Set("user_email", claims.Email)
+
+	c.Next()
+}
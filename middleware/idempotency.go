@@ -0,0 +1,245 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header naming a retryable request
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IdempotentReplayedHeader is set on responses replayed for a repeated key
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// idempotencyKeyTTL is how long a key and its response are kept
+	idempotencyKeyTTL = 24 * time.Hour
+
+	// idempotencyLockTimeout is how long a repeat waits on a first request that
+	// has not finished before assuming it was interrupted and running again
+	idempotencyLockTimeout = 10 * time.Minute
+
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	idempotencyPruneMu    sync.Mutex
+	idempotencyPrunedAt   time.Time
+	errIdempotencyClaimed = errors.New("idempotency key is in use")
+)
+
+// idempotencyRecorder keeps a copy of the response body so it can be replayed
+type idempotencyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *idempotencyRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *idempotencyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// IdempotencyMiddleware makes requests carrying an Idempotency-Key header safe
+// to retry. The first request with a key runs and its response is stored for
+// idempotencyKeyTTL; repeats get the stored response with Idempotent-Replayed
+// set. A key reused with a different request is rejected with 422, and one
+// whose first request is still running with 409. Server errors and 429s are
+// not stored, so the request can be retried with the same key. It must run
+// after AuthMiddleware, since keys belong to a user.
+func IdempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimSpace(c.GetHeader(IdempotencyKeyHeader))
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			c.Abort()
+			return
+		}
+
+		userID, exists := c.Get("user_id")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		pruneIdempotencyKeys()
+
+		hash := requestHash(c.Request, body)
+		record, err := claimIdempotencyKey(userID.(uint), key, hash)
+		if errors.Is(err, errIdempotencyClaimed) {
+			replayIdempotentResponse(c, record, hash)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Idempotency-Key"})
+			c.Abort()
+			return
+		}
+
+		recorder := &idempotencyRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+
+		completed := false
+		defer func() {
+			// Release the key if the handler failed or panicked, so the request can be retried
+			if !completed {
+				config.DB.Delete(&models.IdempotencyKey{}, record.ID)
+			}
+		}()
+
+		c.Next()
+
+		status := c.Writer.Status()
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			return
+		}
+
+		now := time.Now()
+		err = config.DB.Model(&models.IdempotencyKey{}).Where("id = ?", record.ID).Updates(map[string]interface{}{
+			"status_code":   status,
+			"content_type":  c.Writer.Header().Get("Content-Type"),
+			"response_body": recorder.body.String(),
+			"completed_at":  now,
+		}).Error
+		if err != nil {
+			fmt.Printf("Failed to store the response of Idempotency-Key %q: %v\n", key, err)
+			return
+		}
+		completed = true
+	}
+}
+
+// claimIdempotencyKey records the first request with a key. If the key was
+// already claimed, it returns the existing record and errIdempotencyClaimed.
+// Keys past idempotencyKeyTTL, or whose first request was interrupted, are
+// claimed again.
+func claimIdempotencyKey(userID uint, key, hash string) (*models.IdempotencyKey, error) {
+	record := &models.IdempotencyKey{UserID: userID, Key: key, RequestHash: hash}
+	result := config.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return record, nil
+	}
+
+	var existing models.IdempotencyKey
+	err := config.DB.Where("user_id = ? AND idempotency_key = ?", userID, key).First(&existing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Released between the insert and the lookup
+		return claimIdempotencyKey(userID, key, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expired := time.Since(existing.CreatedAt) > idempotencyKeyTTL
+	abandoned := existing.CompletedAt == nil && time.Since(existing.CreatedAt) > idempotencyLockTimeout
+	if !expired && !abandoned {
+		return &existing, errIdempotencyClaimed
+	}
+
+	// Take the key over only if nobody else did in the meantime
+	result = config.DB.Model(&models.IdempotencyKey{}).
+		Where("id = ? AND created_at = ?", existing.ID, existing.CreatedAt).
+		Updates(map[string]interface{}{
+			"request_hash":  hash,
+			"status_code":   0,
+			"content_type":  "",
+			"response_body": "",
+			"created_at":    time.Now(),
+			"completed_at":  nil,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return claimIdempotencyKey(userID, key, hash)
+	}
+	existing.RequestHash = hash
+	return &existing, nil
+}
+
+// replayIdempotentResponse answers a repeated key from its record, if the
+// request matches the one the key was first used with
+func replayIdempotentResponse(c *gin.Context, record *models.IdempotencyKey, hash string) {
+	defer c.Abort()
+
+	if hash != record.RequestHash {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request"})
+		return
+	}
+
+	if record.CompletedAt == nil {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still being processed"})
+		return
+	}
+
+	c.Header(IdempotentReplayedHeader, "true")
+	c.Data(record.StatusCode, record.ContentType, []byte(record.ResponseBody))
+}
+
+// requestHash fingerprints a request by its method, path and body. JSON
+// bodies are compacted first, so a retry that only reformats them matches.
+func requestHash(r *http.Request, body []byte) string {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, body); err == nil {
+		body = compacted.Bytes()
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// pruneIdempotencyKeys deletes expired keys, at most once an hour
+func pruneIdempotencyKeys() {
+	idempotencyPruneMu.Lock()
+	defer idempotencyPruneMu.Unlock()
+
+	if time.Since(idempotencyPrunedAt) < time.Hour {
+		return
+	}
+	idempotencyPrunedAt = time.Now()
+
+	go func() {
+		if err := config.DB.Where("created_at < ?", time.Now().Add(-idempotencyKeyTTL)).Delete(&models.IdempotencyKey{}).Error; err != nil {
+			fmt.Printf("Failed to delete expired idempotency keys: %v\n", err)
+		}
+	}()
+}
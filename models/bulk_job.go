@@ -0,0 +1,93 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Bulk job statuses
+const (
+	BulkJobQueued    = "queued"
+	BulkJobRunning   = "running"
+	BulkJobPaused    = "paused"
+	BulkJobCompleted = "completed"
+	BulkJobCancelled = "cancelled"
+)
+
+// Reasons a bulk job is paused
+const (
+	PauseReasonManual       = "manual"        // Paused by the user
+	PauseReasonDailyLimit   = "daily_limit"   // Paused until the daily sending limit resets
+	PauseReasonGmailRevoked = "gmail_revoked" // Paused until the user reconnects Gmail and resumes
+)
+
+// Strategies for rotating a bulk job between several Gmail accounts
+const (
+	RotationRoundRobin     = "round_robin"     // Each account in turn
+	RotationWeighted       = "weighted"        // In proportion to each account's weight
+	RotationQuotaRemaining = "quota_remaining" // The account with the most daily quota left
+)
+
+// Bulk job recipient statuses
+const (
+	RecipientPending   = "pending"
+	RecipientSent      = "sent"
+	RecipientFailed    = "failed"
+	RecipientCancelled = "cancelled"
+)
+
+// BulkJob is a persisted bulk send (campaign) drained by the background worker.
+// Its ID doubles as the BatchID of the EmailHistory rows it produces.
+type BulkJob struct {
+	ID              string         `json:"id" gorm:"primaryKey;type:varchar(36)"`
+	UserID          uint           `json:"user_id" gorm:"not null;index"`
+	GmailTokenID    uint           `json:"gmail_token_id"`     // Gmail account sending the job, 0 for the user's default
+	Senders         string         `json:"-" gorm:"type:text"` // JSON encoded accounts the job rotates between, instead of GmailTokenID
+	Rotation        string         `json:"rotation,omitempty"` // Strategy for rotating between Senders
+	Status          string         `json:"status" gorm:"not null;index"`
+	PauseReason     string         `json:"pause_reason,omitempty"`
+	ResumeAt        *time.Time     `json:"resume_at,omitempty"` // When a job paused by the daily limit is queued again
+	Subject         string         `json:"subject" gorm:"not null"`
+	Body            string         `json:"body" gorm:"type:text"`
+	BodyFormat      string         `json:"body_format,omitempty"` // How Body is written: text, markdown or html
+	HTMLBody        string         `json:"html_body" gorm:"type:text"`
+	TemplateID      *uint          `json:"template_id,omitempty"`      // Saved template the subject and bodies come from
+	TemplateVersion int            `json:"template_version,omitempty"` // Version of the template
+	From            string         `json:"from,omitempty"`             // Send-as address, empty for the account's own
+	ReplyTo         string         `json:"reply_to"`
+	RetryOfJobID    string         `json:"retry_of_job_id,omitempty" gorm:"type:varchar(36);index"`
+	Attachments     string         `json:"-" gorm:"type:text"` // JSON encoded attachments
+	TotalCount      int            `json:"total_count"`
+	SentCount       int            `json:"sent_count"`
+	FailedCount     int            `json:"failed_count"`
+	CancelledCount  int            `json:"cancelled_count"`
+	WorkerID        string         `json:"-" gorm:"type:varchar(64);not null;default:''"` // Process running the job
+	LeaseExpiresAt  *time.Time     `json:"-" gorm:"index"`                                // Until when WorkerID holds the job, renewed while it runs
+	StartedAt       *time.Time     `json:"started_at"`
+	CompletedAt     *time.Time     `json:"completed_at"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `json:"-" gorm:"index"`
+
+	// Relationships
+	User       User               `json:"-" gorm:"foreignKey:UserID"`
+	Recipients []BulkJobRecipient `json:"recipients,omitempty" gorm:"foreignKey:JobID"`
+}
+
+// BulkJobRecipient is one recipient of a bulk job and the outcome of sending to them
+type BulkJobRecipient struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	JobID        string     `json:"job_id" gorm:"type:varchar(36);not null;index"`
+	Position     int        `json:"position" gorm:"not null"`
+	Email        string     `json:"email" gorm:"not null"`
+	Name         string     `json:"name"`
+	Fields       string     `json:"-" gorm:"type:text"` // JSON encoded merge fields
+	Status       string     `json:"status" gorm:"not null;index"`
+	ErrorMessage string     `json:"error_message"`
+	RetryOfID    *uint      `json:"retry_of_id"`              // EmailHistory row of the failed attempt being retried
+	GmailTokenID uint       `json:"gmail_token_id,omitempty"` // Gmail account the email was sent from
+	ProcessedAt  *time.Time `json:"processed_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
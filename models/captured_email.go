@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// CapturedEmail is a message the sandbox kept instead of sending it
+type CapturedEmail struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	UserID       uint      `json:"user_id" gorm:"not null;index"`
+	GmailTokenID uint      `json:"account_id"` // Gmail account it would have been sent from, 0 for other transports
+	MessageID    string    `json:"message_id"`
+	FromEmail    string    `json:"from"`       // Envelope sender
+	Recipients   string    `json:"recipients"` // Comma separated envelope recipients, Bcc included
+	Subject      string    `json:"subject"`
+	Size         int       `json:"size"` // Size of Raw in bytes
+	Raw          string    `json:"-" gorm:"type:text;not null"`
+	CreatedAt    time.Time `json:"created_at" gorm:"index"`
+}
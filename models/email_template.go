@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"email-app-backend/utils"
+
+	"gorm.io/gorm"
+)
+
+// EmailTemplate is a saved subject and body that emails can be sent from by
+// ID, or a subject and a layout of blocks the body is rendered from. Every
+// edit is kept as an EmailTemplateVersion, and Version is the number of the
+// current one.
+type EmailTemplate struct {
+	ID          uint               `json:"id" gorm:"primaryKey"`
+	UserID      uint               `json:"user_id" gorm:"not null;index"`
+	Name        string             `json:"name" gorm:"not null"`
+	Description string             `json:"description"`
+	Subject     string             `json:"subject" gorm:"not null"`
+	Body        string             `json:"body" gorm:"type:text"`
+	BodyFormat  string             `json:"body_format"` // How Body is written: text, markdown or html
+	HTMLBody    string             `json:"html_body" gorm:"type:text"`
+	Layout      *utils.EmailLayout `json:"layout,omitempty" gorm:"serializer:json;type:text"` // Blocks the HTML body is rendered from, instead of Body
+	Version     int                `json:"version" gorm:"not null"`
+	CreatedAt   time.Time          `json:"created_at"`
+	UpdatedAt   time.Time          `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt     `json:"-" gorm:"index"`
+
+	// Relationships
+	User     User                   `json:"-" gorm:"foreignKey:UserID"`
+	Versions []EmailTemplateVersion `json:"-" gorm:"foreignKey:TemplateID"`
+}
+
+// EmailTemplateVersion is the content of a template as of one edit
+type EmailTemplateVersion struct {
+	ID          uint               `json:"id" gorm:"primaryKey"`
+	TemplateID  uint               `json:"template_id" gorm:"not null;uniqueIndex:idx_email_template_versions_version"`
+	Version     int                `json:"version" gorm:"not null;uniqueIndex:idx_email_template_versions_version"`
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Subject     string             `json:"subject"`
+	Body        string             `json:"body" gorm:"type:text"`
+	BodyFormat  string             `json:"body_format"`
+	HTMLBody    string             `json:"html_body" gorm:"type:text"`
+	Layout      *utils.EmailLayout `json:"layout,omitempty" gorm:"serializer:json;type:text"`
+	CreatedAt   time.Time          `json:"created_at"`
+}
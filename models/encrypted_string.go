@@ -0,0 +1,40 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+
+	"email-app-backend/utils"
+)
+
+// EncryptedString is a string column stored encrypted with utils.EncryptToken.
+// It is decrypted transparently when read; legacy plaintext values read as is.
+type EncryptedString string
+
+// Value encrypts the string with the current token key
+func (s EncryptedString) Value() (driver.Value, error) {
+	return utils.EncryptToken(string(s))
+}
+
+// Scan decrypts a stored value with the key version it was encrypted with
+func (s *EncryptedString) Scan(value interface{}) error {
+	var stored string
+	switch v := value.(type) {
+	case nil:
+		*s = ""
+		return nil
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into EncryptedString", value)
+	}
+
+	plaintext, err := utils.DecryptToken(stored)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plaintext)
+	return nil
+}
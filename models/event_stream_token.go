@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// EventStreamToken lets a browser open the event stream of one bulk job, since
+// EventSource cannot send an Authorization header. Only a hash of the token is
+// stored, and it is deleted when used.
+type EventStreamToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	TokenHash string    `gorm:"size:64;not null;uniqueIndex"` // SHA-256 of the token
+	UserID    uint      `gorm:"not null"`
+	JobID     string    `gorm:"type:varchar(36);not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	CreatedAt time.Time
+}
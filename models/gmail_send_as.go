@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// GmailSendAs is a cached send-as address of a connected Gmail account: its
+// primary address or an alias the user configured in Gmail's settings
+type GmailSendAs struct {
+	ID                 uint      `json:"-" gorm:"primaryKey"`
+	GmailTokenID       uint      `json:"-" gorm:"not null;index"`
+	Email              string    `json:"email" gorm:"not null"`
+	DisplayName        string    `json:"display_name"`
+	ReplyTo            string    `json:"reply_to"`
+	IsPrimary          bool      `json:"is_primary"`
+	IsDefault          bool      `json:"is_default"`          // Gmail's default From address for the account
+	VerificationStatus string    `json:"verification_status"` // "accepted" once an alias is verified, empty for the primary address
+	FetchedAt          time.Time `json:"fetched_at"`
+	CreatedAt          time.Time `json:"-"`
+}
+
+// CanSend reports whether Gmail lets the account send as this address
+func (s *GmailSendAs) CanSend() bool {
+	return s.IsPrimary || s.VerificationStatus == "accepted"
+}
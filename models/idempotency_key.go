@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// IdempotencyKey remembers a request sent with an Idempotency-Key header and
+// its response, so a retry of the request gets the response again instead of
+// sending the emails twice
+type IdempotencyKey struct {
+	ID           uint   `gorm:"primaryKey"`
+	UserID       uint   `gorm:"not null;uniqueIndex:idx_idempotency_keys_user_key"`
+	Key          string `gorm:"column:idempotency_key;size:255;not null;uniqueIndex:idx_idempotency_keys_user_key"`
+	RequestHash  string `gorm:"not null"` // SHA-256 of the method, path and body
+	StatusCode   int    // 0 while the first request is still being handled
+	ContentType  string
+	ResponseBody string    `gorm:"type:text"`
+	CreatedAt    time.Time `gorm:"index"`
+	CompletedAt  *time.Time
+}
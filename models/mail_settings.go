@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"email-app-backend/utils"
+
+	"gorm.io/gorm"
+)
+
+// MailSettings selects the transport a user's emails are sent with when no
+// Gmail account is picked, overriding the MAIL_TRANSPORT default
+type MailSettings struct {
+	ID           uint            `json:"-" gorm:"primaryKey"`
+	UserID       uint            `json:"user_id" gorm:"not null;uniqueIndex"`
+	Transport    string          `json:"transport" gorm:"not null"` // "gmail", "smtp", "file" or "sandbox"
+	SMTPHost     string          `json:"smtp_host"`
+	SMTPPort     int             `json:"smtp_port"`
+	SMTPUsername string          `json:"smtp_username"`
+	SMTPPassword EncryptedString `json:"-" gorm:"type:text"`
+	SMTPSecurity string          `json:"smtp_security"`                     // "starttls", "tls" or "none"
+	FromEmail    string          `json:"from_email"`                        // From address of emails sent over SMTP
+	FromName     string          `json:"from_name"`                         // Display name for FromEmail
+	KeyVersion   int             `json:"-" gorm:"not null;default:0;index"` // Key version the password is encrypted with, 0 for plaintext
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+}
+
+// BeforeSave records the key version the password is encrypted with. Settings
+// are always saved whole, so the password is rewritten with the current key.
+func (s *MailSettings) BeforeSave(tx *gorm.DB) error {
+	version, err := utils.TokenKeyVersion()
+	if err != nil {
+		return err
+	}
+	s.KeyVersion = version
+	return nil
+}
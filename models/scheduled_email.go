@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of scheduled email
+const (
+	ScheduledSingle = "single"
+	ScheduledBulk   = "bulk"
+)
+
+// Scheduled email statuses
+const (
+	ScheduledPending    = "scheduled"
+	ScheduledProcessing = "processing"
+	ScheduledSent       = "sent" // The email was sent, or the bulk job was queued
+	ScheduledFailed     = "failed"
+	ScheduledCancelled  = "cancelled"
+)
+
+// ScheduledEmail is a single or bulk send request held back until SendAt
+type ScheduledEmail struct {
+	ID             uint           `json:"id" gorm:"primaryKey"`
+	UserID         uint           `json:"user_id" gorm:"not null;index"`
+	Kind           string         `json:"kind" gorm:"not null"`
+	Status         string         `json:"status" gorm:"not null;index"`
+	SendAt         time.Time      `json:"send_at" gorm:"not null;index"`
+	TimeZone       string         `json:"time_zone"`
+	Subject        string         `json:"subject"`
+	RecipientCount int            `json:"recipient_count"`
+	Payload        string         `json:"-" gorm:"type:text;not null"`              // JSON encoded send request
+	JobID          string         `json:"job_id,omitempty" gorm:"type:varchar(36)"` // Bulk job created on dispatch
+	GmailMessageID string         `json:"gmail_message_id,omitempty"`
+	ErrorMessage   string         `json:"error_message,omitempty"`
+	WorkerID       string         `json:"-" gorm:"type:varchar(64);not null;default:''"` // Process dispatching the email
+	LeaseExpiresAt *time.Time     `json:"-" gorm:"index"`                                // Until when WorkerID holds the email, renewed while it is dispatched
+	DispatchedAt   *time.Time     `json:"dispatched_at"`                                 // When sending started, or the bulk job was queued
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	DeletedAt      gorm.DeletedAt `json:"-" gorm:"index"`
+
+	// Relationships
+	User User `json:"-" gorm:"foreignKey:UserID"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// SendQuotaReservation is the share of a Gmail account's daily sending limit
+// taken by one message. It is reserved just before the message is sent, kept
+// once it was sent as the record the rolling 24 hour limit is counted from,
+// and deleted if sending failed.
+type SendQuotaReservation struct {
+	ID           uint      `gorm:"primaryKey"`
+	GmailTokenID uint      `gorm:"not null;index:idx_send_quota_reservations_account"`
+	Recipients   int       `gorm:"not null"`
+	ReservedAt   time.Time `gorm:"not null;index:idx_send_quota_reservations_account"`
+}
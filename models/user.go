@@ -3,6 +3,8 @@ package models
 import (
 	"time"
 
+	"email-app-backend/utils"
+
 	"gorm.io/gorm"
 )
 
@@ -21,36 +23,74 @@ type User struct {
 }
 
 type GmailToken struct {
-	ID           uint           `json:"id" gorm:"primaryKey"`
-	UserID       uint           `json:"user_id" gorm:"not null"`
-	AccessToken  string         `json:"-" gorm:"not null"`
-	RefreshToken string         `json:"-" gorm:"not null"`
-	TokenType    string         `json:"token_type" gorm:"default:'Bearer'"`
-	ExpiresAt    time.Time      `json:"expires_at"`
-	Scope        string         `json:"scope"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
-	DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
+	ID           uint            `json:"id" gorm:"primaryKey"`
+	UserID       uint            `json:"user_id" gorm:"not null;uniqueIndex:idx_gmail_tokens_user_email"`
+	Email        string          `json:"email" gorm:"uniqueIndex:idx_gmail_tokens_user_email"` // Address of the connected Gmail account
+	AccessToken  EncryptedString `json:"-" gorm:"type:text;not null"`
+	RefreshToken EncryptedString `json:"-" gorm:"type:text;not null"`
+	KeyVersion   int             `json:"-" gorm:"not null;default:0;index"` // Key version the tokens are encrypted with, 0 for plaintext
+	TokenType    string          `json:"token_type" gorm:"default:'Bearer'"`
+	ExpiresAt    time.Time       `json:"expires_at"`
+	Scope        string          `json:"scope"`
+	RefreshedAt  *time.Time      `json:"refreshed_at"` // Last time the access token was refreshed
+	RevokedAt    *time.Time      `json:"revoked_at"`   // Set when Google rejects the refresh token
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+	DeletedAt    gorm.DeletedAt  `json:"-" gorm:"index"`
 
 	// Relationship
 	User User `json:"user,omitempty" gorm:"foreignKey:UserID"`
 }
 
+// BeforeCreate records the key version a new token is encrypted with
+func (t *GmailToken) BeforeCreate(tx *gorm.DB) error {
+	version, err := utils.TokenKeyVersion()
+	if err != nil {
+		return err
+	}
+	t.KeyVersion = version
+	return nil
+}
+
+// BeforeUpdate records the key version whenever the token columns are rewritten.
+// Updates must write both columns so they share one key version.
+func (t *GmailToken) BeforeUpdate(tx *gorm.DB) error {
+	if !tx.Statement.Changed("AccessToken", "RefreshToken") {
+		return nil
+	}
+
+	version, err := utils.TokenKeyVersion()
+	if err != nil {
+		return err
+	}
+	tx.Statement.SetColumn("KeyVersion", version)
+	return nil
+}
+
 type EmailHistory struct {
-	ID             uint           `json:"id" gorm:"primaryKey"`
-	UserID         uint           `json:"user_id" gorm:"not null"`
-	EmailType      string         `json:"email_type" gorm:"not null"` // "single" or "bulk"
-	RecipientEmail string         `json:"recipient_email" gorm:"not null"`
-	RecipientName  string         `json:"recipient_name"`
-	Subject        string         `json:"subject" gorm:"not null"`
-	Body           string         `json:"body" gorm:"type:text"`
-	Status         string         `json:"status" gorm:"not null"` // "sent" or "failed"
-	ErrorMessage   string         `json:"error_message"`
-	BatchID        string         `json:"batch_id"` // For grouping bulk emails
-	SentAt         time.Time      `json:"sent_at"`
-	CreatedAt      time.Time      `json:"created_at"`
-	UpdatedAt      time.Time      `json:"updated_at"`
-	DeletedAt      gorm.DeletedAt `json:"-" gorm:"index"`
+	ID              uint           `json:"id" gorm:"primaryKey"`
+	UserID          uint           `json:"user_id" gorm:"not null"`
+	EmailType       string         `json:"email_type" gorm:"not null"` // "single" or "bulk"
+	RecipientEmail  string         `json:"recipient_email" gorm:"not null"`
+	RecipientName   string         `json:"recipient_name"`
+	RecipientType   string         `json:"recipient_type" gorm:"default:'to'"` // "to", "cc" or "bcc"
+	Subject         string         `json:"subject" gorm:"not null"`
+	Body            string         `json:"body" gorm:"type:text"`
+	Status          string         `json:"status" gorm:"not null"` // "sent", "failed" or "cancelled"
+	ErrorMessage    string         `json:"error_message"`
+	Retryable       bool           `json:"retryable"` // Failed with a transient error that may succeed on retry
+	BatchID         string         `json:"batch_id"`  // For grouping bulk emails
+	GmailMessageID  string         `json:"gmail_message_id"`
+	GmailTokenID    uint           `json:"gmail_token_id" gorm:"index"` // Gmail account the email was sent from, 0 for other transports
+	SenderEmail     string         `json:"sender_email"`                // Address the email was sent from, kept after the account is disconnected
+	Transport       string         `json:"transport"`                   // "gmail", "smtp", "file" or "sandbox"
+	RetryOfID       *uint          `json:"retry_of_id" gorm:"index"`    // The failed row this email retried
+	TemplateID      *uint          `json:"template_id" gorm:"index"`    // Saved template the email was sent from
+	TemplateVersion int            `json:"template_version,omitempty"`  // Version of the template
+	SentAt          time.Time      `json:"sent_at"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `json:"-" gorm:"index"`
 
 	// Relationship
 	User User `json:"user,omitempty" gorm:"foreignKey:UserID"`
@@ -0,0 +1,374 @@
+package routes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"email-app-backend/config"
+	"email-app-backend/fakegoogle"
+	"email-app-backend/handlers"
+	"email-app-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// startBulkWorker starts the bulk worker once for all tests, since it runs until the process exits
+var startBulkWorker sync.Once
+
+// testDatabases numbers the in-memory databases, so each test API gets a new one
+var testDatabases atomic.Int64
+
+// testAPI is the API served against an in-memory database and a fake Google,
+// signed in as a registered user
+type testAPI struct {
+	t      *testing.T
+	server *httptest.Server
+	google *fakegoogle.Server
+	token  string // JWT of the registered user
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("GOOGLE_CLIENT_ID", "test-client")
+	t.Setenv("GOOGLE_CLIENT_SECRET", "test-secret")
+	t.Setenv("SANDBOX_MODE", "")
+	t.Setenv("MAIL_TRANSPORT", "")
+
+	// Each test has its own database, kept in memory while its connections are open
+	dsn := fmt.Sprintf("file:api-test-%d?mode=memory&cache=shared", testDatabases.Add(1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.MigrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	config.DB = db
+	startBulkWorker.Do(handlers.StartBulkWorker)
+
+	google := fakegoogle.New()
+	t.Cleanup(google.Close)
+	t.Cleanup(google.Install())
+
+	api := &testAPI{t: t, server: httptest.NewServer(SetupRoutes()), google: google}
+	t.Cleanup(api.server.Close)
+
+	var registered struct {
+		Token string `json:"token"`
+	}
+	api.mustDo(http.MethodPost, "/api/auth/register", map[string]interface{}{
+		"name": "Test User", "email": "user@example.com", "password": "password123",
+	}, http.StatusCreated, &registered)
+	api.token = registered.Token
+	return api
+}
+
+// do sends a JSON request as the registered user and decodes the JSON reply into out, if set
+func (a *testAPI) do(method, path string, body interface{}, out interface{}) int {
+	a.t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			a.t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, a.server.URL+path, &payload)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			a.t.Fatalf("%s %s: decoding the reply: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// mustDo is do, failing the test unless the reply has the status
+func (a *testAPI) mustDo(method, path string, body interface{}, status int, out interface{}) {
+	a.t.Helper()
+	var reply json.RawMessage
+	if code := a.do(method, path, body, &reply); code != status {
+		a.t.Fatalf("%s %s = %d %s, want %d", method, path, code, reply, status)
+	}
+	if out != nil {
+		if err := json.Unmarshal(reply, out); err != nil {
+			a.t.Fatal(err)
+		}
+	}
+}
+
+// connectGmail adds an account to the fake and connects it through the OAuth code exchange
+func (a *testAPI) connectGmail(email string) uint {
+	a.t.Helper()
+	a.google.AddAccount(email, "Sender")
+
+	var connected struct {
+		Account struct {
+			ID    uint   `json:"id"`
+			Email string `json:"email"`
+		} `json:"account"`
+	}
+	a.mustDo(http.MethodPost, "/api/gmail/accounts", map[string]interface{}{
+		"code": a.google.AuthCode(email), "scope": fakegoogle.Scopes,
+	}, http.StatusCreated, &connected)
+	if connected.Account.Email != email {
+		a.t.Fatalf("connected %q, want %q", connected.Account.Email, email)
+	}
+	return connected.Account.ID
+}
+
+func TestConnectGmailAndSend(t *testing.T) {
+	api := newTestAPI(t)
+	accountID := api.connectGmail("sender@gmail.com")
+
+	api.mustDo(http.MethodPost, "/api/gmail/send", map[string]interface{}{
+		"to": "friend@example.com", "subject": "Hello", "body": "Hi there", "from_account_id": accountID,
+	}, http.StatusOK, nil)
+
+	sent := api.google.SentTo("friend@example.com")
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages to friend@example.com, want 1", len(sent))
+	}
+	raw := string(sent[0].Raw)
+	if sent[0].Account != "sender@gmail.com" || !strings.Contains(raw, "Subject: Hello") || !strings.Contains(raw, "Hi there") {
+		t.Errorf("sent from %s:\n%s", sent[0].Account, raw)
+	}
+
+	var history models.EmailHistory
+	if err := config.DB.Where("recipient_email = ?", "friend@example.com").First(&history).Error; err != nil {
+		t.Fatal(err)
+	}
+	if history.Status != "sent" || history.GmailMessageID == "" || history.SenderEmail != "sender@gmail.com" {
+		t.Errorf("history = %+v, want sent from sender@gmail.com with the Gmail message ID", history)
+	}
+}
+
+func TestBulkJobCompletes(t *testing.T) {
+	api := newTestAPI(t)
+	accountID := api.connectGmail("sender@gmail.com")
+
+	var queued struct {
+		JobID string `json:"job_id"`
+	}
+	api.mustDo(http.MethodPost, "/api/gmail/send-bulk", map[string]interface{}{
+		"subject":         "Hello {{name}}",
+		"body":            "Your plan is {{plan}}",
+		"from_account_id": accountID,
+		"emails": []map[string]interface{}{
+			{"email": "a@example.com", "name": "Ann", "fields": map[string]interface{}{"plan": "pro"}},
+			{"email": "b@example.com", "name": "Bob", "fields": map[string]interface{}{"plan": "free"}},
+			{"email": "c@example.com", "name": "Cy", "fields": map[string]interface{}{"plan": "team"}},
+		},
+	}, http.StatusAccepted, &queued)
+
+	var job handlers.BulkJobResponse
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		api.mustDo(http.MethodGet, "/api/gmail/jobs/"+queued.JobID, nil, http.StatusOK, &job)
+		if job.Status == models.BulkJobCompleted || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if job.Status != models.BulkJobCompleted || job.SentCount != 3 || job.FailedCount != 0 {
+		t.Fatalf("job is %s with %d sent and %d failed, want completed with 3 sent", job.Status, job.SentCount, job.FailedCount)
+	}
+	for email, want := range map[string]string{"a@example.com": "Hello Ann", "b@example.com": "Hello Bob", "c@example.com": "Hello Cy"} {
+		sent := api.google.SentTo(email)
+		if len(sent) != 1 || !strings.Contains(string(sent[0].Raw), "Subject: "+want) {
+			t.Errorf("sent %d messages to %s, want one with subject %q", len(sent), email, want)
+		}
+	}
+}
+
+func TestBulkJobEventStream(t *testing.T) {
+	api := newTestAPI(t)
+	accountID := api.connectGmail("sender@gmail.com")
+
+	// Gmail's daily limit pauses the job with a recipient left, so its result is streamed
+	api.google.Fail(fakegoogle.Send, fakegoogle.DailyLimit, 1)
+	var queued struct {
+		JobID string `json:"job_id"`
+	}
+	api.mustDo(http.MethodPost, "/api/gmail/send-bulk", map[string]interface{}{
+		"subject":         "Hello",
+		"body":            "Hi",
+		"from_account_id": accountID,
+		"emails":          []map[string]interface{}{{"email": "a@example.com"}, {"email": "b@example.com"}},
+	}, http.StatusAccepted, &queued)
+
+	var job handlers.BulkJobResponse
+	deadline := time.Now().Add(30 * time.Second)
+	for job.Status != models.BulkJobPaused && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		api.mustDo(http.MethodGet, "/api/gmail/jobs/"+queued.JobID, nil, http.StatusOK, &job)
+	}
+	if job.Status != models.BulkJobPaused || job.SentCount == 2 {
+		t.Fatalf("job is %s with %d sent, want paused by the daily limit", job.Status, job.SentCount)
+	}
+
+	var streamToken struct {
+		Token string `json:"token"`
+	}
+	api.mustDo(http.MethodPost, "/api/gmail/jobs/"+queued.JobID+"/events/token", nil, http.StatusCreated, &streamToken)
+	resp, err := http.Get(api.server.URL + "/api/gmail/jobs/" + queued.JobID + "/events?token=" + streamToken.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("opening the event stream = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	api.mustDo(http.MethodPost, "/api/gmail/jobs/"+queued.JobID+"/resume", nil, http.StatusOK, nil)
+
+	// The stream ends by itself once the job is completed
+	timer := time.AfterFunc(30*time.Second, func() { resp.Body.Close() })
+	defer timer.Stop()
+	var events []string
+	var first, last handlers.BulkProgressEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event:"); ok {
+			events = append(events, name)
+		} else if data, ok := strings.CutPrefix(line, "data:"); ok {
+			if err := json.Unmarshal([]byte(data), &last); err != nil {
+				t.Fatalf("decoding event %q: %v", data, err)
+			}
+			if len(events) == 1 {
+				first = last
+			}
+		}
+	}
+
+	// One result for each recipient left in the snapshot, then the final status
+	want := []string{"snapshot"}
+	for i := 0; i < first.Remaining; i++ {
+		want = append(want, "result")
+	}
+	want = append(want, "status")
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Errorf("streamed events %v, want %v", events, want)
+	}
+	if last.Status != models.BulkJobCompleted || last.SuccessCount != 2 || last.Remaining != 0 {
+		t.Errorf("last event = %+v, want the job completed with 2 sent", last)
+	}
+}
+
+func TestSendRetriesRateLimit(t *testing.T) {
+	api := newTestAPI(t)
+	accountID := api.connectGmail("sender@gmail.com")
+	api.google.Fail(fakegoogle.Send, fakegoogle.RateLimit, 2)
+
+	api.mustDo(http.MethodPost, "/api/gmail/send", map[string]interface{}{
+		"to": "friend@example.com", "subject": "Hello", "body": "Hi", "from_account_id": accountID,
+	}, http.StatusOK, nil)
+
+	if calls := api.google.Calls(fakegoogle.Send); calls != 3 {
+		t.Errorf("messages.send was called %d times, want 2 rate limited calls and 1 that succeeds", calls)
+	}
+	if sent := api.google.SentTo("friend@example.com"); len(sent) != 1 {
+		t.Errorf("sent %d messages, want 1", len(sent))
+	}
+}
+
+func TestRevokedGrant(t *testing.T) {
+	api := newTestAPI(t)
+	accountID := api.connectGmail("sender@gmail.com")
+
+	// The user removes the app's access; the next send has to refresh the expired token
+	api.google.Revoke("sender@gmail.com")
+	if err := config.DB.Model(&models.GmailToken{}).Where("id = ?", accountID).
+		Update("expires_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var failed struct {
+		Revoked bool `json:"revoked"`
+	}
+	api.mustDo(http.MethodPost, "/api/gmail/send", map[string]interface{}{
+		"to": "friend@example.com", "subject": "Hello", "body": "Hi", "from_account_id": accountID,
+	}, http.StatusForbidden, &failed)
+	if !failed.Revoked {
+		t.Error("send reply does not say the access was revoked")
+	}
+	if len(api.google.Sent()) != 0 {
+		t.Error("a message was sent with a revoked grant")
+	}
+
+	var status struct {
+		Revoked bool `json:"revoked"`
+	}
+	api.mustDo(http.MethodGet, fmt.Sprintf("/api/gmail/status?account_id=%d", accountID), nil, http.StatusOK, &status)
+	if !status.Revoked {
+		t.Error("status does not report the account as revoked")
+	}
+
+	// Later sends fail without calling Google again
+	refreshes := api.google.Calls(fakegoogle.Token)
+	api.mustDo(http.MethodPost, "/api/gmail/send", map[string]interface{}{
+		"to": "friend@example.com", "subject": "Hello", "body": "Hi", "from_account_id": accountID,
+	}, http.StatusForbidden, nil)
+	if calls := api.google.Calls(fakegoogle.Token); calls != refreshes {
+		t.Errorf("the token endpoint was called %d more times for a revoked account", calls-refreshes)
+	}
+}
+
+func TestSearchEmailTemplates(t *testing.T) {
+	api := newTestAPI(t)
+	for _, name := range []string{"50% off", "500 off", "a_b", "axb", `back\slash`} {
+		api.mustDo(http.MethodPost, "/api/templates", map[string]interface{}{
+			"name": name, "subject": "Hello", "body": "Hi",
+		}, http.StatusCreated, nil)
+	}
+
+	// Wildcards in the search text match themselves
+	tests := map[string][]string{
+		"%":    {"50% off"},
+		"_":    {"a_b"},
+		`\`:    {`back\slash`},
+		" off": {"50% off", "500 off"},
+	}
+	for search, want := range tests {
+		var list handlers.EmailTemplateListResponse
+		api.mustDo(http.MethodGet, "/api/templates?search="+url.QueryEscape(search), nil, http.StatusOK, &list)
+
+		var got []string
+		for _, template := range list.Templates {
+			got = append(got, template.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") || list.TotalCount != int64(len(want)) {
+			t.Errorf("search %q found %q (%d in total), want %q", search, got, list.TotalCount, want)
+		}
+	}
+}
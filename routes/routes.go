@@ -26,7 +26,8 @@ func SetupRoutes() *gin.Engine {
 
 	config.AllowOrigins = allowedOrigins
 	config.AllowCredentials = true
-	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
+	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization", middleware.IdempotencyKeyHeader}
+	config.ExposeHeaders = []string{middleware.IdempotentReplayedHeader}
 	r.Use(cors.New(config))
 
 	r.GET("/health", func(c *gin.Context) {
@@ -41,6 +42,9 @@ func SetupRoutes() *gin.Engine {
 		auth.POST("/google/callback", handlers.HandleGoogleCallback)
 	}
 
+	// Outside the api group, since EventSource authenticates with a stream token
+	r.GET("/api/gmail/jobs/:id/events", middleware.EventStreamAuthMiddleware(), handlers.StreamBulkJobEvents)
+
 	api := r.Group("/api")
 	api.Use(middleware.AuthMiddleware())
 	{
@@ -51,12 +55,56 @@ func SetupRoutes() *gin.Engine {
 			gmail.GET("/auth-url", handlers.GetGmailAuthURL)
 			gmail.GET("/status", handlers.GetGmailStatus)
 			gmail.DELETE("/disconnect", handlers.DisconnectGmail)
-			gmail.POST("/send", handlers.SendEmail)
+			gmail.GET("/accounts", handlers.ListGmailAccounts)
+			gmail.POST("/accounts", handlers.ConnectGmailAccount)
+			gmail.DELETE("/accounts/:id", handlers.DisconnectGmailAccount)
+			gmail.GET("/accounts/:id/aliases", handlers.ListSendAsAliases)
+			gmail.POST("/send", middleware.IdempotencyMiddleware(), handlers.SendEmail)
 			gmail.POST("/process-csv", handlers.ProcessCSV)
-			gmail.POST("/send-bulk", handlers.SendBulkEmails)
+			gmail.POST("/send-bulk", middleware.IdempotencyMiddleware(), handlers.SendBulkEmails)
+			gmail.POST("/preview", handlers.PreviewEmail)
+			gmail.GET("/jobs", handlers.ListBulkJobs)
+			gmail.GET("/jobs/:id", handlers.GetBulkJob)
+			gmail.POST("/jobs/:id/events/token", handlers.CreateEventStreamToken)
+			gmail.POST("/jobs/:id/pause", handlers.PauseBulkJob)
+			gmail.POST("/jobs/:id/resume", handlers.ResumeBulkJob)
+			gmail.POST("/jobs/:id/cancel", handlers.CancelBulkJob)
+			gmail.POST("/jobs/:id/retry", handlers.RetryBulkJob)
+			gmail.GET("/scheduled", handlers.ListScheduledEmails)
+			gmail.GET("/scheduled/:id", handlers.GetScheduledEmail)
+			gmail.PATCH("/scheduled/:id", handlers.RescheduleEmail)
+			gmail.DELETE("/scheduled/:id", handlers.CancelScheduledEmail)
 			gmail.GET("/history", handlers.GetEmailHistory)
 			gmail.GET("/history/stats", handlers.GetEmailHistoryStats)
 		}
+
+		mail := api.Group("/mail")
+		{
+			mail.GET("/settings", handlers.GetMailSettings)
+			mail.PUT("/settings", handlers.UpdateMailSettings)
+			mail.DELETE("/settings", handlers.ResetMailSettings)
+		}
+
+		templates := api.Group("/templates")
+		{
+			templates.GET("", handlers.ListEmailTemplates)
+			templates.POST("", handlers.CreateEmailTemplate)
+			templates.GET("/:id", handlers.GetEmailTemplate)
+			templates.PUT("/:id", handlers.UpdateEmailTemplate)
+			templates.DELETE("/:id", handlers.DeleteEmailTemplate)
+			templates.GET("/:id/versions", handlers.ListEmailTemplateVersions)
+			templates.GET("/:id/versions/:version", handlers.GetEmailTemplateVersion)
+		}
+
+		sandbox := api.Group("/sandbox")
+		{
+			sandbox.GET("/messages", handlers.ListCapturedEmails)
+			sandbox.DELETE("/messages", handlers.PurgeCapturedEmails)
+			sandbox.GET("/messages/:id", handlers.GetCapturedEmail)
+			sandbox.GET("/messages/:id/html", handlers.GetCapturedEmailHTML)
+			sandbox.GET("/messages/:id/raw", handlers.GetCapturedEmailRaw)
+			sandbox.DELETE("/messages/:id", handlers.DeleteCapturedEmail)
+		}
 	}
 
 	return r
@@ -0,0 +1,42 @@
+package transport
+
+import "context"
+
+// CaptureFunc stores a message a CaptureTransport captured, with the
+// Message-ID it was given
+type CaptureFunc func(ctx context.Context, messageID string, msg *Message) error
+
+// CaptureTransport hands messages to a CaptureFunc instead of delivering
+// them, for sandboxes where nothing may leave the server
+type CaptureTransport struct {
+	defaultFrom string
+	store       CaptureFunc
+}
+
+// NewCapture creates a transport keeping every message with store. Messages
+// without a From header get defaultFrom, as Gmail adds the account's address.
+func NewCapture(defaultFrom string, store CaptureFunc) *CaptureTransport {
+	return &CaptureTransport{defaultFrom: defaultFrom, store: store}
+}
+
+func (t *CaptureTransport) Name() string {
+	return Sandbox
+}
+
+// Send stores msg as it would have been delivered: without its Bcc header
+// and with a From header and a Message-ID, which it returns
+func (t *CaptureTransport) Send(ctx context.Context, msg *Message) (string, error) {
+	raw := withoutBcc(msg.Raw)
+	if headerValue(raw, "From") == "" && t.defaultFrom != "" {
+		raw = append([]byte("From: "+t.defaultFrom+"\r\n"), raw...)
+	}
+
+	from := envelopeFrom(&Message{From: msg.From, Raw: raw})
+	raw, messageID := withMessageID(raw, from)
+
+	captured := &Message{From: from, Recipients: msg.Recipients, Raw: raw}
+	if err := t.store(ctx, messageID, captured); err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
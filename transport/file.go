@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File transport formats
+const (
+	FormatEML  = "eml"  // One .eml file per message in a directory
+	FormatMbox = "mbox" // Messages appended to a single mbox file
+)
+
+// FileTransport writes messages to local files instead of delivering them,
+// for development and testing without a mail server
+type FileTransport struct {
+	path   string
+	format string
+	mu     sync.Mutex
+}
+
+// NewFile creates a transport writing messages to path: a directory for the
+// eml format (the default) or a file for the mbox format
+func NewFile(path, format string) (*FileTransport, error) {
+	if path == "" {
+		return nil, fmt.Errorf("mail file path is required")
+	}
+
+	switch format {
+	case "":
+		format = FormatEML
+	case FormatEML, FormatMbox:
+	default:
+		return nil, fmt.Errorf("mail file format must be %s or %s", FormatEML, FormatMbox)
+	}
+
+	return &FileTransport{path: path, format: format}, nil
+}
+
+func (t *FileTransport) Name() string {
+	return File
+}
+
+// Send writes msg with an X-Envelope-To header listing its recipients, Bcc
+// included, and returns its Message-ID
+func (t *FileTransport) Send(ctx context.Context, msg *Message) (string, error) {
+	from := envelopeFrom(msg)
+	raw, messageID := withMessageID(withoutBcc(msg.Raw), from)
+	raw = append([]byte("X-Envelope-To: "+strings.Join(msg.Recipients, ", ")+"\r\n"), raw...)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.format == FormatMbox {
+		return messageID, t.appendMbox(from, raw)
+	}
+
+	if err := os.MkdirAll(t.path, 0o755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), strings.SplitN(messageID, "@", 2)[0])
+	if err := os.WriteFile(filepath.Join(t.path, name), raw, 0o644); err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
+
+// appendMbox appends raw to the mbox file in mboxrd format, quoting body
+// lines that start with "From " so they are not read as message separators
+func (t *FileTransport) appendMbox(from string, raw []byte) error {
+	if dir := filepath.Dir(t.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", from, time.Now().UTC().Format(time.ANSIC))
+	content := strings.TrimRight(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n")
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			buf.WriteString(">")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	// A blank line ends the message before the next "From " separator
+	buf.WriteString("\n")
+
+	file, err := os.OpenFile(t.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,35 @@
+package transport
+
+import (
+	"context"
+	"encoding/base64"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// GmailTransport sends through the Gmail API of one connected account. Gmail
+// delivers to Bcc recipients itself and strips the header from the sent copies.
+type GmailTransport struct {
+	service *gmail.Service
+}
+
+// NewGmail creates a transport sending with an authorized Gmail API client
+func NewGmail(service *gmail.Service) *GmailTransport {
+	return &GmailTransport{service: service}
+}
+
+func (t *GmailTransport) Name() string {
+	return Gmail
+}
+
+// Send sends the raw message and returns the ID Gmail assigned to it
+func (t *GmailTransport) Send(ctx context.Context, msg *Message) (string, error) {
+	message := &gmail.Message{
+		Raw: base64.URLEncoding.EncodeToString(msg.Raw),
+	}
+	sent, err := t.service.Users.Messages.Send("me", message).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return sent.Id, nil
+}
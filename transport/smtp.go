@@ -0,0 +1,234 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SMTP connection security modes
+const (
+	SecurityStartTLS = "starttls" // Upgrade a plain connection, refusing servers that do not offer it
+	SecurityTLS      = "tls"      // Implicit TLS, usually on port 465
+	SecurityNone     = "none"     // Plain text, only for local relays
+)
+
+// ErrPrivateAddress is returned for SMTP servers on the server's own network,
+// which users must not be able to reach through their mail settings
+var ErrPrivateAddress = errors.New("SMTP host must not resolve to a private, loopback or link-local address")
+
+// nonPublicNetworks are the ranges besides those of the net.IP predicates that
+// are not reachable on the internet
+var nonPublicNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"), // Carrier-grade NAT
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// smtpTimeout bounds a whole SMTP session when ctx has no earlier deadline
+const smtpTimeout = 2 * time.Minute
+
+// SMTPConfig describes an SMTP server and the account used to send through it
+type SMTPConfig struct {
+	Host     string
+	Port     int    // 587 for STARTTLS, 465 for implicit TLS and 25 otherwise when zero
+	Username string // Authenticates with PLAIN when set
+	Password string
+	Security string // SecurityStartTLS when empty
+
+	// PublicOnly refuses hosts resolving to private, loopback or link-local
+	// addresses. It is checked on every connection, so a host cannot switch to
+	// such an address after it was validated.
+	PublicOnly bool
+}
+
+// SMTPTransport sends through an SMTP server, opening a connection per message
+type SMTPTransport struct {
+	config SMTPConfig
+}
+
+// NewSMTP checks config and creates a transport sending through it
+func NewSMTP(config SMTPConfig) (*SMTPTransport, error) {
+	if config.Host == "" {
+		return nil, errors.New("SMTP host is required")
+	}
+
+	switch config.Security {
+	case "":
+		config.Security = SecurityStartTLS
+	case SecurityStartTLS, SecurityTLS, SecurityNone:
+	default:
+		return nil, fmt.Errorf("SMTP security must be %s, %s or %s", SecurityStartTLS, SecurityTLS, SecurityNone)
+	}
+
+	if config.Port == 0 {
+		switch config.Security {
+		case SecurityStartTLS:
+			config.Port = 587
+		case SecurityTLS:
+			config.Port = 465
+		default:
+			config.Port = 25
+		}
+	}
+
+	return &SMTPTransport{config: config}, nil
+}
+
+func (t *SMTPTransport) Name() string {
+	return SMTP
+}
+
+// Send delivers msg to its recipients and returns its Message-ID
+func (t *SMTPTransport) Send(ctx context.Context, msg *Message) (string, error) {
+	from := envelopeFrom(msg)
+	if from == "" {
+		from = t.config.Username
+	}
+	if len(msg.Recipients) == 0 {
+		return "", errors.New("message has no recipients")
+	}
+
+	raw, messageID := withMessageID(withoutBcc(msg.Raw), from)
+
+	client, err := t.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	if err := client.Mail(from); err != nil {
+		return "", err
+	}
+	for _, recipient := range msg.Recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := client.Data()
+	if err != nil {
+		return "", err
+	}
+	if _, err := data.Write(raw); err != nil {
+		return "", err
+	}
+	if err := data.Close(); err != nil {
+		return "", err
+	}
+
+	// The message is accepted once DATA is acknowledged
+	client.Quit()
+	return messageID, nil
+}
+
+// dial connects, secures and authenticates an SMTP session
+func (t *SMTPTransport) dial(ctx context.Context) (*smtp.Client, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > smtpTimeout {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+
+	address := net.JoinHostPort(t.config.Host, strconv.Itoa(t.config.Port))
+	tlsConfig := &tls.Config{ServerName: t.config.Host}
+
+	netDialer := &net.Dialer{}
+	if t.config.PublicOnly {
+		netDialer.Control = refusePrivateAddress
+	}
+
+	var conn net.Conn
+	var err error
+	if t.config.Security == SecurityTLS {
+		dialer := &tls.Dialer{NetDialer: netDialer, Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = netDialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, t.config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if t.config.Security == SecurityStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, fmt.Errorf("SMTP server %s does not support STARTTLS", t.config.Host)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	if t.config.Username != "" {
+		auth := smtp.PlainAuth("", t.config.Username, t.config.Password, t.config.Host)
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// CheckPublicHost resolves host and fails with ErrPrivateAddress if any of its
+// addresses is not reachable on the internet
+func CheckPublicHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("SMTP host %s could not be resolved", host)
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return ErrPrivateAddress
+		}
+	}
+	return nil
+}
+
+// refusePrivateAddress is a net.Dialer Control function rejecting connections
+// to the resolved address when it is not public
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// isPublicIP reports whether ip is reachable on the internet
+func isPublicIP(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+// Package transport delivers composed MIME messages through the Gmail API, an
+// SMTP server or local files, or captures them in a sandbox.
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Names of the available transports
+const (
+	Gmail   = "gmail"
+	SMTP    = "smtp"
+	File    = "file"
+	Sandbox = "sandbox"
+)
+
+// Message is a composed message and the addresses it is delivered to
+type Message struct {
+	From       string   // Envelope sender, taken from the From header if empty
+	Recipients []string // Every To, Cc and Bcc address
+	Raw        []byte   // RFC 5322 message; a Bcc header is removed before it leaves the transport
+}
+
+// Transport delivers messages
+type Transport interface {
+	// Name identifies the transport: Gmail, SMTP, File or Sandbox
+	Name() string
+
+	// Send delivers msg and returns the ID the message was sent with
+	Send(ctx context.Context, msg *Message) (string, error)
+}
+
+// envelopeFrom returns the envelope sender of msg
+func envelopeFrom(msg *Message) string {
+	if msg.From != "" {
+		return msg.From
+	}
+	if value := headerValue(msg.Raw, "From"); value != "" {
+		if address, err := mail.ParseAddress(value); err == nil {
+			return address.Address
+		}
+	}
+	return ""
+}
+
+// headerValue returns the first value of a header of raw
+func headerValue(raw []byte, name string) string {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return ""
+	}
+	return header.Get(name)
+}
+
+// withoutBcc removes the Bcc header, including its folded lines, from raw so
+// blind recipients are not disclosed to the others
+func withoutBcc(raw []byte) []byte {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		return raw
+	}
+
+	var out bytes.Buffer
+	skipping := false
+	for _, line := range strings.SplitAfter(string(raw[:end+2]), "\r\n") {
+		folded := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		if folded && skipping {
+			continue
+		}
+		skipping = !folded && len(line) >= 4 && strings.EqualFold(line[:4], "bcc:")
+		if !skipping {
+			out.WriteString(line)
+		}
+	}
+	out.Write(raw[end+2:])
+	return out.Bytes()
+}
+
+// withMessageID returns raw with a Message-ID header, generating one in the
+// sender's domain if it has none, and the ID without angle brackets
+func withMessageID(raw []byte, from string) ([]byte, string) {
+	if existing := headerValue(raw, "Message-ID"); existing != "" {
+		return raw, strings.Trim(existing, "<>")
+	}
+
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = from[at+1:]
+	}
+
+	random := make([]byte, 16)
+	rand.Read(random)
+	id := hex.EncodeToString(random) + "@" + domain
+
+	header := []byte("Message-ID: <" + id + ">\r\n")
+	return append(header, raw...), id
+}
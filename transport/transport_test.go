@@ -0,0 +1,45 @@
+package transport
+
+import "testing"
+
+func TestWithoutBcc(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			"no bcc",
+			"To: a@example.com\r\nSubject: Hi\r\n\r\nBody\r\n",
+			"To: a@example.com\r\nSubject: Hi\r\n\r\nBody\r\n",
+		},
+		{
+			"bcc removed",
+			"To: a@example.com\r\nBcc: b@example.com\r\nSubject: Hi\r\n\r\nBody\r\n",
+			"To: a@example.com\r\nSubject: Hi\r\n\r\nBody\r\n",
+		},
+		{
+			"folded bcc removed",
+			"To: a@example.com\r\nBCC: b@example.com,\r\n c@example.com\r\nSubject: Hi\r\n\r\nBody\r\n",
+			"To: a@example.com\r\nSubject: Hi\r\n\r\nBody\r\n",
+		},
+		{
+			"bcc in the body kept",
+			"To: a@example.com\r\n\r\nBcc: b@example.com\r\n",
+			"To: a@example.com\r\n\r\nBcc: b@example.com\r\n",
+		},
+		{
+			"header named like bcc kept",
+			"X-Bcc-Count: 1\r\nTo: a@example.com\r\n\r\nBody",
+			"X-Bcc-Count: 1\r\nTo: a@example.com\r\n\r\nBody",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(withoutBcc([]byte(tt.raw))); got != tt.want {
+				t.Errorf("withoutBcc() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
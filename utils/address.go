@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// EmailAddress is a mailbox with an optional display name
+type EmailAddress struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email"`
+}
+
+// String formats the address for a message header, e.g. "Jane Doe" <jane@example.com>.
+// Non-ASCII display names are RFC 2047 encoded and internationalized domains
+// are converted to their punycode form.
+func (a EmailAddress) String() string {
+	email := headerEmail(a.Email)
+	if a.Name == "" {
+		return email
+	}
+
+	if !isASCII(a.Name) {
+		return fmt.Sprintf("%s <%s>", encodePhrase(a.Name), email)
+	}
+
+	name := strings.ReplaceAll(a.Name, `\`, `\\`)
+	name = strings.ReplaceAll(name, `"`, `\"`)
+	return fmt.Sprintf(`"%s" <%s>`, name, email)
+}
+
+// encodePhrase encodes a non-ASCII display name. Q encoded words may not
+// contain address specials such as commas, so those names use B encoding.
+func encodePhrase(name string) string {
+	if strings.ContainsAny(name, `()<>@,;:\".[]`) {
+		return mime.BEncoding.Encode("UTF-8", name)
+	}
+	return EncodeHeaderText(name)
+}
+
+// headerEmail converts the domain of email to ASCII. Non-ASCII local parts
+// are kept as UTF-8, which Gmail delivers using SMTPUTF8 (RFC 6531).
+func headerEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+
+	domain, err := idna.Lookup.ToASCII(email[at+1:])
+	if err != nil {
+		return email
+	}
+	return email[:at+1] + domain
+}
+
+// IsValidEmailAddress reports whether email is a deliverable addr-spec.
+// Unlike a plain ASCII regex it accepts UTF-8 local parts (RFC 6531) and
+// internationalized domain names, which are validated via IDNA.
+func IsValidEmailAddress(email string) bool {
+	if email == "" || len(email) > 254 || !utf8.ValidString(email) {
+		return false
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return false
+	}
+
+	return isValidLocalPart(email[:at]) && isValidDomain(email[at+1:])
+}
+
+// isValidLocalPart checks a dot-atom local part, allowing any non-ASCII letters
+func isValidLocalPart(local string) bool {
+	if len(local) > 64 || strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, "..") {
+		return false
+	}
+
+	for _, r := range local {
+		switch {
+		case r >= utf8.RuneSelf:
+			if unicode.IsSpace(r) || unicode.IsControl(r) {
+				return false
+			}
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune(".!#$%&'*+-/=?^_`{|}~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isValidDomain checks that domain converts to a valid ASCII hostname with a top-level domain
+func isValidDomain(domain string) bool {
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil || len(ascii) > 253 {
+		return false
+	}
+
+	labels := strings.Split(ascii, ".")
+	if len(labels) < 2 {
+		return false
+	}
+
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+
+	tld := labels[len(labels)-1]
+	if strings.HasPrefix(strings.ToLower(tld), "xn--") {
+		return true
+	}
+	if len(tld) < 2 {
+		return false
+	}
+	for _, r := range tld {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseEmailAddress parses a single address written as either addr or "Name" <addr>
+func ParseEmailAddress(value string) (EmailAddress, error) {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(value))
+	if err != nil {
+		return EmailAddress{}, fmt.Errorf("invalid email address %q: %v", value, err)
+	}
+	return EmailAddress{Name: parsed.Name, Email: parsed.Address}, nil
+}
+
+// ParseEmailAddressList parses a comma separated list of addresses
+func ParseEmailAddressList(value string) ([]EmailAddress, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	parsed, err := mail.ParseAddressList(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email address list %q: %v", value, err)
+	}
+
+	addresses := make([]EmailAddress, 0, len(parsed))
+	for _, address := range parsed {
+		addresses = append(addresses, EmailAddress{Name: address.Name, Email: address.Address})
+	}
+	return addresses, nil
+}
+
+// FormatAddressList joins addresses for use in a To, Cc or Bcc header
+func FormatAddressList(addresses []EmailAddress) string {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		formatted = append(formatted, address.String())
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEmailAddressString(t *testing.T) {
+	tests := []struct {
+		name    string
+		address EmailAddress
+		want    string
+	}{
+		{"email only", EmailAddress{Email: "jane@example.com"}, "jane@example.com"},
+		{"name", EmailAddress{Name: "Jane Doe", Email: "jane@example.com"}, `"Jane Doe" <jane@example.com>`},
+		{"quotes and backslashes", EmailAddress{Name: `Jane "JD" \ Doe`, Email: "jane@example.com"}, `"Jane \"JD\" \\ Doe" <jane@example.com>`},
+		{"non-ascii name", EmailAddress{Name: "José Silva", Email: "jose@example.com"}, "=?UTF-8?q?Jos=C3=A9_Silva?= <jose@example.com>"},
+		{"non-ascii name with comma", EmailAddress{Name: "Doe, José", Email: "jose@example.com"}, "=?UTF-8?b?RG9lLCBKb3PDqQ==?= <jose@example.com>"},
+		{"internationalized domain", EmailAddress{Email: "info@bücher.de"}, "info@xn--bcher-kva.de"},
+		{"utf-8 local part", EmailAddress{Email: "用户@example.com"}, "用户@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.address.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsValidEmailAddress(t *testing.T) {
+	tests := map[string]bool{
+		"jane@example.com":           true,
+		"jane.doe+tag@mail.example":  true,
+		"用户@例子.广告":                   true,
+		"info@bücher.de":             true,
+		"":                           false,
+		"jane":                       false,
+		"jane@":                      false,
+		"@example.com":               false,
+		"jane@localhost":             false,
+		"jane..doe@example.com":      false,
+		".jane@example.com":          false,
+		"jane doe@example.com":       false,
+		"jane@-example.com":          false,
+		"jane@example.c0m":           false,
+		"jane@example.com\r\nBcc: x": false,
+	}
+
+	for email, want := range tests {
+		if got := IsValidEmailAddress(email); got != want {
+			t.Errorf("IsValidEmailAddress(%q) = %v, want %v", email, got, want)
+		}
+	}
+}
+
+func TestParseEmailAddressList(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []EmailAddress
+		wantErr bool
+	}{
+		{"empty", "  ", nil, false},
+		{"single", "jane@example.com", []EmailAddress{{Email: "jane@example.com"}}, false},
+		{"names and addresses", `"Doe, Jane" <jane@example.com>, bob@example.com`,
+			[]EmailAddress{{Name: "Doe, Jane", Email: "jane@example.com"}, {Email: "bob@example.com"}}, false},
+		{"encoded name", "=?UTF-8?q?Jos=C3=A9?= <jose@example.com>", []EmailAddress{{Name: "José", Email: "jose@example.com"}}, false},
+		{"invalid", "jane@example.com, not an address", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseEmailAddressList(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEmailAddressList(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseEmailAddressList(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
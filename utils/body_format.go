@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+)
+
+// Formats the body of an email can be written in
+const (
+	BodyFormatText     = "text"     // Sent as written, next to an optional html_body
+	BodyFormatMarkdown = "markdown" // Converted to HTML, with a plain text alternative
+	BodyFormatHTML     = "html"     // Sent as the HTML body, with a plain text alternative
+)
+
+// markdown converts GitHub flavored Markdown to HTML. Raw HTML and links with
+// dangerous schemes such as javascript: are left out, and line breaks are kept
+// as written.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithRendererOptions(goldmarkhtml.WithHardWraps()),
+)
+
+// ValidateBodyFormat checks the body_format of a request. An html_body can only
+// be given along with a text body, since the other formats generate it.
+func ValidateBodyFormat(format, htmlBody string) ValidationErrors {
+	var errs ValidationErrors
+	switch format {
+	case "", BodyFormatText:
+	case BodyFormatMarkdown, BodyFormatHTML:
+		if htmlBody != "" {
+			errs.Add("html_body", "cannot be combined with body_format %s, which makes the HTML from body", format)
+		}
+	default:
+		errs.Add("body_format", "must be %s, %s or %s", BodyFormatText, BodyFormatMarkdown, BodyFormatHTML)
+	}
+	return errs
+}
+
+// RenderedBody is the text and HTML bodies of a message
+type RenderedBody struct {
+	Text     string
+	HTML     string
+	Warnings []HTMLWarning // About the HTML, from ProcessEmailHTML
+}
+
+// RenderBody turns a body written in format into the text and HTML bodies of a
+// message. A text body is sent as is, along with htmlBody; Markdown is
+// converted to HTML. The HTML goes through ProcessEmailHTML, and the text of
+// Markdown and HTML bodies is made from it with HTMLToText.
+func RenderBody(format, body, htmlBody string) (*RenderedBody, error) {
+	rendered := &RenderedBody{}
+	switch format {
+	case "", BodyFormatText:
+		rendered.Text, rendered.HTML = body, htmlBody
+	case BodyFormatMarkdown:
+		markdownHTML, err := RenderMarkdown(body)
+		if err != nil {
+			return nil, err
+		}
+		rendered.HTML = markdownHTML
+	case BodyFormatHTML:
+		rendered.HTML = body
+	default:
+		return nil, fmt.Errorf("unknown body format %q", format)
+	}
+
+	if rendered.HTML != "" {
+		rendered.HTML, rendered.Warnings = ProcessEmailHTML(rendered.HTML)
+	}
+	if format == BodyFormatMarkdown || format == BodyFormatHTML {
+		rendered.Text = HTMLToText(rendered.HTML)
+	}
+	return rendered, nil
+}
+
+// RenderMarkdown converts Markdown to HTML
+func RenderMarkdown(source string) (string, error) {
+	if strings.TrimSpace(source) == "" {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return "", fmt.Errorf("failed to render markdown: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// EscapeMarkdown backslash-escapes the punctuation Markdown gives a meaning to,
+// so a value filled into a Markdown template shows as written
+func EscapeMarkdown(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		if strings.ContainsRune("\\`*_{}[]()<>#+-.!|~&", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
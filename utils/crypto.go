@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tokenCipherPrefix marks a value sealed by EncryptToken; anything else is legacy plaintext
+const tokenCipherPrefix = "enc:v"
+
+// tokenKeyring holds the master keys tokens are encrypted with, by version
+type tokenKeyring struct {
+	keys    map[int][]byte
+	current int // Version used for new values, 0 when encryption is not configured
+}
+
+var (
+	tokenKeys     *tokenKeyring
+	tokenKeysErr  error
+	tokenKeysOnce sync.Once
+)
+
+// loadTokenKeyring reads the master keys once. Keys come from
+// TOKEN_ENCRYPTION_KEYS, a comma separated list of "version:base64key",
+// and/or TOKEN_ENCRYPTION_KEYS_FILE, a file with one "version:base64key"
+// per line. Each key must be 32 bytes (AES-256). New values are encrypted
+// with TOKEN_ENCRYPTION_KEY_VERSION, or the highest version if it is unset.
+func loadTokenKeyring() (*tokenKeyring, error) {
+	tokenKeysOnce.Do(func() {
+		tokenKeys, tokenKeysErr = readTokenKeyring()
+		if tokenKeysErr == nil && tokenKeys.current == 0 {
+			fmt.Println("Warning: TOKEN_ENCRYPTION_KEYS is not set, Gmail tokens are stored unencrypted")
+		}
+	})
+	return tokenKeys, tokenKeysErr
+}
+
+func readTokenKeyring() (*tokenKeyring, error) {
+	keyring := &tokenKeyring{keys: make(map[int][]byte)}
+
+	var entries []string
+	if value := os.Getenv("TOKEN_ENCRYPTION_KEYS"); value != "" {
+		entries = append(entries, strings.Split(value, ",")...)
+	}
+	if path := os.Getenv("TOKEN_ENCRYPTION_KEYS_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open token key file: %v", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read token key file: %v", err)
+		}
+	}
+
+	for _, entry := range entries {
+		versionText, encoded, found := strings.Cut(strings.TrimSpace(entry), ":")
+		version, err := strconv.Atoi(versionText)
+		if !found || err != nil || version < 1 {
+			return nil, fmt.Errorf("token key %q must be formatted as version:base64key with a positive version", versionText)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("token key version %d must be 32 bytes encoded as base64", version)
+		}
+		if _, duplicate := keyring.keys[version]; duplicate {
+			return nil, fmt.Errorf("token key version %d is defined twice", version)
+		}
+		keyring.keys[version] = key
+		if version > keyring.current {
+			keyring.current = version
+		}
+	}
+
+	if value := os.Getenv("TOKEN_ENCRYPTION_KEY_VERSION"); value != "" {
+		version, err := strconv.Atoi(value)
+		if err != nil || keyring.keys[version] == nil {
+			return nil, fmt.Errorf("TOKEN_ENCRYPTION_KEY_VERSION %q does not name a configured key", value)
+		}
+		keyring.current = version
+	}
+
+	return keyring, nil
+}
+
+// TokenKeyVersion returns the key version new tokens are encrypted with, or 0
+// if no encryption key is configured and tokens are stored as plaintext
+func TokenKeyVersion() (int, error) {
+	keyring, err := loadTokenKeyring()
+	if err != nil {
+		return 0, err
+	}
+	return keyring.current, nil
+}
+
+// EncryptToken seals a secret with envelope encryption: the value is encrypted
+// with a fresh data key, and the data key with the current master key. The
+// result is "enc:v<version>:<wrapped data key>:<ciphertext>". Without a
+// configured key the value is returned unchanged.
+func EncryptToken(plaintext string) (string, error) {
+	keyring, err := loadTokenKeyring()
+	if err != nil {
+		return "", err
+	}
+	if keyring.current == 0 || plaintext == "" {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+
+	version := strconv.Itoa(keyring.current)
+	wrappedKey, err := sealGCM(keyring.keys[keyring.current], dataKey, []byte(version))
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealGCM(dataKey, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return tokenCipherPrefix + version + ":" +
+		base64.RawURLEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// DecryptToken opens a value sealed by EncryptToken with the key version it
+// names. Legacy plaintext values are returned unchanged.
+func DecryptToken(value string) (string, error) {
+	if !strings.HasPrefix(value, tokenCipherPrefix) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, tokenCipherPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted token")
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return "", errors.New("malformed encrypted token version")
+	}
+
+	keyring, err := loadTokenKeyring()
+	if err != nil {
+		return "", err
+	}
+	masterKey := keyring.keys[version]
+	if masterKey == nil {
+		return "", fmt.Errorf("token encryption key version %d is not configured", version)
+	}
+
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("malformed encrypted token key")
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed encrypted token data")
+	}
+
+	dataKey, err := openGCM(masterKey, wrappedKey, []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap token key: %v", err)
+	}
+	plaintext, err := openGCM(dataKey, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt token: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// TokenCipherVersion returns the key version a stored value was encrypted with, or 0 for plaintext
+func TokenCipherVersion(value string) int {
+	if !strings.HasPrefix(value, tokenCipherPrefix) {
+		return 0
+	}
+	versionText, _, _ := strings.Cut(strings.TrimPrefix(value, tokenCipherPrefix), ":")
+	version, _ := strconv.Atoi(versionText)
+	return version
+}
+
+func sealGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openGCM(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
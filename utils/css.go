@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// cssRule is a rule of a style sheet: a selector list with its declarations,
+// or an at-rule such as @media kept as written
+type cssRule struct {
+	selectors    string
+	declarations []cssDeclaration
+	atRule       string // Whole text of an at-rule, including its block
+}
+
+// cssDeclaration is one property of a rule or style attribute
+type cssDeclaration struct {
+	property  string // Lower case
+	value     string
+	important bool
+}
+
+// cssImportant matches the !important flag at the end of a declaration's value
+var cssImportant = regexp.MustCompile(`(?i)\s*!\s*important\s*$`)
+
+// parseStyleSheet splits the content of a style element into rules.
+// Comments are dropped, and text that is not a complete rule is ignored.
+func parseStyleSheet(css string) []cssRule {
+	css = stripCSSComments(css)
+
+	var rules []cssRule
+	for i := 0; i < len(css); {
+		end := indexCSSOutsideStrings(css, i, "{;")
+		if end < 0 {
+			break
+		}
+		prelude := strings.TrimSpace(css[i:end])
+
+		// Statements such as @import and @charset end at a semicolon
+		if css[end] == ';' {
+			if prelude != "" {
+				rules = append(rules, cssRule{atRule: prelude + ";"})
+			}
+			i = end + 1
+			continue
+		}
+
+		close := matchingCSSBrace(css, end)
+		block := css[end+1 : close]
+		switch {
+		case strings.HasPrefix(prelude, "@"):
+			rules = append(rules, cssRule{atRule: prelude + " {" + block + "}"})
+		case prelude != "":
+			rules = append(rules, cssRule{selectors: prelude, declarations: parseCSSDeclarations(block)})
+		}
+		i = close + 1
+	}
+	return rules
+}
+
+// parseCSSDeclarations parses the declarations of a rule block or style attribute
+func parseCSSDeclarations(text string) []cssDeclaration {
+	var declarations []cssDeclaration
+	for _, part := range splitCSSOutsideStrings(stripCSSComments(text), ';') {
+		colon := strings.IndexByte(part, ':')
+		if colon < 0 {
+			continue
+		}
+		declaration := cssDeclaration{
+			property: strings.ToLower(strings.TrimSpace(part[:colon])),
+			value:    strings.TrimSpace(part[colon+1:]),
+		}
+		if cssImportant.MatchString(declaration.value) {
+			declaration.value = cssImportant.ReplaceAllString(declaration.value, "")
+			declaration.important = true
+		}
+		if declaration.property != "" && declaration.value != "" {
+			declarations = append(declarations, declaration)
+		}
+	}
+	return declarations
+}
+
+// formatCSSDeclarations writes declarations as the value of a style attribute
+func formatCSSDeclarations(declarations []cssDeclaration) string {
+	parts := make([]string, 0, len(declarations))
+	for _, declaration := range declarations {
+		part := declaration.property + ": " + declaration.value
+		if declaration.important {
+			part += " !important"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// formatCSSRule writes a rule back as style sheet text
+func formatCSSRule(rule cssRule) string {
+	if rule.atRule != "" {
+		return rule.atRule
+	}
+	return rule.selectors + " { " + formatCSSDeclarations(rule.declarations) + " }"
+}
+
+// splitCSSSelectors splits a selector list at its top-level commas
+func splitCSSSelectors(selectors string) []string {
+	var parts []string
+	for _, part := range splitCSSOutsideStrings(selectors, ',') {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// stripCSSComments removes /* */ comments, and the HTML comment markers old
+// style sheets are wrapped in, outside of strings
+func stripCSSComments(css string) string {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(css) {
+				b.WriteByte(c)
+				i++
+				c = css[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case strings.HasPrefix(css[i:], "/*"):
+			end := strings.Index(css[i+2:], "*/")
+			if end < 0 {
+				return b.String()
+			}
+			i += end + 3
+			continue
+		case strings.HasPrefix(css[i:], "<!--"):
+			i += 3
+			continue
+		case strings.HasPrefix(css[i:], "-->"):
+			i += 2
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// splitCSSOutsideStrings splits text at sep, except inside strings, parentheses and brackets
+func splitCSSOutsideStrings(text string, sep byte) []string {
+	var parts []string
+	start := 0
+	for {
+		end := indexCSSOutsideStrings(text, start, string(sep))
+		if end < 0 {
+			return append(parts, text[start:])
+		}
+		parts = append(parts, text[start:end])
+		start = end + 1
+	}
+}
+
+// indexCSSOutsideStrings returns the index of the first of chars in css from
+// start, skipping strings, parentheses and brackets, or -1 if there is none
+func indexCSSOutsideStrings(css string, start int, chars string) int {
+	var quote byte
+	depth := 0
+	for i := start; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case (c == ')' || c == ']') && depth > 0:
+			depth--
+		case depth == 0 && strings.IndexByte(chars, c) >= 0:
+			return i
+		}
+	}
+	return -1
+}
+
+// matchingCSSBrace returns the index of the brace closing the block opened at
+// open, or the end of css if the block is not closed
+func matchingCSSBrace(css string, open int) int {
+	depth := 0
+	for i := open; i < len(css); {
+		next := indexCSSOutsideStrings(css, i, "{}")
+		if next < 0 {
+			break
+		}
+		if css[next] == '{' {
+			depth++
+		} else if depth--; depth == 0 {
+			return next
+		}
+		i = next + 1
+	}
+	return len(css)
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCSSDeclarations(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []cssDeclaration
+	}{
+		{"simple", "color: red; Padding: 4px", []cssDeclaration{{"color", "red", false}, {"padding", "4px", false}}},
+		{"important", "color: red !important; margin: 0 ! IMPORTANT", []cssDeclaration{{"color", "red", true}, {"margin", "0", true}}},
+		{"semicolon in string", `font-family: "a;b", serif; color: red`, []cssDeclaration{{"font-family", `"a;b", serif`, false}, {"color", "red", false}}},
+		{"colon in value", "background: url(https://example.com/a.png)", []cssDeclaration{{"background", "url(https://example.com/a.png)", false}}},
+		{"comments", "color: /* blue */ red; /* margin: 0; */ padding: 1px", []cssDeclaration{{"color", "red", false}, {"padding", "1px", false}}},
+		{"empty and invalid parts", "; color:; : red; nonsense; color: red;", []cssDeclaration{{"color", "red", false}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseCSSDeclarations(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCSSDeclarations(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStyleSheet(t *testing.T) {
+	css := `@charset "utf-8";
+/* header { color: red } */
+h1, .title { color: red; content: "}" }
+@media (max-width: 600px) { h1 { font-size: 18px } }
+p{margin:0}`
+
+	want := []cssRule{
+		{atRule: `@charset "utf-8";`},
+		{selectors: "h1, .title", declarations: []cssDeclaration{{"color", "red", false}, {"content", `"}"`, false}}},
+		{atRule: "@media (max-width: 600px) { h1 { font-size: 18px } }"},
+		{selectors: "p", declarations: []cssDeclaration{{"margin", "0", false}}},
+	}
+	got := parseStyleSheet(css)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStyleSheet() = %#v, want %#v", got, want)
+	}
+}
+
+func TestSplitCSSSelectors(t *testing.T) {
+	got := splitCSSSelectors(` h1 , a[title="x, y"],, p `)
+	want := []string{"h1", `a[title="x, y"]`, "p"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitCSSSelectors() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,586 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// GmailClipSize is the size of HTML past which Gmail clips a message behind a "View entire message" link
+const GmailClipSize = 102 * 1024
+
+// HTMLWarning is something in an HTML body that was removed, or that renders
+// badly in some email clients
+type HTMLWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Codes of HTML warnings
+const (
+	HTMLWarningRemovedElement   = "removed_element"
+	HTMLWarningRemovedAttribute = "removed_attribute"
+	HTMLWarningUnsafeURL        = "unsafe_url"
+	HTMLWarningUnsafeCSS        = "unsafe_css"
+	HTMLWarningStyleKept        = "style_not_inlined"
+	HTMLWarningUnsupportedCSS   = "unsupported_css"
+	HTMLWarningMissingAlt       = "missing_alt"
+	HTMLWarningRelativeURL      = "relative_url"
+	HTMLWarningDataImage        = "data_image"
+	HTMLWarningClipped          = "gmail_clipping"
+)
+
+// htmlDocument matches HTML that is a whole document rather than a fragment
+var htmlDocument = regexp.MustCompile(`(?i)<(!doctype|html)[\s>]`)
+
+// cssDynamicSelector matches selectors for states and pseudo-elements, which
+// cannot be written as style attributes
+var cssDynamicSelector = regexp.MustCompile(`(?i)::|:(hover|active|focus|focus-within|focus-visible|visited|target|before|after|first-line|first-letter)\b`)
+
+// ProcessEmailHTML prepares an HTML body for sending. CSS rules from style
+// elements are inlined into style attributes, since clients such as Gmail drop
+// style elements; rules that cannot be inlined, such as @media queries and
+// :hover, stay in a style element. Scripts, event handlers, javascript: URLs
+// and other dangerous elements, attributes and CSS are removed. The warnings
+// list what was removed and the constructs that render badly in major email
+// clients. A fragment stays a fragment, and a whole document keeps its head.
+func ProcessEmailHTML(source string) (string, []HTMLWarning) {
+	doc, err := html.Parse(strings.NewReader(source))
+	if err != nil {
+		return source, nil
+	}
+
+	p := &htmlProcessor{seen: make(map[string]bool)}
+	kept := p.inlineCSS(doc)
+	if kept != "" {
+		style := &html.Node{Type: html.ElementNode, DataAtom: atom.Style, Data: "style"}
+		style.AppendChild(&html.Node{Type: html.TextNode, Data: kept})
+		if head := findElement(doc, atom.Head); head != nil {
+			head.AppendChild(style)
+		}
+	}
+	p.sanitize(doc)
+	p.check(findElement(doc, atom.Body))
+
+	var buf bytes.Buffer
+	if htmlDocument.MatchString(source) {
+		html.Render(&buf, doc)
+	} else {
+		for _, parent := range []*html.Node{findElement(doc, atom.Head), findElement(doc, atom.Body)} {
+			for n := parent.FirstChild; n != nil; n = n.NextSibling {
+				if parent.DataAtom == atom.Body || n.DataAtom == atom.Style {
+					html.Render(&buf, n)
+				}
+			}
+		}
+	}
+
+	if buf.Len() > GmailClipSize {
+		p.warn(HTMLWarningClipped, "the HTML is %d KB; Gmail clips messages over %d KB behind a \"View entire message\" link", buf.Len()/1024, GmailClipSize/1024)
+	}
+	return buf.String(), p.warnings
+}
+
+// htmlProcessor collects the warnings of ProcessEmailHTML, each one once
+type htmlProcessor struct {
+	warnings []HTMLWarning
+	seen     map[string]bool
+}
+
+func (p *htmlProcessor) warn(code, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if p.seen[message] {
+		return
+	}
+	p.seen[message] = true
+	p.warnings = append(p.warnings, HTMLWarning{Code: code, Message: message})
+}
+
+// cssMatch is a rule's declarations that apply to an element
+type cssMatch struct {
+	specificity  cascadia.Specificity
+	order        int
+	declarations []cssDeclaration
+}
+
+// inlineCSS moves the rules of the document's style elements into the style
+// attributes of the elements they select, following the cascade, and removes
+// the style elements. The rules that cannot be inlined are returned as a
+// style sheet.
+func (p *htmlProcessor) inlineCSS(doc *html.Node) string {
+	var styles []*html.Node
+	walkElements(doc, func(n *html.Node) {
+		if n.DataAtom == atom.Style {
+			styles = append(styles, n)
+		}
+	})
+
+	var kept []string
+	matches := make(map[*html.Node][]cssMatch)
+	order := 0
+	for _, style := range styles {
+		css := textContent(style)
+		style.Parent.RemoveChild(style)
+
+		// Only screen styles apply when inlined
+		if media := strings.TrimSpace(htmlAttr(style, "media")); media != "" && !strings.EqualFold(media, "all") && !strings.EqualFold(media, "screen") {
+			kept = append(kept, "@media "+media+" {\n"+css+"\n}")
+			continue
+		}
+
+		for _, rule := range parseStyleSheet(css) {
+			if rule.atRule != "" {
+				kept = append(kept, rule.atRule)
+				continue
+			}
+			for _, selector := range splitCSSSelectors(rule.selectors) {
+				sel, err := cascadia.ParseWithPseudoElement(selector)
+				if err != nil || sel.PseudoElement() != "" || cssDynamicSelector.MatchString(selector) {
+					p.warn(HTMLWarningStyleKept, "the CSS for %s cannot be inlined and stays in a style element, which some email clients ignore", selector)
+					kept = append(kept, formatCSSRule(cssRule{selectors: selector, declarations: rule.declarations}))
+					continue
+				}
+				order++
+				for _, n := range cascadia.QueryAll(doc, sel) {
+					if inBody(n) {
+						matches[n] = append(matches[n], cssMatch{specificity: sel.Specificity(), order: order, declarations: rule.declarations})
+					}
+				}
+			}
+		}
+	}
+
+	for n, matched := range matches {
+		sort.SliceStable(matched, func(i, j int) bool {
+			if matched[i].specificity != matched[j].specificity {
+				return matched[i].specificity.Less(matched[j].specificity)
+			}
+			return matched[i].order < matched[j].order
+		})
+		setHTMLAttr(n, "style", formatCSSDeclarations(cascadeCSS(matched, parseCSSDeclarations(htmlAttr(n, "style")))))
+	}
+
+	return strings.Join(kept, "\n")
+}
+
+// cascadeCSS merges the rules matching an element, sorted by specificity and
+// order, with its style attribute. Declarations come in increasing priority:
+// normal ones from rules, then the attribute's, then important ones from rules,
+// then the attribute's important ones. Only the last declaration of each
+// property is kept.
+func cascadeCSS(matched []cssMatch, inline []cssDeclaration) []cssDeclaration {
+	var ordered []cssDeclaration
+	for _, important := range []bool{false, true} {
+		for _, match := range matched {
+			for _, declaration := range match.declarations {
+				if declaration.important == important {
+					ordered = append(ordered, declaration)
+				}
+			}
+		}
+		for _, declaration := range inline {
+			if declaration.important == important {
+				ordered = append(ordered, declaration)
+			}
+		}
+	}
+
+	// A repeated property moves to the end, so it still overrides shorthands declared before it
+	var result []cssDeclaration
+	for _, declaration := range ordered {
+		for i := range result {
+			if result[i].property == declaration.property {
+				result = append(result[:i], result[i+1:]...)
+				break
+			}
+		}
+		result = append(result, declaration)
+	}
+	return result
+}
+
+// removedElements are dropped with their content, for the reason given
+var removedElements = map[atom.Atom]string{
+	atom.Script:   "scripts do not run in email and are a security risk",
+	atom.Noscript: "scripts do not run in email",
+	atom.Iframe:   "frames are not supported in email and are a security risk",
+	atom.Frame:    "frames are not supported in email and are a security risk",
+	atom.Frameset: "frames are not supported in email and are a security risk",
+	atom.Object:   "plugins are not supported in email and are a security risk",
+	atom.Embed:    "plugins are not supported in email and are a security risk",
+	atom.Applet:   "plugins are not supported in email and are a security risk",
+	atom.Base:     "it changes where every link of the message points",
+	atom.Link:     "email clients do not load external style sheets; put the CSS in a style element",
+	atom.Svg:      "Gmail and Outlook do not show SVG",
+	atom.Math:     "most email clients do not show MathML",
+	atom.Video:    "most email clients do not play video; link to it from an image instead",
+	atom.Audio:    "most email clients do not play audio",
+	atom.Canvas:   "canvas needs scripts, which do not run in email",
+	atom.Input:    "most email clients do not support forms",
+	atom.Button:   "most email clients do not support forms; style a link as a button instead",
+	atom.Select:   "most email clients do not support forms",
+	atom.Textarea: "most email clients do not support forms",
+	atom.Template: "template content is never shown",
+}
+
+// allowedElements are kept. Other elements are replaced by their content.
+var allowedElements = map[atom.Atom]bool{
+	atom.Html: true, atom.Head: true, atom.Body: true, atom.Title: true, atom.Meta: true, atom.Style: true,
+	atom.A: true, atom.Abbr: true, atom.Address: true, atom.Area: true, atom.Article: true, atom.Aside: true,
+	atom.B: true, atom.Bdi: true, atom.Bdo: true, atom.Big: true, atom.Blockquote: true, atom.Br: true,
+	atom.Caption: true, atom.Center: true, atom.Cite: true, atom.Code: true, atom.Col: true, atom.Colgroup: true,
+	atom.Dd: true, atom.Del: true, atom.Details: true, atom.Dfn: true, atom.Div: true, atom.Dl: true, atom.Dt: true,
+	atom.Em: true, atom.Figcaption: true, atom.Figure: true, atom.Font: true, atom.Footer: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Header: true, atom.Hr: true, atom.I: true, atom.Img: true, atom.Ins: true, atom.Kbd: true, atom.Li: true,
+	atom.Main: true, atom.Map: true, atom.Mark: true, atom.Nav: true, atom.Ol: true, atom.P: true, atom.Pre: true,
+	atom.Q: true, atom.S: true, atom.Samp: true, atom.Section: true, atom.Small: true, atom.Span: true,
+	atom.Strike: true, atom.Strong: true, atom.Sub: true, atom.Summary: true, atom.Sup: true,
+	atom.Table: true, atom.Tbody: true, atom.Td: true, atom.Tfoot: true, atom.Th: true, atom.Thead: true,
+	atom.Time: true, atom.Tr: true, atom.Tt: true, atom.U: true, atom.Ul: true, atom.Var: true, atom.Wbr: true,
+}
+
+// allowedAttributes are kept on any element, along with aria-* and data-* attributes
+var allowedAttributes = map[string]bool{
+	"id": true, "class": true, "style": true, "title": true, "dir": true, "lang": true, "role": true,
+	"align": true, "valign": true, "width": true, "height": true, "bgcolor": true, "background": true,
+	"border": true, "bordercolor": true, "cellpadding": true, "cellspacing": true, "color": true, "face": true, "size": true,
+	"colspan": true, "rowspan": true, "span": true, "scope": true, "headers": true, "nowrap": true, "summary": true,
+	"alt": true, "src": true, "href": true, "target": true, "rel": true, "name": true, "usemap": true,
+	"shape": true, "coords": true, "type": true, "start": true, "value": true, "reversed": true, "datetime": true,
+	"cite": true, "open": true, "hspace": true, "vspace": true, "media": true, "xmlns": true,
+	"charset": true, "content": true, "http-equiv": true,
+}
+
+// urlAttributes hold URLs, which must use a safe scheme
+var urlAttributes = map[string]bool{"href": true, "src": true, "background": true, "cite": true}
+
+// sanitize removes the dangerous elements, attributes and CSS below n
+func (p *htmlProcessor) sanitize(n *html.Node) {
+	for child := n.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type != html.ElementNode {
+			child = next
+			continue
+		}
+
+		if reason, ok := removedElements[child.DataAtom]; ok {
+			p.warn(HTMLWarningRemovedElement, "removed <%s>: %s", child.Data, reason)
+			n.RemoveChild(child)
+			child = next
+			continue
+		}
+		if child.DataAtom == atom.Meta && !safeMeta(child) {
+			p.warn(HTMLWarningRemovedElement, "removed <meta http-equiv=%q>", htmlAttr(child, "http-equiv"))
+			n.RemoveChild(child)
+			child = next
+			continue
+		}
+		if !allowedElements[child.DataAtom] || child.Namespace != "" {
+			if child.DataAtom == atom.Form {
+				p.warn(HTMLWarningRemovedElement, "removed <form>, keeping its content: most email clients do not support forms")
+			}
+			// Keep the content in its place, and sanitize it next
+			first := child.FirstChild
+			for grandchild := first; grandchild != nil; grandchild = child.FirstChild {
+				child.RemoveChild(grandchild)
+				n.InsertBefore(grandchild, child)
+			}
+			n.RemoveChild(child)
+			if first != nil {
+				next = first
+			}
+			child = next
+			continue
+		}
+
+		p.sanitizeAttributes(child)
+		if child.DataAtom == atom.Style {
+			setTextContent(child, p.sanitizeStyleSheet(textContent(child)))
+		}
+		p.sanitize(child)
+		child = next
+	}
+}
+
+// sanitizeAttributes removes the attributes of n that are not allowed, event
+// handlers, unsafe URLs and unsafe CSS in its style
+func (p *htmlProcessor) sanitizeAttributes(n *html.Node) {
+	attrs := n.Attr[:0]
+	for _, attr := range n.Attr {
+		key := strings.ToLower(attr.Key)
+		switch {
+		case attr.Namespace != "":
+			continue
+		case strings.HasPrefix(key, "on"):
+			p.warn(HTMLWarningRemovedAttribute, "removed %s attributes: scripts do not run in email", key)
+			continue
+		case !allowedAttributes[key] && !strings.HasPrefix(key, "aria-") && !strings.HasPrefix(key, "data-"):
+			continue
+		case urlAttributes[key] && !safeURL(attr.Val, n.DataAtom == atom.Img && key == "src"):
+			p.warn(HTMLWarningUnsafeURL, "removed the %s of <%s>: %s URLs are not allowed", key, n.Data, urlScheme(attr.Val))
+			continue
+		case key == "style":
+			attr.Val = formatCSSDeclarations(p.sanitizeDeclarations(parseCSSDeclarations(attr.Val)))
+			if attr.Val == "" {
+				continue
+			}
+		}
+		attrs = append(attrs, attr)
+	}
+	n.Attr = attrs
+}
+
+// sanitizeStyleSheet removes the unsafe rules and declarations of a style sheet
+func (p *htmlProcessor) sanitizeStyleSheet(css string) string {
+	var rules []string
+	for _, rule := range parseStyleSheet(css) {
+		if rule.atRule == "" {
+			rule.declarations = p.sanitizeDeclarations(rule.declarations)
+			rules = append(rules, formatCSSRule(rule))
+			continue
+		}
+
+		name := strings.ToLower(strings.Fields(rule.atRule)[0])
+		switch {
+		case name == "@import":
+			p.warn(HTMLWarningUnsafeCSS, "removed @import: email clients do not load external style sheets")
+		case name == "@charset" || name == "@namespace":
+		case unsafeCSS(rule.atRule):
+			p.warn(HTMLWarningUnsafeCSS, "removed the CSS rule %s: it runs code or loads an unsafe URL", name)
+		default:
+			rules = append(rules, rule.atRule)
+		}
+	}
+	return strings.Join(rules, "\n")
+}
+
+// sanitizeDeclarations removes the declarations that run code or load unsafe URLs
+func (p *htmlProcessor) sanitizeDeclarations(declarations []cssDeclaration) []cssDeclaration {
+	safe := declarations[:0]
+	for _, declaration := range declarations {
+		if unsafeCSS(declaration.property + ":" + declaration.value) {
+			p.warn(HTMLWarningUnsafeCSS, "removed the CSS property %s: it runs code or loads an unsafe URL", declaration.property)
+			continue
+		}
+		safe = append(safe, declaration)
+	}
+	return safe
+}
+
+// cssURL matches the URLs of CSS, quoted or not
+var cssURL = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)]*))\s*\)`)
+
+// cssCode matches the CSS old browsers run as code
+var cssCode = regexp.MustCompile(`(?i)expression\s*\(|(^|[^-\w])behavior\s*:|-moz-binding|javascript:|vbscript:|@import`)
+
+// unsafeCSS reports whether CSS runs code, in old browsers, or loads a URL
+// with an unsafe scheme. Escapes are not decoded, so CSS with any is unsafe.
+func unsafeCSS(css string) bool {
+	if strings.Contains(css, "\\") || cssCode.MatchString(css) {
+		return true
+	}
+	for _, match := range cssURL.FindAllStringSubmatch(css, -1) {
+		if !safeURL(match[1]+match[2]+match[3], true) {
+			return true
+		}
+	}
+	return false
+}
+
+// safeURL reports whether a URL uses a scheme email may link to: http, https,
+// mailto, tel and cid, or none for relative URLs. Images may also be data:
+// URLs, except SVG which can hold scripts.
+func safeURL(value string, image bool) bool {
+	switch scheme := urlScheme(value); scheme {
+	case "", "http", "https", "mailto", "tel", "cid":
+		return true
+	case "data":
+		normalized := strings.ToLower(stripURLSpace(value))
+		return image && strings.HasPrefix(normalized, "data:image/") && !strings.HasPrefix(normalized, "data:image/svg")
+	default:
+		return false
+	}
+}
+
+// urlScheme returns the lower case scheme of a URL, ignoring the whitespace and
+// control characters browsers ignore, or "" for a relative URL
+func urlScheme(value string) string {
+	normalized := stripURLSpace(value)
+	colon := strings.IndexByte(normalized, ':')
+	if colon < 0 || strings.ContainsAny(normalized[:colon], "/?#") {
+		return ""
+	}
+	return strings.ToLower(normalized[:colon])
+}
+
+func stripURLSpace(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// safeMeta reports whether a meta element only describes the document, rather
+// than refreshing or redirecting it
+func safeMeta(n *html.Node) bool {
+	equiv := strings.ToLower(strings.TrimSpace(htmlAttr(n, "http-equiv")))
+	return equiv == "" || equiv == "content-type" || equiv == "x-ua-compatible"
+}
+
+// unsupportedCSS describes the CSS properties major email clients ignore
+var unsupportedCSS = map[string]string{
+	"position":         "Gmail and Outlook ignore position",
+	"float":            "Outlook on Windows ignores float; use table cells or align instead",
+	"box-shadow":       "Outlook on Windows and Gmail on some platforms do not show box-shadow",
+	"transform":        "most email clients ignore transform",
+	"animation":        "most email clients do not run animations",
+	"transition":       "most email clients ignore transitions",
+	"background-image": "Outlook on Windows does not show background images",
+	"max-width":        "Outlook on Windows ignores max-width; set a width too",
+	"clip-path":        "most email clients ignore clip-path",
+	"filter":           "most email clients ignore filter",
+}
+
+// check warns about what renders badly in major email clients below body
+func (p *htmlProcessor) check(body *html.Node) {
+	missingAlt := 0
+	walkElements(body, func(n *html.Node) {
+		for _, declaration := range parseCSSDeclarations(htmlAttr(n, "style")) {
+			property := declaration.property
+			if strings.HasPrefix(property, "animation") || strings.HasPrefix(property, "transition") {
+				property = strings.SplitN(property, "-", 2)[0]
+			}
+			value := strings.ToLower(declaration.value)
+			switch {
+			case unsupportedCSS[property] != "":
+				p.warn(HTMLWarningUnsupportedCSS, "%s", unsupportedCSS[property])
+			case property == "display" && strings.Contains(value, "flex"):
+				p.warn(HTMLWarningUnsupportedCSS, "Outlook on Windows and some webmail clients do not support flexbox; lay out with tables")
+			case property == "display" && strings.Contains(value, "grid"):
+				p.warn(HTMLWarningUnsupportedCSS, "Outlook on Windows and some webmail clients do not support CSS grid; lay out with tables")
+			case property == "background" && strings.Contains(value, "url("):
+				p.warn(HTMLWarningUnsupportedCSS, "%s", unsupportedCSS["background-image"])
+			}
+			if strings.Contains(value, "var(") {
+				p.warn(HTMLWarningUnsupportedCSS, "Gmail and Outlook do not support CSS variables")
+			}
+		}
+
+		switch n.DataAtom {
+		case atom.Img:
+			if _, ok := htmlAttrOK(n, "alt"); !ok {
+				missingAlt++
+			}
+			p.checkURL("image", htmlAttr(n, "src"))
+			if urlScheme(htmlAttr(n, "src")) == "data" {
+				p.warn(HTMLWarningDataImage, "Gmail does not show images embedded as data: URLs; host them or attach them inline")
+			}
+		case atom.A:
+			p.checkURL("link", htmlAttr(n, "href"))
+		}
+	})
+
+	if missingAlt == 1 {
+		p.warn(HTMLWarningMissingAlt, "an image has no alt text, which is shown when images are blocked")
+	} else if missingAlt > 1 {
+		p.warn(HTMLWarningMissingAlt, "%d images have no alt text, which is shown when images are blocked", missingAlt)
+	}
+}
+
+// checkURL warns about a relative URL, which has nothing to be relative to in an email
+func (p *htmlProcessor) checkURL(kind, value string) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.HasPrefix(value, "#") || urlScheme(value) != "" {
+		return
+	}
+	p.warn(HTMLWarningRelativeURL, "the %s %q is relative; email needs absolute URLs such as https://example.com/...", kind, value)
+}
+
+// walkElements calls fn for every element below n, in document order
+func walkElements(n *html.Node, fn func(*html.Node)) {
+	if n == nil {
+		return
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode {
+			fn(child)
+		}
+		walkElements(child, fn)
+	}
+}
+
+// findElement returns the first element of type a below n
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	var found *html.Node
+	walkElements(n, func(child *html.Node) {
+		if found == nil && child.DataAtom == a {
+			found = child
+		}
+	})
+	return found
+}
+
+// inBody reports whether n is the body or inside it
+func inBody(n *html.Node) bool {
+	for ; n != nil; n = n.Parent {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Body {
+			return true
+		}
+	}
+	return false
+}
+
+// textContent returns the text inside n
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.TextNode {
+			b.WriteString(child.Data)
+		}
+	}
+	return b.String()
+}
+
+// setTextContent replaces the content of n with text
+func setTextContent(n *html.Node, text string) {
+	for n.FirstChild != nil {
+		n.RemoveChild(n.FirstChild)
+	}
+	n.AppendChild(&html.Node{Type: html.TextNode, Data: text})
+}
+
+// htmlAttrOK returns the value of an attribute of n and whether it is set
+func htmlAttrOK(n *html.Node, name string) (string, bool) {
+	for _, attr := range n.Attr {
+		if attr.Key == name {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+// setHTMLAttr sets an attribute of n, or removes it if value is empty
+func setHTMLAttr(n *html.Node, name, value string) {
+	for i, attr := range n.Attr {
+		if attr.Key == name {
+			if value == "" {
+				n.Attr = append(n.Attr[:i], n.Attr[i+1:]...)
+			} else {
+				n.Attr[i].Val = value
+			}
+			return
+		}
+	}
+	if value != "" {
+		n.Attr = append(n.Attr, html.Attribute{Key: name, Val: value})
+	}
+}
@@ -0,0 +1,314 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+// findByID parses processed HTML and returns its element with the id, failing the test if there is none
+func findByID(t *testing.T, source, id string) *html.Node {
+	t.Helper()
+	doc, err := html.Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *html.Node
+	walkElements(doc, func(n *html.Node) {
+		if htmlAttr(n, "id") == id {
+			found = n
+		}
+	})
+	if found == nil {
+		t.Fatalf("no element with id %q in %q", id, source)
+	}
+	return found
+}
+
+func hasWarning(warnings []HTMLWarning, code string) bool {
+	for _, warning := range warnings {
+		if warning.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProcessEmailHTMLURLs(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		attr string
+		kept bool
+	}{
+		{"https link", `<a id="x" href="https://example.com/">x</a>`, "href", true},
+		{"relative link", `<a id="x" href="/unsubscribe?id=1">x</a>`, "href", true},
+		{"mailto link", `<a id="x" href="mailto:me@example.com">x</a>`, "href", true},
+		{"javascript link", `<a id="x" href="javascript:alert(1)">x</a>`, "href", false},
+		{"upper case scheme", `<a id="x" href="JaVaScRiPt:alert(1)">x</a>`, "href", false},
+		{"vbscript link", `<a id="x" href="vbscript:msgbox(1)">x</a>`, "href", false},
+		{"decimal entities", `<a id="x" href="&#106;&#97;vascript:alert(1)">x</a>`, "href", false},
+		{"hex entities", `<a id="x" href="&#x6A;avascript&#x3A;alert(1)">x</a>`, "href", false},
+		{"named entity colon", `<a id="x" href="javascript&colon;alert(1)">x</a>`, "href", false},
+		{"tab inside scheme", "<a id=\"x\" href=\"java\tscript:alert(1)\">x</a>", "href", false},
+		{"encoded tab inside scheme", `<a id="x" href="java&#9;script:alert(1)">x</a>`, "href", false},
+		{"newline inside scheme", `<a id="x" href="java&#10;script:alert(1)">x</a>`, "href", false},
+		{"leading space and control characters", `<a id="x" href=" &#1;javascript:alert(1)">x</a>`, "href", false},
+		{"data link", `<a id="x" href="data:text/html,<script>alert(1)</script>">x</a>`, "href", false},
+		{"png data image", `<img id="x" alt="" src="data:image/png;base64,iVBORw0KGgo=">`, "src", true},
+		{"svg data image", `<img id="x" alt="" src="data:image/svg+xml;base64,PHN2Zz4=">`, "src", false},
+		{"svg data image with spaces", `<img id="x" alt="" src="data: image/svg+xml,<svg onload=alert(1)>">`, "src", false},
+		{"upper case svg data image", `<img id="x" alt="" src="DATA:IMAGE/SVG+XML;base64,PHN2Zz4=">`, "src", false},
+		{"data URL outside images", `<table><tr><td id="x" background="data:image/png;base64,iVBORw0KGgo=">x</td></tr></table>`, "background", false},
+		{"javascript background", `<table><tr><td id="x" background="javascript:alert(1)">x</td></tr></table>`, "background", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, warnings := ProcessEmailHTML(tt.html)
+			_, kept := htmlAttrOK(findByID(t, out, "x"), tt.attr)
+			if kept != tt.kept {
+				t.Fatalf("ProcessEmailHTML(%q) = %q, want %s kept: %v", tt.html, out, tt.attr, tt.kept)
+			}
+			if !tt.kept && !hasWarning(warnings, HTMLWarningUnsafeURL) {
+				t.Errorf("ProcessEmailHTML(%q) warnings = %v, want %s", tt.html, warnings, HTMLWarningUnsafeURL)
+			}
+		})
+	}
+}
+
+func TestProcessEmailHTMLEventHandlers(t *testing.T) {
+	tests := []string{
+		`<div id="x" onclick="alert(1)">x</div>`,
+		`<img id="x" alt="" src="a.png" onerror="alert(1)">`,
+		`<html><body id="x" onload="alert(1)">x</body></html>`,
+		`<a id="x" href="#" ONMOUSEOVER="alert(1)">x</a>`,
+		`<div id="x" onfocus=alert(1) tabindex=1>x</div>`,
+	}
+
+	for _, source := range tests {
+		out, warnings := ProcessEmailHTML(source)
+		for _, attr := range findByID(t, out, "x").Attr {
+			if strings.HasPrefix(strings.ToLower(attr.Key), "on") {
+				t.Errorf("ProcessEmailHTML(%q) = %q, kept %s", source, out, attr.Key)
+			}
+		}
+		if !hasWarning(warnings, HTMLWarningRemovedAttribute) {
+			t.Errorf("ProcessEmailHTML(%q) warnings = %v, want %s", source, warnings, HTMLWarningRemovedAttribute)
+		}
+	}
+}
+
+func TestProcessEmailHTMLElements(t *testing.T) {
+	tests := []struct {
+		name    string
+		html    string
+		absent  string
+		present string
+	}{
+		{"script", `<p>a</p><script>alert(1)</script>`, "alert", "<p>a</p>"},
+		{"iframe", `<iframe src="https://evil.example"></iframe><p>a</p>`, "iframe", "<p>a</p>"},
+		{"svg with script", `<svg><script>alert(1)</script></svg><p>a</p>`, "alert", "<p>a</p>"},
+		{"object", `<object data="x.swf"></object>`, "object", ""},
+		{"base", `<base href="https://evil.example/"><a href="/x">x</a>`, "evil", `<a href="/x">x</a>`},
+		{"meta refresh", `<html><head><meta http-equiv="refresh" content="0;url=https://evil.example"></head><body>x</body></html>`, "refresh", "x"},
+		{"form keeps content", `<form action="https://evil.example"><p>a</p></form>`, "form", "<p>a</p>"},
+		{"unknown element keeps content", `<blink>a</blink>`, "blink", "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, warnings := ProcessEmailHTML(tt.html)
+			if strings.Contains(out, tt.absent) || !strings.Contains(out, tt.present) {
+				t.Errorf("ProcessEmailHTML(%q) = %q, want no %q and %q", tt.html, out, tt.absent, tt.present)
+			}
+			if tt.name != "unknown element keeps content" && !hasWarning(warnings, HTMLWarningRemovedElement) {
+				t.Errorf("ProcessEmailHTML(%q) warnings = %v, want %s", tt.html, warnings, HTMLWarningRemovedElement)
+			}
+		})
+	}
+}
+
+func TestProcessEmailHTMLUnsafeCSS(t *testing.T) {
+	tests := []struct {
+		name  string
+		style string
+		want  string
+	}{
+		{"safe", "color: red; padding: 4px", "color: red; padding: 4px"},
+		{"expression", "color: red; width: expression(alert(1))", "color: red"},
+		{"expression with space", "width: EXPRESSION (alert(1)); color: red", "color: red"},
+		{"url javascript", "color: red; background: url(javascript:alert(1))", "color: red"},
+		{"quoted url javascript", `background-image: url("javascript:alert(1)"); color: red`, "color: red"},
+		{"url with spaces in scheme", "background: url(' java script:alert(1)'); color: red", "color: red"},
+		{"url svg data", "background: url(data:image/svg+xml;base64,PHN2Zz4=); color: red", "color: red"},
+		{"url png data", "background: url(data:image/png;base64,iVBORw0KGgo=)", "background: url(data:image/png;base64,iVBORw0KGgo=)"},
+		{"url https", "background: url(https://example.com/bg.png)", "background: url(https://example.com/bg.png)"},
+		{"css escapes", `background: url(\6a avascript:alert(1)); color: red`, "color: red"},
+		{"behavior", "behavior: url(x.htc); color: red", "color: red"},
+		{"moz binding", "-moz-binding: url(x.xml#xss); color: red", "color: red"},
+		{"only unsafe", "width: expression(alert(1))", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := `<div id="x" style="` + strings.ReplaceAll(tt.style, `"`, "&quot;") + `">x</div>`
+			out, warnings := ProcessEmailHTML(source)
+			got, ok := htmlAttrOK(findByID(t, out, "x"), "style")
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("style %q became %q (present: %v), want %q", tt.style, got, ok, tt.want)
+			}
+			if tt.want != tt.style && !hasWarning(warnings, HTMLWarningUnsafeCSS) {
+				t.Errorf("style %q warnings = %v, want %s", tt.style, warnings, HTMLWarningUnsafeCSS)
+			}
+		})
+	}
+}
+
+func TestProcessEmailHTMLUnsafeStyleSheet(t *testing.T) {
+	source := `<style>
+@import url(https://evil.example/x.css);
+@media (max-width: 600px) { .a { width: expression(alert(1)) } }
+.b:hover { background: url(javascript:alert(1)); color: red }
+</style><p class="a b">x</p>`
+
+	out, warnings := ProcessEmailHTML(source)
+	for _, unsafe := range []string{"@import", "expression", "javascript"} {
+		if strings.Contains(out, unsafe) {
+			t.Errorf("ProcessEmailHTML kept %s: %q", unsafe, out)
+		}
+	}
+	if !strings.Contains(out, ".b:hover { color: red }") {
+		t.Errorf("ProcessEmailHTML(%q) = %q, want the safe part of the :hover rule kept", source, out)
+	}
+	if !hasWarning(warnings, HTMLWarningUnsafeCSS) {
+		t.Errorf("warnings = %v, want %s", warnings, HTMLWarningUnsafeCSS)
+	}
+}
+
+func TestProcessEmailHTMLInlineCascade(t *testing.T) {
+	tests := []struct {
+		name  string
+		css   string
+		attrs string
+		want  string
+	}{
+		{"type selector", "p { color: red }", ``, "color: red"},
+		{"later rule wins", "p { color: red } p { color: blue }", ``, "color: blue"},
+		{"class beats type", ".c { color: blue } p { color: red }", `class="c"`, "color: blue"},
+		{"id beats class", "#x { color: green } .c { color: blue }", `class="c"`, "color: green"},
+		{"more classes win", ".c.d { color: blue } .c { color: red }", `class="c d"`, "color: blue"},
+		{"descendant adds specificity", "div p { color: blue } p { color: red }", ``, "color: blue"},
+		{"style attribute beats rules", "#x { color: green }", `style="color: black"`, "color: black"},
+		{"important beats style attribute", "p { color: red !important }", `style="color: black"`, "color: red !important"},
+		{"important beats specificity", "p { color: red !important } #x { color: green }", ``, "color: red !important"},
+		{"important style attribute beats important rule", "#x { color: green !important }", `style="color: black !important"`, "color: black !important"},
+		{"later important rule wins", "p { color: red !important } p { color: blue !important }", ``, "color: blue !important"},
+		{"properties merge", "p { color: red } .c { padding: 4px }", `class="c" style="margin: 0"`, "color: red; padding: 4px; margin: 0"},
+		{"shorthand after longhand", "p { margin-top: 8px } .c { margin: 0 }", `class="c"`, "margin-top: 8px; margin: 0"},
+		{"overridden property moves last", "p { margin: 0; margin-top: 4px } .c { margin: 2px }", `class="c"`, "margin-top: 4px; margin: 2px"},
+		{"selector lists", "h1, p { color: red }", ``, "color: red"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := "<style>" + tt.css + `</style><div><p id="x" ` + tt.attrs + ">x</p></div>"
+			out, _ := ProcessEmailHTML(source)
+			if got := htmlAttr(findByID(t, out, "x"), "style"); got != tt.want {
+				t.Errorf("inlining %q into <p %s> gave style %q, want %q", tt.css, tt.attrs, got, tt.want)
+			}
+			if strings.Contains(out, "<style") {
+				t.Errorf("ProcessEmailHTML(%q) = %q, want every rule inlined", source, out)
+			}
+		})
+	}
+}
+
+func TestProcessEmailHTMLKeepsStyleSheet(t *testing.T) {
+	source := `<html><head><style>
+p { color: red }
+p:hover { color: blue }
+@media (max-width: 600px) { p { font-size: 18px } }
+</style></head><body><p id="x">x</p></body></html>`
+
+	out, warnings := ProcessEmailHTML(source)
+	if got := htmlAttr(findByID(t, out, "x"), "style"); got != "color: red" {
+		t.Errorf("style = %q, want color: red", got)
+	}
+	for _, kept := range []string{"p:hover { color: blue }", "@media (max-width: 600px)"} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("ProcessEmailHTML(%q) = %q, want %q kept in a style element", source, out, kept)
+		}
+	}
+	if !hasWarning(warnings, HTMLWarningStyleKept) {
+		t.Errorf("warnings = %v, want %s", warnings, HTMLWarningStyleKept)
+	}
+}
+
+func TestCascadeCSS(t *testing.T) {
+	low, high := cascadia.Specificity{0, 0, 1}, cascadia.Specificity{0, 1, 0}
+	decl := func(property, value string, important bool) cssDeclaration {
+		return cssDeclaration{property: property, value: value, important: important}
+	}
+
+	tests := []struct {
+		name    string
+		matched []cssMatch
+		inline  []cssDeclaration
+		want    []cssDeclaration
+	}{
+		{
+			"later match overrides earlier",
+			[]cssMatch{
+				{low, 1, []cssDeclaration{decl("color", "red", false)}},
+				{high, 2, []cssDeclaration{decl("color", "blue", false)}},
+			},
+			nil,
+			[]cssDeclaration{decl("color", "blue", false)},
+		},
+		{
+			"inline overrides matches",
+			[]cssMatch{{high, 1, []cssDeclaration{decl("color", "red", false), decl("margin", "0", false)}}},
+			[]cssDeclaration{decl("color", "black", false)},
+			[]cssDeclaration{decl("margin", "0", false), decl("color", "black", false)},
+		},
+		{
+			"important match overrides inline",
+			[]cssMatch{{low, 1, []cssDeclaration{decl("color", "red", true)}}},
+			[]cssDeclaration{decl("color", "black", false)},
+			[]cssDeclaration{decl("color", "red", true)},
+		},
+		{
+			"important match overrides later normal match",
+			[]cssMatch{
+				{low, 1, []cssDeclaration{decl("color", "red", true)}},
+				{high, 2, []cssDeclaration{decl("color", "blue", false)}},
+			},
+			nil,
+			[]cssDeclaration{decl("color", "red", true)},
+		},
+		{
+			"important inline overrides important match",
+			[]cssMatch{{high, 1, []cssDeclaration{decl("color", "red", true)}}},
+			[]cssDeclaration{decl("color", "black", true)},
+			[]cssDeclaration{decl("color", "black", true)},
+		},
+		{
+			"last declaration in a rule wins",
+			[]cssMatch{{low, 1, []cssDeclaration{decl("color", "red", false), decl("color", "blue", false)}}},
+			nil,
+			[]cssDeclaration{decl("color", "blue", false)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cascadeCSS(tt.matched, tt.inline); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cascadeCSS() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
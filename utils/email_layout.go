@@ -0,0 +1,424 @@
+package utils
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Block types of an email layout
+const (
+	LayoutHeader  = "header"
+	LayoutText    = "text"
+	LayoutImage   = "image"
+	LayoutButton  = "button"
+	LayoutColumns = "columns"
+	LayoutDivider = "divider"
+	LayoutFooter  = "footer"
+)
+
+// Limits and defaults of email layouts
+const (
+	DefaultLayoutWidth = 600
+	MinLayoutWidth     = 320
+	MaxLayoutWidth     = 800
+	MaxLayoutColumns   = 4
+
+	defaultLayoutFont            = "Arial, Helvetica, sans-serif"
+	defaultLayoutTextColor       = "#333333"
+	defaultLayoutBackgroundColor = "#f4f4f4"
+	defaultLayoutContentColor    = "#ffffff"
+	defaultButtonColor           = "#2563eb"
+	defaultButtonTextColor       = "#ffffff"
+	defaultDividerColor          = "#e5e7eb"
+	defaultFooterColor           = "#6b7280"
+)
+
+// EmailLayout is an email built from blocks, which RenderEmailLayout renders
+// as table-based HTML that stacks its columns on small screens. The text and
+// links of the blocks are merge templates, filled in when the email is sent.
+type EmailLayout struct {
+	Width           int           `json:"width,omitempty"`            // Width of the content in pixels, 600 if unset
+	BackgroundColor string        `json:"background_color,omitempty"` // Around the content
+	ContentColor    string        `json:"content_color,omitempty"`    // Behind the content
+	TextColor       string        `json:"text_color,omitempty"`
+	FontFamily      string        `json:"font_family,omitempty"`
+	Preheader       string        `json:"preheader,omitempty"` // Preview text inboxes show after the subject
+	Blocks          []LayoutBlock `json:"blocks"`
+}
+
+// LayoutBlock is one block of a layout. Which fields apply depends on its type:
+//   - header: text as a heading, and an optional logo from src, alt and href
+//   - text: text as Markdown
+//   - image: src, alt, an optional href and a width in pixels
+//   - button: text linking to href, in background_color
+//   - columns: columns side by side, each with its own blocks
+//   - divider: a line in color
+//   - footer: text as Markdown, in small print
+type LayoutBlock struct {
+	Type            string         `json:"type"`
+	Text            string         `json:"text,omitempty"`
+	Src             string         `json:"src,omitempty"`
+	Alt             string         `json:"alt,omitempty"`
+	Href            string         `json:"href,omitempty"`
+	Width           int            `json:"width,omitempty"`
+	Align           string         `json:"align,omitempty"` // left, center or right
+	Color           string         `json:"color,omitempty"` // Of the text, or of the line of a divider
+	BackgroundColor string         `json:"background_color,omitempty"`
+	Columns         []LayoutColumn `json:"columns,omitempty"`
+}
+
+// LayoutColumn is one column of a columns block
+type LayoutColumn struct {
+	Blocks []LayoutBlock `json:"blocks"`
+}
+
+var (
+	// layoutColor matches the colors a layout may use: hex or a color name
+	layoutColor = regexp.MustCompile(`^(#[0-9a-fA-F]{3}|#[0-9a-fA-F]{6}|[a-zA-Z]+)$`)
+
+	// layoutFont matches a font-family list
+	layoutFont = regexp.MustCompile(`^[\w\s,'"-]+$`)
+
+	// mergeTag matches the tags of a merge template, such as {{name}}
+	mergeTag = regexp.MustCompile(`(?s)\{\{.*?\}\}`)
+)
+
+// ValidateEmailLayout checks a layout, reporting errors on the fields under field
+func ValidateEmailLayout(field string, layout *EmailLayout) ValidationErrors {
+	var errs ValidationErrors
+
+	if layout.Width != 0 && (layout.Width < MinLayoutWidth || layout.Width > MaxLayoutWidth) {
+		errs.Add(field+".width", "must be between %d and %d pixels", MinLayoutWidth, MaxLayoutWidth)
+	}
+	errs = append(errs, validateLayoutColor(field+".background_color", layout.BackgroundColor)...)
+	errs = append(errs, validateLayoutColor(field+".content_color", layout.ContentColor)...)
+	errs = append(errs, validateLayoutColor(field+".text_color", layout.TextColor)...)
+	if _, err := ParseTemplate(layout.Preheader); err != nil {
+		errs.Add(field+".preheader", "%v", err)
+	}
+	if layout.FontFamily != "" && !layoutFont.MatchString(layout.FontFamily) {
+		errs.Add(field+".font_family", "must be a list of font names")
+	}
+	if len(layout.Blocks) == 0 {
+		errs.Add(field+".blocks", "at least one block is required")
+	}
+
+	for i, block := range layout.Blocks {
+		errs = append(errs, validateLayoutBlock(fmt.Sprintf("%s.blocks[%d]", field, i), &block, layoutWidth(layout), true)...)
+	}
+	return errs
+}
+
+func validateLayoutBlock(field string, block *LayoutBlock, width int, columnsAllowed bool) ValidationErrors {
+	var errs ValidationErrors
+
+	switch block.Type {
+	case LayoutHeader:
+		if strings.TrimSpace(block.Text) == "" && block.Src == "" {
+			errs.Add(field+".text", "a header needs text or a logo in src")
+		}
+	case LayoutText, LayoutFooter:
+		if strings.TrimSpace(block.Text) == "" {
+			errs.Add(field+".text", "text is required")
+		}
+	case LayoutImage:
+		if block.Src == "" {
+			errs.Add(field+".src", "src is required")
+		}
+	case LayoutButton:
+		if strings.TrimSpace(block.Text) == "" {
+			errs.Add(field+".text", "text is required")
+		}
+		if block.Href == "" {
+			errs.Add(field+".href", "href is required")
+		}
+	case LayoutColumns:
+		if !columnsAllowed {
+			errs.Add(field+".type", "columns cannot be nested")
+			return errs
+		}
+		if len(block.Columns) < 2 || len(block.Columns) > MaxLayoutColumns {
+			errs.Add(field+".columns", "must have between 2 and %d columns", MaxLayoutColumns)
+		}
+		for i, column := range block.Columns {
+			if len(column.Blocks) == 0 {
+				errs.Add(fmt.Sprintf("%s.columns[%d].blocks", field, i), "at least one block is required")
+			}
+			for j, child := range column.Blocks {
+				childField := fmt.Sprintf("%s.columns[%d].blocks[%d]", field, i, j)
+				errs = append(errs, validateLayoutBlock(childField, &child, layoutColumnWidth(width, len(block.Columns)), false)...)
+			}
+		}
+	case LayoutDivider:
+	default:
+		errs.Add(field+".type", "must be header, text, image, button, columns, divider or footer")
+		return errs
+	}
+
+	if block.Src != "" && !layoutURL(block.Src, "http", "https", "cid") {
+		errs.Add(field+".src", "must be an http or https URL, or a merge field such as {{logo_url}}")
+	}
+	if block.Href != "" && !layoutURL(block.Href, "http", "https", "mailto", "tel") {
+		errs.Add(field+".href", "must be an http, https, mailto or tel URL, or a merge field such as {{link}}")
+	}
+	if block.Width < 0 || block.Width > width {
+		errs.Add(field+".width", "must be at most %d pixels, the width it is shown in", width)
+	}
+	if block.Align != "" && block.Align != "left" && block.Align != "center" && block.Align != "right" {
+		errs.Add(field+".align", "must be left, center or right")
+	}
+	errs = append(errs, validateLayoutColor(field+".color", block.Color)...)
+	errs = append(errs, validateLayoutColor(field+".background_color", block.BackgroundColor)...)
+
+	// Report merge tags that do not parse on the field they are written in,
+	// rather than on the HTML the layout renders to
+	fields := []struct{ name, value string }{{"text", block.Text}, {"src", block.Src}, {"alt", block.Alt}, {"href", block.Href}}
+	for _, f := range fields {
+		if _, err := ParseTemplate(f.value); err != nil {
+			errs.Add(field+"."+f.name, "%v", err)
+		}
+	}
+	return errs
+}
+
+func validateLayoutColor(field, color string) ValidationErrors {
+	if color == "" || layoutColor.MatchString(color) {
+		return nil
+	}
+	return ValidationErrors{{Field: field, Message: "must be a hex color such as #1a73e8 or a color name"}}
+}
+
+// layoutURL reports whether a URL of a block is absolute with one of schemes,
+// or starts with a merge tag that fills it in when sent
+func layoutURL(value string, schemes ...string) bool {
+	if strings.HasPrefix(strings.TrimSpace(value), "{{") {
+		return true
+	}
+	scheme := urlScheme(value)
+	for _, allowed := range schemes {
+		if scheme == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func layoutWidth(layout *EmailLayout) int {
+	if layout.Width == 0 {
+		return DefaultLayoutWidth
+	}
+	return layout.Width
+}
+
+// layoutColumnWidth is the width of each of n columns in a block width pixels
+// wide, less the padding around them
+func layoutColumnWidth(width, n int) int {
+	return (width - 24) / n
+}
+
+// layoutStyles stacks the columns on small screens, and spaces the Markdown
+// of text blocks. ProcessEmailHTML inlines what it can when the email is sent.
+const layoutStyles = `
+.layout-text p, .layout-text ul, .layout-text ol { margin: 0 0 12px 0; }
+.layout-text h1, .layout-text h2, .layout-text h3 { margin: 0 0 12px 0; line-height: 1.3; }
+.layout-text a { color: %[1]s; }
+@media only screen and (max-width: %[2]dpx) {
+  .layout-container { width: 100%% !important; }
+  .layout-column { display: block !important; width: 100%% !important; }
+  .layout-fluid { width: 100%% !important; height: auto !important; }
+}
+`
+
+// RenderEmailLayout renders a layout as a table-based HTML document that
+// stacks its columns on small screens. Its merge tags are kept as written, for
+// the HTML to be filled in as a merge template.
+func RenderEmailLayout(layout *EmailLayout) (string, error) {
+	width := layoutWidth(layout)
+	textColor := layoutDefault(layout.TextColor, defaultLayoutTextColor)
+	font := layoutDefault(layout.FontFamily, defaultLayoutFont)
+
+	r := &layoutRenderer{textColor: textColor, font: font}
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n")
+	b.WriteString(`<meta charset="utf-8">` + "\n")
+	b.WriteString(`<meta name="viewport" content="width=device-width, initial-scale=1">` + "\n")
+	fmt.Fprintf(&b, "<style>%s</style>\n", fmt.Sprintf(layoutStyles, defaultButtonColor, width+20))
+	b.WriteString("</head>\n")
+
+	background := layoutDefault(layout.BackgroundColor, defaultLayoutBackgroundColor)
+	fmt.Fprintf(&b, `<body style="margin: 0; padding: 0; background-color: %s;">`+"\n", background)
+	if layout.Preheader != "" {
+		fmt.Fprintf(&b, `<div style="display: none; max-height: 0; overflow: hidden; mso-hide: all;">%s</div>`+"\n", layoutText(layout.Preheader))
+	}
+	fmt.Fprintf(&b, `<table role="presentation" width="100%%" cellpadding="0" cellspacing="0" border="0" bgcolor="%s">`+"\n", background)
+	b.WriteString(`<tr><td align="center" style="padding: 24px 0;">` + "\n")
+	fmt.Fprintf(&b, `<table role="presentation" class="layout-container" width="%d" cellpadding="0" cellspacing="0" border="0" bgcolor="%s" style="width: %dpx; font-family: %s; color: %s;">`+"\n",
+		width, layoutDefault(layout.ContentColor, defaultLayoutContentColor), width, font, textColor)
+
+	for _, block := range layout.Blocks {
+		if err := r.block(&b, &block, width); err != nil {
+			return "", err
+		}
+	}
+
+	b.WriteString("</table>\n</td></tr>\n</table>\n</body>\n</html>\n")
+	return b.String(), nil
+}
+
+// layoutRenderer renders the blocks of a layout as table rows
+type layoutRenderer struct {
+	textColor string
+	font      string
+}
+
+// block writes a block as a row of a table width pixels wide
+func (r *layoutRenderer) block(b *strings.Builder, block *LayoutBlock, width int) error {
+	align := layoutDefault(block.Align, "left")
+	cell := func(padding, style string) {
+		fmt.Fprintf(b, `<tr><td align="%s" style="padding: %s;%s">`, align, padding, style)
+	}
+
+	switch block.Type {
+	case LayoutHeader:
+		align = layoutDefault(block.Align, "center")
+		style := ""
+		if block.BackgroundColor != "" {
+			style = " background-color: " + block.BackgroundColor + ";"
+		}
+		cell("24px", style)
+		if block.Src != "" {
+			logoWidth := block.Width
+			if logoWidth == 0 {
+				logoWidth = 160
+			}
+			r.image(b, block, logoWidth)
+		}
+		if strings.TrimSpace(block.Text) != "" {
+			margin := "0"
+			if block.Src != "" {
+				margin = "12px 0 0 0"
+			}
+			fmt.Fprintf(b, `<h1 style="margin: %s; font-size: 26px; line-height: 1.3; color: %s;">%s</h1>`,
+				margin, layoutDefault(block.Color, r.textColor), layoutText(block.Text))
+		}
+
+	case LayoutText, LayoutFooter:
+		content, err := layoutMarkdown(block.Text)
+		if err != nil {
+			return err
+		}
+		style := fmt.Sprintf(" font-size: 16px; line-height: 1.5; color: %s;", layoutDefault(block.Color, r.textColor))
+		padding := "12px 24px"
+		if block.Type == LayoutFooter {
+			align = layoutDefault(block.Align, "center")
+			style = fmt.Sprintf(" font-size: 12px; line-height: 1.5; color: %s;", layoutDefault(block.Color, defaultFooterColor))
+			padding = "24px"
+		}
+		if block.BackgroundColor != "" {
+			style += " background-color: " + block.BackgroundColor + ";"
+		}
+		cell(padding, style)
+		fmt.Fprintf(b, `<div class="layout-text">%s</div>`, content)
+
+	case LayoutImage:
+		align = layoutDefault(block.Align, "center")
+		cell("12px 24px", "")
+		imageWidth := block.Width
+		if imageWidth == 0 || imageWidth > width-48 {
+			imageWidth = width - 48
+		}
+		r.image(b, block, imageWidth)
+
+	case LayoutButton:
+		align = layoutDefault(block.Align, "center")
+		color := layoutDefault(block.BackgroundColor, defaultButtonColor)
+		cell("12px 24px", "")
+		fmt.Fprintf(b, `<table role="presentation" cellpadding="0" cellspacing="0" border="0" align="%s"><tr>`, align)
+		fmt.Fprintf(b, `<td bgcolor="%s" style="border-radius: 6px; background-color: %s;">`, color, color)
+		fmt.Fprintf(b, `<a href="%s" target="_blank" style="display: inline-block; padding: 12px 24px; font-family: %s; font-size: 16px; font-weight: bold; color: %s; text-decoration: none; border-radius: 6px;">%s</a>`,
+			layoutText(block.Href), r.font, layoutDefault(block.Color, defaultButtonTextColor), layoutText(block.Text))
+		b.WriteString("</td></tr></table>")
+
+	case LayoutColumns:
+		if len(block.Columns) == 0 {
+			return fmt.Errorf("layout columns block has no columns")
+		}
+		columnWidth := layoutColumnWidth(width, len(block.Columns))
+		cell("0 12px", "")
+		b.WriteString(`<table role="presentation" width="100%" cellpadding="0" cellspacing="0" border="0"><tr>`)
+		for _, column := range block.Columns {
+			fmt.Fprintf(b, `<td class="layout-column" width="%d" valign="top" style="width: %dpx;">`, columnWidth, columnWidth)
+			b.WriteString(`<table role="presentation" width="100%" cellpadding="0" cellspacing="0" border="0">`)
+			for _, child := range column.Blocks {
+				if err := r.block(b, &child, columnWidth); err != nil {
+					return err
+				}
+			}
+			b.WriteString("</table></td>")
+		}
+		b.WriteString("</tr></table>")
+
+	case LayoutDivider:
+		cell("12px 24px", "")
+		fmt.Fprintf(b, `<table role="presentation" width="100%%" cellpadding="0" cellspacing="0" border="0"><tr><td style="border-top: 1px solid %s; font-size: 0; line-height: 0;">&nbsp;</td></tr></table>`,
+			layoutDefault(block.Color, defaultDividerColor))
+
+	default:
+		return fmt.Errorf("unknown layout block type %q", block.Type)
+	}
+
+	b.WriteString("</td></tr>\n")
+	return nil
+}
+
+// image writes the image of a block, linked to its href if it has one. It
+// shrinks to the screen on small screens.
+func (r *layoutRenderer) image(b *strings.Builder, block *LayoutBlock, width int) {
+	img := fmt.Sprintf(`<img src="%s" alt="%s" width="%d" class="layout-fluid" style="display: block; width: %dpx; height: auto; border: 0; outline: none; text-decoration: none;">`,
+		layoutText(block.Src), layoutText(block.Alt), width, width)
+	if block.Href != "" {
+		img = fmt.Sprintf(`<a href="%s" target="_blank">%s</a>`, layoutText(block.Href), img)
+	}
+	b.WriteString(img)
+}
+
+// layoutText escapes text for HTML, leaving its merge tags as written
+func layoutText(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range mergeTag.FindAllStringIndex(text, -1) {
+		b.WriteString(html.EscapeString(text[last:loc[0]]))
+		b.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
+
+// layoutMarkdown renders Markdown, leaving its merge tags as written. Tags are
+// swapped for placeholders while rendering, so Markdown does not escape them.
+func layoutMarkdown(text string) (string, error) {
+	var tags []string
+	protected := mergeTag.ReplaceAllStringFunc(text, func(tag string) string {
+		tags = append(tags, tag)
+		return fmt.Sprintf("mergetag%dplaceholder", len(tags)-1)
+	})
+
+	rendered, err := RenderMarkdown(protected)
+	if err != nil {
+		return "", err
+	}
+	for i := len(tags) - 1; i >= 0; i-- {
+		rendered = strings.ReplaceAll(rendered, fmt.Sprintf("mergetag%dplaceholder", i), tags[i])
+	}
+	return rendered, nil
+}
+
+func layoutDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// GmailErrorKind classifies why a Gmail API call failed, which decides whether it is retried
+type GmailErrorKind string
+
+const (
+	// GmailErrorRateLimit means too many requests in a short time; retry after backing off
+	GmailErrorRateLimit GmailErrorKind = "rate_limit"
+
+	// GmailErrorDailyLimit means the account's daily sending quota is used up
+	GmailErrorDailyLimit GmailErrorKind = "daily_limit"
+
+	// GmailErrorServer is a temporary failure on Google's side
+	GmailErrorServer GmailErrorKind = "server"
+
+	// GmailErrorNetwork means the API could not be reached
+	GmailErrorNetwork GmailErrorKind = "network"
+
+	// GmailErrorAuth means the stored credentials were rejected
+	GmailErrorAuth GmailErrorKind = "auth"
+
+	// GmailErrorPermanent is any other failure; sending the same message again fails the same way
+	GmailErrorPermanent GmailErrorKind = "permanent"
+)
+
+// ClassifyGmailError reports the kind of a failed Gmail API call. SMTP replies
+// from the SMTP transport are classified the same way.
+func ClassifyGmailError(err error) GmailErrorKind {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		reasons := make(map[string]bool, len(apiErr.Errors))
+		for _, item := range apiErr.Errors {
+			reasons[item.Reason] = true
+		}
+
+		// quotaExceeded is also reported for short-term quotas, such as
+		// concurrent requests, so only a daily reason or message pauses sending for the day
+		switch {
+		case reasons["dailyLimitExceeded"] || namesDailySendingLimit(apiErr.Message):
+			return GmailErrorDailyLimit
+		case apiErr.Code == http.StatusTooManyRequests || reasons["rateLimitExceeded"] ||
+			reasons["userRateLimitExceeded"] || reasons["quotaExceeded"]:
+			return GmailErrorRateLimit
+		case apiErr.Code >= http.StatusInternalServerError || reasons["backendError"]:
+			return GmailErrorServer
+		case apiErr.Code == http.StatusUnauthorized || reasons["authError"]:
+			return GmailErrorAuth
+		}
+		return GmailErrorPermanent
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		if retrieveErr.Response != nil && retrieveErr.Response.StatusCode >= http.StatusInternalServerError {
+			return GmailErrorServer
+		}
+		return GmailErrorAuth
+	}
+
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		switch {
+		case smtpErr.Code == 452: // Too many recipients or messages for now
+			return GmailErrorRateLimit
+		case smtpErr.Code >= 400 && smtpErr.Code < 500:
+			return GmailErrorServer
+		case smtpErr.Code == 530 || smtpErr.Code == 534 || smtpErr.Code == 535:
+			return GmailErrorAuth
+		}
+		return GmailErrorPermanent
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return GmailErrorNetwork
+	}
+	return GmailErrorPermanent
+}
+
+// namesDailySendingLimit reports whether a Gmail error message is about the
+// daily sending limit, e.g. "Daily user sending quota exceeded"
+func namesDailySendingLimit(message string) bool {
+	message = strings.ToLower(message)
+	return strings.Contains(message, "daily") &&
+		(strings.Contains(message, "sending quota") || strings.Contains(message, "sending limit") || strings.Contains(message, "limit exceeded"))
+}
+
+// IsTransientSendError reports whether a failed send may succeed when retried
+// later: rate and quota limits, Gmail server errors and network failures
+func IsTransientSendError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch ClassifyGmailError(err) {
+	case GmailErrorRateLimit, GmailErrorDailyLimit, GmailErrorServer, GmailErrorNetwork:
+		return true
+	}
+	return false
+}
+
+// RetryAfter returns how long Gmail asked to wait before retrying, from the
+// Retry-After header or the "Retry after <time>" hint in the error message.
+// It returns 0 when the error carries no hint.
+func RetryAfter(err error) time.Duration {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return 0
+	}
+
+	if value := apiErr.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return positiveDuration(time.Until(at))
+		}
+	}
+
+	const hint = "retry after "
+	message := strings.ToLower(apiErr.Message)
+	if i := strings.Index(message, hint); i >= 0 {
+		fields := strings.Fields(apiErr.Message[i+len(hint):])
+		if len(fields) > 0 {
+			if at, err := time.Parse(time.RFC3339, strings.TrimRight(fields[0], ".,")); err == nil {
+				return positiveDuration(time.Until(at))
+			}
+		}
+	}
+	return 0
+}
+
+func positiveDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"net/textproto"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassifyGmailError(t *testing.T) {
+	apiError := func(code int, reason, message string) error {
+		err := &googleapi.Error{Code: code, Message: message}
+		if reason != "" {
+			err.Errors = []googleapi.ErrorItem{{Reason: reason, Message: message}}
+		}
+		return err
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want GmailErrorKind
+	}{
+		{"daily limit reason", apiError(http.StatusForbidden, "dailyLimitExceeded", "Daily Limit Exceeded"), GmailErrorDailyLimit},
+		{"daily sending quota message", apiError(http.StatusForbidden, "", "Daily user sending quota exceeded."), GmailErrorDailyLimit},
+		{"quota exceeded", apiError(http.StatusForbidden, "quotaExceeded", "Quota exceeded for quota metric 'Queries'"), GmailErrorRateLimit},
+		{"too many requests", apiError(http.StatusTooManyRequests, "", "Too many concurrent requests for user"), GmailErrorRateLimit},
+		{"user rate limit", apiError(http.StatusForbidden, "userRateLimitExceeded", "User-rate limit exceeded"), GmailErrorRateLimit},
+		{"server error", apiError(http.StatusServiceUnavailable, "backendError", "Backend Error"), GmailErrorServer},
+		{"unauthorized", apiError(http.StatusUnauthorized, "authError", "Invalid Credentials"), GmailErrorAuth},
+		{"bad request", apiError(http.StatusBadRequest, "invalidArgument", "Invalid To header"), GmailErrorPermanent},
+		{"smtp busy", &textproto.Error{Code: 452, Msg: "Too many messages"}, GmailErrorRateLimit},
+		{"smtp temporary", &textproto.Error{Code: 421, Msg: "Try again later"}, GmailErrorServer},
+		{"smtp auth", &textproto.Error{Code: 535, Msg: "Bad credentials"}, GmailErrorAuth},
+		{"other", errors.New("boom"), GmailErrorPermanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyGmailError(tt.err); got != tt.want {
+				t.Errorf("ClassifyGmailError(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
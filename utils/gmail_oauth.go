@@ -49,7 +49,7 @@ func GetGmailRefreshToken(code, redirectURL string) (*GoogleTokenResponse, error
 	data.Set("grant_type", "authorization_code")
 
 	resp, err := http.Post(
-		"https://oauth2.googleapis.com/token",
+		GetGoogleEndpoints().TokenURL,
 		"application/x-www-form-urlencoded",
 		bytes.NewBufferString(data.Encode()),
 	)
@@ -73,3 +73,30 @@ func GetGmailRefreshToken(code, redirectURL string) (*GoogleTokenResponse, error
 
 	return &tokenResp, nil
 }
+
+// GoogleUserInfo is the profile of the Google account an access token belongs to
+type GoogleUserInfo struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// GetGoogleUserInfo looks up the Google account an access token was granted by.
+// The token needs the userinfo.email scope.
+func GetGoogleUserInfo(accessToken string) (*GoogleUserInfo, error) {
+	resp, err := http.Get(GetGoogleEndpoints().APIURL + "oauth2/v2/userinfo?access_token=" + url.QueryEscape(accessToken))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user info: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("user info request failed with status: %d", resp.StatusCode)
+	}
+
+	var userInfo GoogleUserInfo
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		return nil, fmt.Errorf("failed to decode user info: %v", err)
+	}
+	return &userInfo, nil
+}
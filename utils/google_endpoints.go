@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// Google's production endpoints
+const (
+	defaultGoogleAuthURL  = "https://accounts.google.com/o/oauth2/auth"
+	defaultGoogleTokenURL = "https://oauth2.googleapis.com/token"
+	defaultGoogleAPIURL   = "https://www.googleapis.com/"
+	defaultGoogleGmailURL = "https://gmail.googleapis.com/"
+)
+
+// GoogleEndpoints are the URLs of the Google services the server calls
+type GoogleEndpoints struct {
+	AuthURL  string // OAuth consent page
+	TokenURL string // OAuth code exchange and token refresh
+	APIURL   string // Base URL of the userinfo and tokeninfo endpoints
+	GmailURL string // Base URL of the Gmail API
+}
+
+var (
+	googleEndpointsMu       sync.RWMutex
+	googleEndpointsOverride *GoogleEndpoints
+)
+
+// GetGoogleEndpoints returns the endpoints set with SetGoogleEndpoints, or
+// else Google's own, each of which can be replaced with GOOGLE_AUTH_URL,
+// GOOGLE_TOKEN_URL, GOOGLE_API_URL and GOOGLE_GMAIL_URL
+func GetGoogleEndpoints() GoogleEndpoints {
+	googleEndpointsMu.RLock()
+	defer googleEndpointsMu.RUnlock()
+
+	endpoints := GoogleEndpoints{
+		AuthURL:  envOrDefault("GOOGLE_AUTH_URL", defaultGoogleAuthURL),
+		TokenURL: envOrDefault("GOOGLE_TOKEN_URL", defaultGoogleTokenURL),
+		APIURL:   envOrDefault("GOOGLE_API_URL", defaultGoogleAPIURL),
+		GmailURL: envOrDefault("GOOGLE_GMAIL_URL", defaultGoogleGmailURL),
+	}
+	if googleEndpointsOverride != nil {
+		endpoints = *googleEndpointsOverride
+	}
+
+	// The API clients append paths such as "gmail/v1/..." to the base URLs
+	endpoints.APIURL = withTrailingSlash(endpoints.APIURL)
+	endpoints.GmailURL = withTrailingSlash(endpoints.GmailURL)
+	return endpoints
+}
+
+// SetGoogleEndpoints points the server at other Google endpoints, such as a
+// fake in tests. Passing nil restores the configured ones.
+func SetGoogleEndpoints(endpoints *GoogleEndpoints) {
+	googleEndpointsMu.Lock()
+	defer googleEndpointsMu.Unlock()
+
+	if endpoints == nil {
+		googleEndpointsOverride = nil
+		return
+	}
+	override := *endpoints
+	googleEndpointsOverride = &override
+}
+
+// OAuthEndpoint returns the OAuth endpoint of an oauth2.Config
+func (e GoogleEndpoints) OAuthEndpoint() oauth2.Endpoint {
+	return oauth2.Endpoint{
+		AuthURL:   e.AuthURL,
+		TokenURL:  e.TokenURL,
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+}
+
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func withTrailingSlash(url string) string {
+	if strings.HasSuffix(url, "/") {
+		return url
+	}
+	return url + "/"
+}
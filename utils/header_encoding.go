@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxHeaderLineLength is the line length RFC 5322 recommends headers are folded at
+const maxHeaderLineLength = 78
+
+// EncodeHeaderText encodes free text such as a subject or display name as
+// RFC 2047 encoded-words when it contains non-ASCII characters.
+// Mostly-ASCII text (e.g. Portuguese) uses Q encoding so it stays readable,
+// while mostly non-ASCII text (e.g. Japanese) uses the more compact B encoding.
+func EncodeHeaderText(value string) string {
+	if isASCII(value) {
+		return value
+	}
+
+	nonASCII := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf {
+			nonASCII++
+		}
+	}
+
+	if nonASCII*3 > len(value) {
+		return mime.BEncoding.Encode("UTF-8", value)
+	}
+	return mime.QEncoding.Encode("UTF-8", value)
+}
+
+// DecodeHeaderText reverses EncodeHeaderText, returning value unchanged if it cannot be decoded
+func DecodeHeaderText(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// foldHeader formats a header field, folding the value at whitespace so lines
+// stay within the recommended 78 characters where possible
+func foldHeader(name, value string) string {
+	var b strings.Builder
+	b.WriteString(name + ":")
+	lineLength := len(name) + 1
+
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && lineLength+1+len(word) > maxHeaderLineLength {
+			b.WriteString("\r\n")
+			lineLength = 0
+		}
+		b.WriteString(" " + word)
+		lineLength += 1 + len(word)
+	}
+
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func isASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeHeaderText(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"ascii", "Hello, world", "Hello, world"},
+		{"mostly ascii uses Q", "Olá mundo", "=?UTF-8?q?Ol=C3=A1_mundo?="},
+		{"mostly non-ascii uses B", "こんにちは", "=?UTF-8?b?44GT44KT44Gr44Gh44Gv?="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EncodeHeaderText(tt.value)
+			if got != tt.want {
+				t.Errorf("EncodeHeaderText(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+			if decoded := DecodeHeaderText(got); decoded != tt.value {
+				t.Errorf("DecodeHeaderText(%q) = %q, want %q", got, decoded, tt.value)
+			}
+		})
+	}
+}
+
+func TestFoldHeader(t *testing.T) {
+	long := strings.TrimSpace(strings.Repeat("word ", 30))
+	unbreakable := strings.Repeat("x", 100)
+
+	tests := []struct {
+		name  string
+		value string
+		lines int
+	}{
+		{"short", "Hello", 1},
+		{"long", long, 3},
+		{"word longer than a line", "a " + unbreakable + " b", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := foldHeader("Subject", tt.value)
+			if !strings.HasSuffix(got, "\r\n") {
+				t.Fatalf("foldHeader() = %q, want it to end with CRLF", got)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(got, "\r\n"), "\r\n")
+			if len(lines) != tt.lines {
+				t.Errorf("foldHeader() folded into %d lines, want %d: %q", len(lines), tt.lines, got)
+			}
+			for i, line := range lines {
+				if i > 0 && !strings.HasPrefix(line, " ") {
+					t.Errorf("continuation line %q does not start with whitespace", line)
+				}
+				if len(line) > maxHeaderLineLength && !strings.Contains(line, unbreakable) {
+					t.Errorf("line %q is longer than %d characters", line, maxHeaderLineLength)
+				}
+			}
+
+			// Unfolding gives back the value
+			if unfolded := strings.ReplaceAll(got, "\r\n ", " "); unfolded != "Subject: "+tt.value+"\r\n" {
+				t.Errorf("unfolded header = %q, want %q", unfolded, "Subject: "+tt.value+"\r\n")
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxBlankLines is the number of line breaks kept between blocks, however many the HTML asks for
+const maxBlankLines = 2
+
+// HTMLToText makes a readable plain text version of an HTML body: paragraphs
+// and headings are separated by blank lines, list items get a "-" or number,
+// quotes a "> " prefix, links show their URL and images their alt text.
+// Scripts, styles and the document head are left out.
+func HTMLToText(source string) string {
+	doc, err := html.Parse(strings.NewReader(source))
+	if err != nil {
+		return source
+	}
+
+	w := &textWriter{}
+	w.children(doc)
+	return w.String()
+}
+
+// textWriter writes the text of HTML nodes, collapsing whitespace the way a
+// browser would and owing line breaks and spaces until the next text
+type textWriter struct {
+	b      strings.Builder
+	breaks int  // Line breaks owed before the next text
+	space  bool // A space is owed before the next text
+	pre    bool // Whitespace is kept, inside a pre element
+	inList bool // Nested lists are not set apart by blank lines
+}
+
+func (w *textWriter) String() string {
+	lines := strings.Split(w.b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRightFunc(line, unicode.IsSpace)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// write writes text as is, after the breaks or space it is owed
+func (w *textWriter) write(text string) {
+	if text == "" {
+		return
+	}
+	if w.b.Len() > 0 {
+		if w.breaks > 0 {
+			w.b.WriteString(strings.Repeat("\n", w.breaks))
+		} else if w.space {
+			w.b.WriteByte(' ')
+		}
+	}
+	w.breaks, w.space = 0, false
+	w.b.WriteString(text)
+}
+
+// text writes the content of a text node, collapsing its whitespace outside pre elements
+func (w *textWriter) text(text string) {
+	if w.pre {
+		w.write(text)
+		return
+	}
+
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		if text != "" {
+			w.space = true
+		}
+		return
+	}
+	if unicode.IsSpace([]rune(text)[0]) {
+		w.space = true
+	}
+	w.write(strings.Join(words, " "))
+	if last := []rune(text); unicode.IsSpace(last[len(last)-1]) {
+		w.space = true
+	}
+}
+
+// lineBreak owes at least n line breaks before the next text
+func (w *textWriter) lineBreak(n int) {
+	if n > w.breaks {
+		w.breaks = n
+	}
+	w.space = false
+}
+
+func (w *textWriter) children(n *html.Node) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		w.node(child)
+	}
+}
+
+func (w *textWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		w.children(n)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Template, atom.Title:
+	case atom.Br:
+		if w.breaks < maxBlankLines {
+			w.breaks++
+		}
+		w.space = false
+	case atom.Hr:
+		w.lineBreak(2)
+		w.write("----------")
+		w.lineBreak(2)
+	case atom.Img:
+		w.text(htmlAttr(n, "alt"))
+	case atom.A:
+		w.link(n)
+	case atom.Ul, atom.Ol:
+		w.list(n)
+	case atom.Blockquote:
+		w.lineBreak(2)
+		quote := &textWriter{}
+		quote.children(n)
+		w.write(quoteLines(quote.String()))
+		w.lineBreak(2)
+	case atom.Pre:
+		w.lineBreak(2)
+		code := &textWriter{pre: true}
+		code.children(n)
+		w.write(strings.Trim(code.b.String(), "\n"))
+		w.lineBreak(2)
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Table, atom.Dl:
+		w.lineBreak(2)
+		w.children(n)
+		w.lineBreak(2)
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Main, atom.Nav, atom.Aside,
+		atom.Figure, atom.Figcaption, atom.Address, atom.Center, atom.Form, atom.Fieldset, atom.Tr, atom.Dt, atom.Dd, atom.Li:
+		w.lineBreak(1)
+		w.children(n)
+		w.lineBreak(1)
+	case atom.Td, atom.Th:
+		w.children(n)
+		w.space = w.breaks == 0
+	default:
+		w.children(n)
+	}
+}
+
+// link writes the text of a link followed by its URL, unless the text is the URL
+func (w *textWriter) link(n *html.Node) {
+	label := &textWriter{}
+	label.children(n)
+	text := label.String()
+
+	href := strings.TrimSpace(htmlAttr(n, "href"))
+	switch {
+	case href == "" || strings.HasPrefix(href, "#") || href == text || strings.TrimPrefix(href, "mailto:") == text:
+		w.text(text)
+	case text == "":
+		w.text(href)
+	default:
+		w.text(text + " (" + href + ")")
+	}
+}
+
+// list writes the items of a ul or ol element, each starting with a marker and
+// the lines after the first indented under it
+func (w *textWriter) list(n *html.Node) {
+	gap := 2
+	if w.inList {
+		gap = 1
+	}
+	w.lineBreak(gap)
+
+	number := 1
+	if start, err := strconv.Atoi(htmlAttr(n, "start")); err == nil {
+		number = start
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode || child.DataAtom != atom.Li {
+			continue
+		}
+
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		}
+		item := &textWriter{inList: true}
+		item.children(child)
+
+		w.lineBreak(1)
+		w.write(listItem(marker, item.String()))
+	}
+	w.lineBreak(gap)
+}
+
+// quoteLines puts "> " before every line of text, and ">" on empty ones
+func quoteLines(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line == "" {
+			lines[i] = ">"
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// listItem starts text with marker and indents its other lines to line up under the first
+func listItem(marker, text string) string {
+	indent := strings.Repeat(" ", len(marker))
+	lines := strings.Split(text, "\n")
+	for i := 1; i < len(lines); i++ {
+		if lines[i] != "" {
+			lines[i] = indent + lines[i]
+		}
+	}
+	return marker + strings.Join(lines, "\n")
+}
+
+// htmlAttr returns the value of an attribute of n, empty if it is not set
+func htmlAttr(n *html.Node, name string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+	return ""
+}
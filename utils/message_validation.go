@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// MaxHeaderLineLength is the hard limit on a header line from RFC 5322 section 2.1.1
+	MaxHeaderLineLength = 998
+
+	// MaxMessageSize is Gmail's limit for a whole message, including encoded attachments
+	MaxMessageSize = 25 * 1024 * 1024
+
+	// MaxRecipients is the number of To, Cc and Bcc recipients Gmail accepts per message
+	MaxRecipients = 500
+)
+
+// FieldError describes a problem with a single request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects the field errors found while checking a message before sending
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	messages := make([]string, 0, len(v))
+	for _, fieldError := range v {
+		messages = append(messages, fieldError.Field+": "+fieldError.Message)
+	}
+	return "invalid message: " + strings.Join(messages, "; ")
+}
+
+// Add appends an error for field
+func (v *ValidationErrors) Add(field, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidateEmailMessage checks msg before it is composed: header fields must not
+// contain line breaks that would allow header injection, every header line must
+// fit within the RFC 5322 limit, and all addresses must be valid.
+func ValidateEmailMessage(msg *EmailMessage) ValidationErrors {
+	var errs ValidationErrors
+
+	if msg.From.Email != "" {
+		errs = append(errs, ValidateAddress("from", msg.From)...)
+	}
+	if msg.ReplyTo.Email != "" {
+		errs = append(errs, ValidateAddress("reply_to", msg.ReplyTo)...)
+	}
+
+	recipientCount := len(msg.To) + len(msg.Cc) + len(msg.Bcc)
+	if recipientCount == 0 {
+		errs.Add("to", "at least one recipient is required")
+	}
+	if recipientCount > MaxRecipients {
+		errs.Add("to", "at most %d recipients are allowed per email", MaxRecipients)
+	}
+	recipientFields := []struct {
+		field     string
+		addresses []EmailAddress
+	}{{"to", msg.To}, {"cc", msg.Cc}, {"bcc", msg.Bcc}}
+	for _, recipients := range recipientFields {
+		for i, address := range recipients.addresses {
+			errs = append(errs, ValidateAddress(fmt.Sprintf("%s[%d]", recipients.field, i), address)...)
+		}
+	}
+
+	if strings.TrimSpace(msg.Subject) == "" {
+		errs.Add("subject", "subject is required")
+	}
+	errs = append(errs, validateHeaderText("subject", "Subject", msg.Subject)...)
+
+	if msg.TextBody == "" && msg.HTMLBody == "" {
+		errs.Add("body", "either body or html_body is required")
+	}
+
+	for i, attachment := range msg.Attachments {
+		field := fmt.Sprintf("attachments[%d]", i)
+		if containsLineBreak(attachment.Filename) || containsLineBreak(attachment.ContentType) {
+			errs.Add(field, "filename and content type must not contain line breaks")
+			continue
+		}
+		if _, err := attachmentEntity(attachment); err != nil {
+			errs.Add(field, "%v", err)
+		}
+	}
+
+	return errs
+}
+
+// ValidateAddress checks a single address for injection and format problems
+func ValidateAddress(field string, address EmailAddress) ValidationErrors {
+	var errs ValidationErrors
+
+	if containsLineBreak(address.Name) {
+		errs.Add(field+".name", "name must not contain line breaks")
+	}
+	if containsLineBreak(address.Email) || !IsValidEmailAddress(address.Email) {
+		errs.Add(field+".email", "invalid email address: %q", address.Email)
+		return errs
+	}
+	if len(address.String()) > MaxHeaderLineLength-len("Reply-To: ") {
+		errs.Add(field, "address is too long")
+	}
+	return errs
+}
+
+// CheckMessageSize reports an error if a composed message exceeds Gmail's size limit
+func CheckMessageSize(raw []byte) ValidationErrors {
+	var errs ValidationErrors
+	if len(raw) > MaxMessageSize {
+		errs.Add("message", "message is %d bytes after encoding, Gmail accepts at most %d", len(raw), MaxMessageSize)
+	}
+	return errs
+}
+
+// SanitizeHeaderText replaces line breaks with spaces, for values such as CSV
+// names that come from outside the request and are only used for display
+func SanitizeHeaderText(value string) string {
+	return strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == '\r' || r == '\n'
+	}), " ")
+}
+
+// validateHeaderText checks an unstructured header value such as the subject
+func validateHeaderText(field, headerName, value string) ValidationErrors {
+	var errs ValidationErrors
+
+	if containsLineBreak(value) {
+		errs.Add(field, "must not contain line breaks")
+		return errs
+	}
+
+	for _, line := range strings.Split(foldHeader(headerName, EncodeHeaderText(value)), "\r\n") {
+		if len(line) > MaxHeaderLineLength {
+			errs.Add(field, "contains a word too long to fit in a %d character header line", MaxHeaderLineLength)
+			break
+		}
+	}
+	return errs
+}
+
+func containsLineBreak(value string) bool {
+	return strings.ContainsAny(value, "\r\n\x00")
+}
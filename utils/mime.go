@@ -0,0 +1,281 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EmailAttachment is a file attached to an outgoing email.
+// Content holds the file data encoded as standard base64.
+type EmailAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+	Content     string `json:"content"`
+
+	data []byte // Content decoded by DecodeAttachments, nil until then
+}
+
+// DecodeAttachments returns attachments with their content decoded, so the
+// messages composed with them do not decode it again. Attachments whose
+// content is not valid base64 are returned as they are, and reported when a
+// message using them is validated.
+func DecodeAttachments(attachments []EmailAttachment) []EmailAttachment {
+	decoded := make([]EmailAttachment, len(attachments))
+	for i, attachment := range attachments {
+		decoded[i] = attachment
+		if data, err := attachment.decode(); err == nil {
+			decoded[i].data = data
+		}
+	}
+	return decoded
+}
+
+// decode returns the file data of an attachment
+func (a EmailAttachment) decode() ([]byte, error) {
+	if a.data != nil {
+		return a.data, nil
+	}
+	return base64.StdEncoding.DecodeString(a.Content)
+}
+
+// EmailMessage describes an outgoing email before it is MIME encoded
+type EmailMessage struct {
+	From        EmailAddress
+	To          []EmailAddress
+	Cc          []EmailAddress
+	Bcc         []EmailAddress
+	ReplyTo     EmailAddress
+	Subject     string
+	TextBody    string
+	HTMLBody    string
+	Attachments []EmailAttachment
+}
+
+// mimeEntity is a single MIME body part: its headers and a function that writes its content
+type mimeEntity struct {
+	header textproto.MIMEHeader
+	write  func(w io.Writer) error
+}
+
+// BuildMIMEMessage composes an RFC 5322 message from msg.
+// A message with both a text and an HTML body is sent as multipart/alternative,
+// and attachments wrap the body in multipart/mixed.
+// Messages failing ValidateEmailMessage or exceeding MaxMessageSize are
+// rejected with ValidationErrors.
+func BuildMIMEMessage(msg *EmailMessage) ([]byte, error) {
+	// Attachments are decoded once, for both validating and encoding them
+	if len(msg.Attachments) > 0 {
+		decoded := *msg
+		decoded.Attachments = DecodeAttachments(msg.Attachments)
+		msg = &decoded
+	}
+
+	if errs := ValidateEmailMessage(msg); len(errs) > 0 {
+		return nil, errs
+	}
+
+	entity, err := buildMessageEntity(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if msg.From.Email != "" {
+		writeHeaderField(&buf, "From", msg.From.String())
+	}
+	if len(msg.To) > 0 {
+		writeHeaderField(&buf, "To", FormatAddressList(msg.To))
+	}
+	if len(msg.Cc) > 0 {
+		writeHeaderField(&buf, "Cc", FormatAddressList(msg.Cc))
+	}
+	// Gmail delivers to Bcc recipients and strips the header from the sent copies
+	if len(msg.Bcc) > 0 {
+		writeHeaderField(&buf, "Bcc", FormatAddressList(msg.Bcc))
+	}
+	if msg.ReplyTo.Email != "" {
+		writeHeaderField(&buf, "Reply-To", msg.ReplyTo.String())
+	}
+	writeHeaderField(&buf, "Subject", EncodeHeaderText(msg.Subject))
+	writeHeaderField(&buf, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeaderField(&buf, "MIME-Version", "1.0")
+	writeMIMEHeader(&buf, entity.header)
+	buf.WriteString("\r\n")
+
+	if err := entity.write(&buf); err != nil {
+		return nil, err
+	}
+
+	if errs := CheckMessageSize(buf.Bytes()); len(errs) > 0 {
+		return nil, errs
+	}
+
+	return buf.Bytes(), nil
+}
+
+func buildMessageEntity(msg *EmailMessage) (mimeEntity, error) {
+	var body mimeEntity
+	switch {
+	case msg.TextBody != "" && msg.HTMLBody != "":
+		body = multipartEntity("alternative", []mimeEntity{
+			textEntity("text/plain", msg.TextBody),
+			textEntity("text/html", msg.HTMLBody),
+		})
+	case msg.HTMLBody != "":
+		body = textEntity("text/html", msg.HTMLBody)
+	default:
+		body = textEntity("text/plain", msg.TextBody)
+	}
+
+	if len(msg.Attachments) == 0 {
+		return body, nil
+	}
+
+	parts := []mimeEntity{body}
+	for _, attachment := range msg.Attachments {
+		part, err := attachmentEntity(attachment)
+		if err != nil {
+			return mimeEntity{}, err
+		}
+		parts = append(parts, part)
+	}
+
+	return multipartEntity("mixed", parts), nil
+}
+
+// textEntity creates a quoted-printable UTF-8 text part
+func textEntity(contentType, body string) mimeEntity {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "UTF-8"}))
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	return mimeEntity{
+		header: header,
+		write: func(w io.Writer) error {
+			qp := quotedprintable.NewWriter(w)
+			if _, err := io.WriteString(qp, body); err != nil {
+				return err
+			}
+			return qp.Close()
+		},
+	}
+}
+
+// multipartEntity creates a multipart/<subtype> part containing parts
+func multipartEntity(subtype string, parts []mimeEntity) mimeEntity {
+	boundary := randomBoundary()
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary}))
+
+	return mimeEntity{
+		header: header,
+		write: func(w io.Writer) error {
+			mw := multipart.NewWriter(w)
+			if err := mw.SetBoundary(boundary); err != nil {
+				return err
+			}
+			for _, part := range parts {
+				pw, err := mw.CreatePart(part.header)
+				if err != nil {
+					return err
+				}
+				if err := part.write(pw); err != nil {
+					return err
+				}
+			}
+			return mw.Close()
+		},
+	}
+}
+
+// attachmentEntity creates a base64 encoded attachment part
+func attachmentEntity(attachment EmailAttachment) (mimeEntity, error) {
+	if strings.TrimSpace(attachment.Filename) == "" {
+		return mimeEntity{}, fmt.Errorf("attachment filename is required")
+	}
+
+	data, err := attachment.decode()
+	if err != nil {
+		return mimeEntity{}, fmt.Errorf("attachment %s has invalid base64 content: %v", attachment.Filename, err)
+	}
+
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(attachment.Filename))
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return mimeEntity{}, fmt.Errorf("attachment %s has invalid content type: %v", attachment.Filename, err)
+	}
+	params["name"] = attachment.Filename
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	return mimeEntity{
+		header: header,
+		write: func(w io.Writer) error {
+			return writeBase64Lines(w, data)
+		},
+	}, nil
+}
+
+// writeBase64Lines writes data as base64 wrapped at 76 characters per line (RFC 2045)
+func writeBase64Lines(w io.Writer, data []byte) error {
+	const lineLength = 76
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := lineLength
+		if len(encoded) < n {
+			n = len(encoded)
+		}
+		if _, err := io.WriteString(w, encoded[:n]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
+
+func writeHeaderField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(foldHeader(name, value))
+}
+
+func writeMIMEHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			writeHeaderField(buf, key, value)
+		}
+	}
+}
+
+func randomBoundary() string {
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b[:])
+}
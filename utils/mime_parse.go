@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxMIMEDepth bounds how deeply nested multiparts are followed
+const maxMIMEDepth = 10
+
+// ParsedAttachment describes an attachment of a parsed message
+type ParsedAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"` // Decoded size in bytes
+}
+
+// ParsedMessage is an RFC 5322 message split into its headers, bodies and attachments
+type ParsedMessage struct {
+	Header      textproto.MIMEHeader `json:"headers"`
+	Subject     string               `json:"subject"` // Decoded from RFC 2047
+	TextBody    string               `json:"text_body"`
+	HTMLBody    string               `json:"html_body"`
+	Attachments []ParsedAttachment   `json:"attachments"`
+}
+
+// ParseMIMEMessage reads a message such as the ones BuildMIMEMessage
+// composes. The first text/plain and text/html parts that are not
+// attachments become the bodies; every other leaf part is an attachment.
+func ParseMIMEMessage(raw []byte) (*ParsedMessage, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+
+	header := textproto.MIMEHeader(msg.Header)
+	parsed := &ParsedMessage{
+		Header:      header,
+		Subject:     DecodeHeaderText(header.Get("Subject")),
+		Attachments: []ParsedAttachment{},
+	}
+	if err := parsed.readPart(header, msg.Body, 0); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// readPart decodes one MIME entity into the parsed message, recursing into multiparts
+func (p *ParsedMessage) readPart(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMIMEDepth {
+			return fmt.Errorf("multipart nested more than %d levels deep", maxMIMEDepth)
+		}
+
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("invalid multipart body: %v", err)
+			}
+			if err := p.readPart(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	content, err := io.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("invalid %s body: %v", mediaType, err)
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	switch {
+	case disposition != "attachment" && filename == "" && mediaType == "text/plain" && p.TextBody == "":
+		p.TextBody = string(content)
+	case disposition != "attachment" && filename == "" && mediaType == "text/html" && p.HTMLBody == "":
+		p.HTMLBody = string(content)
+	default:
+		p.Attachments = append(p.Attachments, ParsedAttachment{
+			Filename:    DecodeHeaderText(filename),
+			ContentType: mediaType,
+			Size:        len(content),
+		})
+	}
+	return nil
+}
+
+// decodeTransferEncoding undoes a Content-Transfer-Encoding
+func decodeTransferEncoding(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
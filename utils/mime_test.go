@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildMIMEMessage(t *testing.T) {
+	pdf := []byte("%PDF-1.4 not really a pdf")
+	msg := &EmailMessage{
+		From:     EmailAddress{Name: "Jane Doe", Email: "jane@example.com"},
+		To:       []EmailAddress{{Email: "bob@example.com"}, {Name: "José Silva", Email: "jose@example.com"}},
+		Cc:       []EmailAddress{{Email: "carol@example.com"}},
+		Bcc:      []EmailAddress{{Email: "secret@example.com"}},
+		ReplyTo:  EmailAddress{Email: "replies@example.com"},
+		Subject:  "Relatório de vendas " + strings.Repeat("mensal ", 12),
+		TextBody: "Olá, see the report.",
+		HTMLBody: "<p>Olá,</p><p>see the report.</p>",
+		Attachments: []EmailAttachment{
+			{Filename: "report.pdf", Content: base64.StdEncoding.EncodeToString(pdf)},
+		},
+	}
+
+	raw, err := BuildMIMEMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The long subject is folded into several lines
+	header := string(raw[:bytes.Index(raw, []byte("\r\n\r\n"))])
+	subject := header[strings.Index(header, "Subject:"):]
+	if end := strings.Index(subject, "\r\nDate:"); end < 0 || !strings.Contains(subject[:end], "\r\n ") {
+		t.Errorf("Subject header is not folded: %q", subject)
+	}
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(line) > MaxHeaderLineLength {
+			t.Errorf("header line is longer than %d characters: %q", MaxHeaderLineLength, line)
+		}
+	}
+
+	parsed, err := ParseMIMEMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHeaders := map[string]string{
+		"From":     `"Jane Doe" <jane@example.com>`,
+		"To":       "bob@example.com, =?UTF-8?q?Jos=C3=A9_Silva?= <jose@example.com>",
+		"Cc":       "carol@example.com",
+		"Bcc":      "secret@example.com", // Gmail delivers to it and strips it, other transports remove it
+		"Reply-To": "replies@example.com",
+	}
+	for name, want := range wantHeaders {
+		if got := parsed.Header.Get(name); got != want {
+			t.Errorf("%s header = %q, want %q", name, got, want)
+		}
+	}
+	if parsed.Subject != msg.Subject {
+		t.Errorf("Subject = %q, want %q", parsed.Subject, msg.Subject)
+	}
+	if parsed.TextBody != msg.TextBody || parsed.HTMLBody != msg.HTMLBody {
+		t.Errorf("bodies = %q and %q, want %q and %q", parsed.TextBody, parsed.HTMLBody, msg.TextBody, msg.HTMLBody)
+	}
+	wantAttachments := []ParsedAttachment{{Filename: "report.pdf", ContentType: "application/pdf", Size: len(pdf)}}
+	if !reflect.DeepEqual(parsed.Attachments, wantAttachments) {
+		t.Errorf("attachments = %+v, want %+v", parsed.Attachments, wantAttachments)
+	}
+}
+
+func TestBuildMIMEMessageBodies(t *testing.T) {
+	tests := []struct {
+		name        string
+		text, html  string
+		contentType string
+	}{
+		{"text only", "Hi", "", "text/plain"},
+		{"html only", "", "<p>Hi</p>", "text/html"},
+		{"text and html", "Hi", "<p>Hi</p>", "multipart/alternative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := BuildMIMEMessage(&EmailMessage{
+				To:       []EmailAddress{{Email: "bob@example.com"}},
+				Subject:  "Hello",
+				TextBody: tt.text,
+				HTMLBody: tt.html,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, err := ParseMIMEMessage(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parsed.Header.Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+				t.Errorf("Content-Type = %q, want %s", got, tt.contentType)
+			}
+			if parsed.TextBody != tt.text || parsed.HTMLBody != tt.html {
+				t.Errorf("bodies = %q and %q, want %q and %q", parsed.TextBody, parsed.HTMLBody, tt.text, tt.html)
+			}
+		})
+	}
+}
+
+func TestBuildMIMEMessageRejects(t *testing.T) {
+	valid := func() *EmailMessage {
+		return &EmailMessage{
+			To:       []EmailAddress{{Email: "bob@example.com"}},
+			Subject:  "Hello",
+			TextBody: "Hi",
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(msg *EmailMessage)
+		field  string
+	}{
+		{"no recipients", func(msg *EmailMessage) { msg.To = nil }, "to"},
+		{"subject injection", func(msg *EmailMessage) { msg.Subject = "Hi\r\nBcc: eve@example.com" }, "subject"},
+		{"subject word too long", func(msg *EmailMessage) { msg.Subject = strings.Repeat("x", MaxHeaderLineLength) }, "subject"},
+		{"name injection", func(msg *EmailMessage) { msg.To[0].Name = "Bob\nBcc: eve@example.com" }, "to[0].name"},
+		{"invalid address", func(msg *EmailMessage) { msg.Cc = []EmailAddress{{Email: "not an address"}} }, "cc[0].email"},
+		{"invalid reply-to", func(msg *EmailMessage) { msg.ReplyTo = EmailAddress{Email: "replies@"} }, "reply_to.email"},
+		{"no body", func(msg *EmailMessage) { msg.TextBody = "" }, "body"},
+		{"attachment without filename", func(msg *EmailMessage) {
+			msg.Attachments = []EmailAttachment{{Content: "aGk="}}
+		}, "attachments[0]"},
+		{"attachment with invalid base64", func(msg *EmailMessage) {
+			msg.Attachments = []EmailAttachment{{Filename: "a.txt", Content: "not base64!"}}
+		}, "attachments[0]"},
+		{"attachment filename injection", func(msg *EmailMessage) {
+			msg.Attachments = []EmailAttachment{{Filename: "a.txt\r\nX-Evil: 1", Content: "aGk="}}
+		}, "attachments[0]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := valid()
+			tt.modify(msg)
+
+			_, err := BuildMIMEMessage(msg)
+			var errs ValidationErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("BuildMIMEMessage() error = %v, want ValidationErrors", err)
+			}
+			for _, fieldError := range errs {
+				if fieldError.Field == tt.field {
+					return
+				}
+			}
+			t.Errorf("BuildMIMEMessage() error = %v, want an error on %s", err, tt.field)
+		})
+	}
+}
+
+func TestDecodeAttachments(t *testing.T) {
+	attachments := []EmailAttachment{
+		{Filename: "a.txt", Content: base64.StdEncoding.EncodeToString([]byte("hello"))},
+		{Filename: "b.txt", Content: "not base64!"},
+	}
+
+	decoded := DecodeAttachments(attachments)
+	if string(decoded[0].data) != "hello" {
+		t.Errorf("decoded data = %q, want %q", decoded[0].data, "hello")
+	}
+	if decoded[1].data != nil {
+		t.Errorf("invalid content was decoded to %q", decoded[1].data)
+	}
+	if attachments[0].data != nil {
+		t.Error("DecodeAttachments changed the attachments it was given")
+	}
+
+	// Once decoded, the content is not decoded again when a message is built
+	decoded[0].Content = "not base64!"
+	raw, err := BuildMIMEMessage(&EmailMessage{
+		To:          []EmailAddress{{Email: "bob@example.com"}},
+		Subject:     "Hello",
+		TextBody:    "Hi",
+		Attachments: decoded[:1],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte(base64.StdEncoding.EncodeToString([]byte("hello")))) {
+		t.Error("the message does not contain the decoded attachment")
+	}
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// localTimeLayouts are accepted for times without a UTC offset, which are read in the given time zone
+var localTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// ParseScheduleTime parses the time an email should be sent at. A value with
+// a UTC offset (RFC 3339) is used as is; a local date and time is read in
+// timeZone, an IANA name such as "Europe/Berlin", or UTC if none is given.
+func ParseScheduleTime(value, timeZone string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	location := time.UTC
+	if timeZone != "" {
+		loaded, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown time zone %q", timeZone)
+		}
+		location = loaded
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range localTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339 such as 2006-01-02T15:04:05Z07:00", value)
+}
@@ -0,0 +1,917 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Template is a merge template personalizing a message for each recipient.
+// Variables are written {{first_name}} and can be piped through filters, as
+// in {{first_name | default "there" | title}}. {{if plan == "pro"}},
+// {{else}}, {{else if ...}} and {{end}} render conditionally, and
+// {{for item in items}} ... {{end}} repeats for each item of a list, with
+// loop.index, loop.first and loop.last set. {{- and -}} trim the whitespace
+// before or after an action, and {{"{{"}} writes literal braces.
+//
+// Variable names are case-insensitive. A variable written out on its own must
+// have a value unless it has a default; in conditions and loops a missing
+// variable is simply empty.
+type Template struct {
+	nodes []templateNode
+}
+
+// TemplateError is a syntax error in a template, or a variable a recipient has no value for
+type TemplateError struct {
+	Line     int
+	Column   int
+	Variable string // Variable without a value, if that is the error
+	Message  string
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// templateFilter is a filter variables can be piped through
+type templateFilter struct {
+	minArgs, maxArgs int
+	apply            func(value interface{}, args []interface{}) interface{}
+}
+
+// templateFilters are the filters templates can use. raw is handled when
+// writing out a value, since it only turns escaping off.
+var templateFilters = map[string]templateFilter{
+	"default": {1, 1, func(value interface{}, args []interface{}) interface{} {
+		if isEmptyTemplateValue(value) {
+			return args[0]
+		}
+		return value
+	}},
+	"upper": {0, 0, func(value interface{}, _ []interface{}) interface{} {
+		return strings.ToUpper(templateString(value))
+	}},
+	"lower": {0, 0, func(value interface{}, _ []interface{}) interface{} {
+		return strings.ToLower(templateString(value))
+	}},
+	"title": {0, 0, func(value interface{}, _ []interface{}) interface{} {
+		return titleCase(templateString(value))
+	}},
+	"trim": {0, 0, func(value interface{}, _ []interface{}) interface{} {
+		return strings.TrimSpace(templateString(value))
+	}},
+	"split": {0, 1, func(value interface{}, args []interface{}) interface{} {
+		sep := ","
+		if len(args) > 0 {
+			sep = templateString(args[0])
+		}
+		items := []interface{}{}
+		for _, item := range strings.Split(templateString(value), sep) {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}},
+	"join": {0, 1, func(value interface{}, args []interface{}) interface{} {
+		sep := ", "
+		if len(args) > 0 {
+			sep = templateString(args[0])
+		}
+		return joinTemplateList(value, sep)
+	}},
+	"raw": {0, 0, func(value interface{}, _ []interface{}) interface{} {
+		return value
+	}},
+}
+
+// templateKeywords cannot be used as variable names
+var templateKeywords = map[string]bool{"if": true, "else": true, "end": true, "for": true, "in": true, "not": true}
+
+// NormalizeTemplateVariable turns a name, such as a CSV column header, into
+// the variable templates refer to it by: "First Name" becomes first_name
+func NormalizeTemplateVariable(name string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if underscore && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			underscore = false
+			b.WriteRune(r)
+		} else {
+			underscore = true
+		}
+	}
+	return b.String()
+}
+
+// ParseTemplate parses a merge template, returning a *TemplateError for the
+// first syntax error
+func ParseTemplate(text string) (*Template, error) {
+	items, err := lexTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &templateParser{items: items}
+	nodes, term, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if term != nil {
+		return nil, term.errorf("{{%s}} without {{if}} or {{for}}", term.tokens[0].text)
+	}
+	return &Template{nodes: nodes}, nil
+}
+
+// Variables returns the variables the template refers to, sorted, leaving
+// out the ones its loops define
+func (t *Template) Variables() []string {
+	names := make(map[string]bool)
+	for _, node := range t.nodes {
+		node.variables(map[string]bool{}, names)
+	}
+
+	variables := make([]string, 0, len(names))
+	for name := range names {
+		variables = append(variables, name)
+	}
+	sort.Strings(variables)
+	return variables
+}
+
+// Execute renders the template with a recipient's variables, whose keys must
+// be normalized with NormalizeTemplateVariable. Values are strings, numbers,
+// booleans, or lists and maps of them, as decoded from JSON. Every value
+// written out goes through escape, if set, unless it is piped through raw.
+func (t *Template) Execute(data map[string]interface{}, escape func(string) string) (string, error) {
+	state := &templateState{data: data, escape: escape}
+	var out strings.Builder
+	if err := executeTemplateNodes(t.nodes, state, &out); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Template lexing
+
+type templateTokenKind int
+
+const (
+	tokenIdent templateTokenKind = iota
+	tokenString
+	tokenNumber
+	tokenPipe
+	tokenEqual
+	tokenNotEqual
+)
+
+type templateToken struct {
+	kind  templateTokenKind
+	text  string
+	value interface{} // Of string and number tokens
+}
+
+// templateItem is a run of text or an action of a template
+type templateItem struct {
+	action       bool
+	text         string
+	tokens       []templateToken
+	line, column int
+}
+
+func (item *templateItem) errorf(format string, args ...interface{}) *TemplateError {
+	return &TemplateError{Line: item.line, Column: item.column, Message: fmt.Sprintf(format, args...)}
+}
+
+// lexTemplate splits a template into text and tokenized actions
+func lexTemplate(text string) ([]*templateItem, error) {
+	var items []*templateItem
+	line, column := 1, 1
+	advance := func(s string) {
+		for _, r := range s {
+			if r == '\n' {
+				line, column = line+1, 1
+			} else {
+				column++
+			}
+		}
+	}
+
+	trimNext := false
+	for text != "" {
+		start := strings.Index(text, "{{")
+		if start < 0 {
+			start = len(text)
+		}
+
+		literal := text[:start]
+		if trimNext {
+			literal = strings.TrimLeftFunc(literal, unicode.IsSpace)
+		}
+		if start < len(text) && strings.HasPrefix(text[start+2:], "- ") {
+			literal = strings.TrimRightFunc(literal, unicode.IsSpace)
+		}
+		if literal != "" {
+			items = append(items, &templateItem{text: literal})
+		}
+		advance(text[:start])
+		text = text[start:]
+		if text == "" {
+			break
+		}
+
+		item := &templateItem{action: true, line: line, column: column}
+		end := actionEnd(text)
+		if end < 0 {
+			return nil, item.errorf("{{ is not closed with }}")
+		}
+
+		content := text[2:end]
+		if strings.HasPrefix(content, "- ") {
+			content = content[1:]
+		}
+		trimNext = strings.HasSuffix(content, " -")
+		if trimNext {
+			content = content[:len(content)-1]
+		}
+
+		tokens, err := tokenizeTemplateAction(content)
+		if err != nil {
+			return nil, item.errorf("%s", err)
+		}
+		if len(tokens) == 0 {
+			return nil, item.errorf("empty {{}}")
+		}
+		item.tokens = tokens
+		items = append(items, item)
+
+		advance(text[:end+2])
+		text = text[end+2:]
+	}
+	return items, nil
+}
+
+// actionEnd returns the index of the }} closing the action text starts with,
+// or -1 if it is not closed. A }} inside a string, as in {{x | default "}}"}},
+// does not close the action.
+func actionEnd(text string) int {
+	for i := 2; i < len(text); i++ {
+		switch {
+		case text[i] == '"':
+			for i++; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+		case strings.HasPrefix(text[i:], "}}"):
+			return i
+		}
+	}
+	return -1
+}
+
+// tokenizeTemplateAction splits the inside of an action into tokens
+func tokenizeTemplateAction(content string) ([]templateToken, error) {
+	var tokens []templateToken
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '|':
+			tokens = append(tokens, templateToken{kind: tokenPipe, text: "|"})
+			i++
+		case strings.HasPrefix(content[i:], "=="):
+			tokens = append(tokens, templateToken{kind: tokenEqual, text: "=="})
+			i += 2
+		case strings.HasPrefix(content[i:], "!="):
+			tokens = append(tokens, templateToken{kind: tokenNotEqual, text: "!="})
+			i += 2
+		case c == '"':
+			end := i + 1
+			for end < len(content) && content[end] != '"' {
+				if content[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(content) {
+				return nil, fmt.Errorf("string is not closed with \"")
+			}
+			value, err := strconv.Unquote(content[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s", content[i:end+1])
+			}
+			tokens = append(tokens, templateToken{kind: tokenString, text: content[i : end+1], value: value})
+			i = end + 1
+		case isDigit(c) || (c == '-' && i+1 < len(content) && isDigit(content[i+1])):
+			end := i + 1
+			for end < len(content) && (isDigit(content[end]) || content[end] == '.') {
+				end++
+			}
+			value, err := strconv.ParseFloat(content[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s", content[i:end])
+			}
+			tokens = append(tokens, templateToken{kind: tokenNumber, text: content[i:end], value: value})
+			i = end
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(content) && (isIdentStart(content[end]) || isDigit(content[end]) || content[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, templateToken{kind: tokenIdent, text: content[i:end]})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected %q", rune(c))
+		}
+	}
+	return tokens, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Template parsing
+
+type templateParser struct {
+	items []*templateItem
+	pos   int
+}
+
+// parseList parses nodes up to the end of the template or an {{else}} or
+// {{end}}, which it returns
+func (p *templateParser) parseList() ([]templateNode, *templateItem, error) {
+	var nodes []templateNode
+	for p.pos < len(p.items) {
+		item := p.items[p.pos]
+		p.pos++
+
+		if !item.action {
+			nodes = append(nodes, &textNode{text: item.text})
+			continue
+		}
+
+		first := item.tokens[0]
+		keyword := ""
+		if first.kind == tokenIdent {
+			keyword = first.text
+		}
+
+		switch keyword {
+		case "else", "end":
+			return nodes, item, nil
+		case "if":
+			node, err := p.parseIf(item, item.tokens[1:])
+			if err != nil {
+				return nil, nil, err
+			}
+			nodes = append(nodes, node)
+		case "for":
+			node, err := p.parseFor(item)
+			if err != nil {
+				return nil, nil, err
+			}
+			nodes = append(nodes, node)
+		default:
+			pipe, err := parsePipeline(item, item.tokens)
+			if err != nil {
+				return nil, nil, err
+			}
+			nodes = append(nodes, &outputNode{pipe: pipe})
+		}
+	}
+	return nodes, nil, nil
+}
+
+// parseIf parses an {{if}} or {{else if}} up to its {{end}}
+func (p *templateParser) parseIf(item *templateItem, condTokens []templateToken) (templateNode, error) {
+	cond, err := parseCondition(item, condTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &ifNode{cond: cond}
+	if node.then, err = p.parseBody(item, "if", true); err != nil {
+		return nil, err
+	}
+
+	term := p.items[p.pos-1]
+	if term.tokens[0].text != "else" {
+		return node, nil
+	}
+
+	if len(term.tokens) > 1 {
+		if term.tokens[1].kind != tokenIdent || term.tokens[1].text != "if" {
+			return nil, term.errorf("unexpected %s after else", term.tokens[1].text)
+		}
+		// The nested if consumes the {{end}} of the whole chain
+		elseIf, err := p.parseIf(term, term.tokens[2:])
+		if err != nil {
+			return nil, err
+		}
+		node.els = []templateNode{elseIf}
+		return node, nil
+	}
+
+	if node.els, err = p.parseBody(term, "else", false); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// parseFor parses a {{for item in items}} up to its {{end}}
+func (p *templateParser) parseFor(item *templateItem) (templateNode, error) {
+	tokens := item.tokens
+	if len(tokens) < 4 || tokens[1].kind != tokenIdent || tokens[2].kind != tokenIdent || tokens[2].text != "in" {
+		return nil, item.errorf("for must be written {{for item in items}}")
+	}
+	name := strings.ToLower(tokens[1].text)
+	if strings.Contains(name, ".") || templateKeywords[name] || name == "loop" {
+		return nil, item.errorf("%s cannot be used as a loop variable", tokens[1].text)
+	}
+
+	pipe, err := parsePipeline(item, tokens[3:])
+	if err != nil {
+		return nil, err
+	}
+
+	node := &forNode{name: name, pipe: pipe}
+	if node.body, err = p.parseBody(item, "for", true); err != nil {
+		return nil, err
+	}
+	if term := p.items[p.pos-1]; term.tokens[0].text == "else" {
+		if len(term.tokens) > 1 {
+			return nil, term.errorf("unexpected %s after else", term.tokens[1].text)
+		}
+		if node.els, err = p.parseBody(term, "else", false); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// parseBody parses the body of a block opened by item, which must be closed
+// by {{end}}, or by {{else}} if allowed
+func (p *templateParser) parseBody(item *templateItem, block string, elseAllowed bool) ([]templateNode, error) {
+	nodes, term, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if term == nil {
+		return nil, item.errorf("{{%s}} is not closed with {{end}}", block)
+	}
+	if term.tokens[0].text == "else" && !elseAllowed {
+		return nil, term.errorf("unexpected {{else}}")
+	}
+	if term.tokens[0].text == "end" && len(term.tokens) > 1 {
+		return nil, term.errorf("unexpected %s after end", term.tokens[1].text)
+	}
+	return nodes, nil
+}
+
+// parseCondition parses [not] pipeline [== or != pipeline]
+func parseCondition(item *templateItem, tokens []templateToken) (*templateCondition, error) {
+	cond := &templateCondition{}
+	if len(tokens) > 0 && tokens[0].kind == tokenIdent && tokens[0].text == "not" {
+		cond.negate = true
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return nil, item.errorf("if needs a condition")
+	}
+
+	left := tokens
+	for i, token := range tokens {
+		if token.kind == tokenEqual || token.kind == tokenNotEqual {
+			left = tokens[:i]
+			cond.compare = token.kind
+			right, err := parsePipeline(item, tokens[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			cond.right = right
+			break
+		}
+	}
+
+	pipe, err := parsePipeline(item, left)
+	if err != nil {
+		return nil, err
+	}
+	cond.left = pipe
+	return cond, nil
+}
+
+// parsePipeline parses operand [| filter args...]...
+func parsePipeline(item *templateItem, tokens []templateToken) (*templatePipeline, error) {
+	if len(tokens) == 0 {
+		return nil, item.errorf("missing value")
+	}
+
+	operand, err := parseOperand(item, tokens[0])
+	if err != nil {
+		return nil, err
+	}
+	pipe := &templatePipeline{operand: operand, line: item.line, column: item.column}
+
+	tokens = tokens[1:]
+	for len(tokens) > 0 {
+		if tokens[0].kind != tokenPipe {
+			return nil, item.errorf("unexpected %s; separate filters with |", tokens[0].text)
+		}
+		if len(tokens) < 2 || tokens[1].kind != tokenIdent {
+			return nil, item.errorf("| must be followed by a filter")
+		}
+
+		call := templateFilterCall{name: strings.ToLower(tokens[1].text)}
+		filter, ok := templateFilters[call.name]
+		if !ok {
+			return nil, item.errorf("unknown filter %q", tokens[1].text)
+		}
+
+		tokens = tokens[2:]
+		for len(tokens) > 0 && tokens[0].kind != tokenPipe {
+			arg, err := parseOperand(item, tokens[0])
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			tokens = tokens[1:]
+		}
+		if len(call.args) < filter.minArgs || len(call.args) > filter.maxArgs {
+			return nil, item.errorf("%s takes %s", call.name, argumentCount(filter))
+		}
+		pipe.filters = append(pipe.filters, call)
+	}
+	return pipe, nil
+}
+
+func parseOperand(item *templateItem, token templateToken) (*templateOperand, error) {
+	switch token.kind {
+	case tokenString, tokenNumber:
+		return &templateOperand{literal: token.value}, nil
+	case tokenIdent:
+		if templateKeywords[strings.ToLower(token.text)] {
+			return nil, item.errorf("unexpected %s", token.text)
+		}
+		path := strings.Split(token.text, ".")
+		for _, segment := range path {
+			if segment == "" {
+				return nil, item.errorf("invalid variable name %s", token.text)
+			}
+		}
+		path[0] = strings.ToLower(path[0])
+		return &templateOperand{path: path}, nil
+	default:
+		return nil, item.errorf("unexpected %s", token.text)
+	}
+}
+
+func argumentCount(filter templateFilter) string {
+	switch {
+	case filter.maxArgs == 0:
+		return "no arguments"
+	case filter.minArgs == filter.maxArgs:
+		return fmt.Sprintf("%d argument", filter.minArgs)
+	default:
+		return fmt.Sprintf("at most %d argument", filter.maxArgs)
+	}
+}
+
+// Template nodes and execution
+
+type templateState struct {
+	data   map[string]interface{}
+	scopes []map[string]interface{} // Loop variables, innermost last
+	escape func(string) string
+}
+
+type templateNode interface {
+	execute(state *templateState, out *strings.Builder) error
+	variables(bound map[string]bool, names map[string]bool)
+}
+
+type templateOperand struct {
+	path    []string    // Variable, with the keys into its map value if any
+	literal interface{} // Set if not a variable
+}
+
+type templateFilterCall struct {
+	name string
+	args []*templateOperand
+}
+
+type templatePipeline struct {
+	operand      *templateOperand
+	filters      []templateFilterCall
+	line, column int
+}
+
+type templateCondition struct {
+	negate  bool
+	left    *templatePipeline
+	compare templateTokenKind // tokenEqual or tokenNotEqual if right is set
+	right   *templatePipeline
+}
+
+type textNode struct {
+	text string
+}
+
+type outputNode struct {
+	pipe *templatePipeline
+}
+
+type ifNode struct {
+	cond *templateCondition
+	then []templateNode
+	els  []templateNode
+}
+
+type forNode struct {
+	name string
+	pipe *templatePipeline
+	body []templateNode
+	els  []templateNode // Rendered if the list is empty
+}
+
+func executeTemplateNodes(nodes []templateNode, state *templateState, out *strings.Builder) error {
+	for _, node := range nodes {
+		if err := node.execute(state, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *textNode) execute(_ *templateState, out *strings.Builder) error {
+	out.WriteString(n.text)
+	return nil
+}
+
+func (n *textNode) variables(map[string]bool, map[string]bool) {}
+
+func (n *outputNode) execute(state *templateState, out *strings.Builder) error {
+	if n.pipe.operand.path != nil && !n.pipe.hasFilter("default") && isEmptyTemplateValue(state.lookup(n.pipe.operand.path)) {
+		name := strings.Join(n.pipe.operand.path, ".")
+		return &TemplateError{
+			Line:     n.pipe.line,
+			Column:   n.pipe.column,
+			Variable: name,
+			Message:  fmt.Sprintf("no value for %s; give it one or a fallback such as {{%s | default \"...\"}}", name, name),
+		}
+	}
+
+	value := templateString(n.pipe.evaluate(state))
+	if state.escape != nil && !n.pipe.hasFilter("raw") {
+		value = state.escape(value)
+	}
+	out.WriteString(value)
+	return nil
+}
+
+func (n *outputNode) variables(bound map[string]bool, names map[string]bool) {
+	n.pipe.variables(bound, names)
+}
+
+func (n *ifNode) execute(state *templateState, out *strings.Builder) error {
+	if n.cond.evaluate(state) {
+		return executeTemplateNodes(n.then, state, out)
+	}
+	return executeTemplateNodes(n.els, state, out)
+}
+
+func (n *ifNode) variables(bound map[string]bool, names map[string]bool) {
+	n.cond.left.variables(bound, names)
+	if n.cond.right != nil {
+		n.cond.right.variables(bound, names)
+	}
+	for _, node := range append(append([]templateNode{}, n.then...), n.els...) {
+		node.variables(bound, names)
+	}
+}
+
+func (n *forNode) execute(state *templateState, out *strings.Builder) error {
+	items := templateList(n.pipe.evaluate(state))
+	if len(items) == 0 {
+		return executeTemplateNodes(n.els, state, out)
+	}
+
+	scope := make(map[string]interface{}, 2)
+	state.scopes = append(state.scopes, scope)
+	defer func() { state.scopes = state.scopes[:len(state.scopes)-1] }()
+
+	for i, item := range items {
+		scope[n.name] = item
+		scope["loop"] = map[string]interface{}{
+			"index": float64(i + 1),
+			"first": i == 0,
+			"last":  i == len(items)-1,
+		}
+		if err := executeTemplateNodes(n.body, state, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *forNode) variables(bound map[string]bool, names map[string]bool) {
+	n.pipe.variables(bound, names)
+
+	inner := make(map[string]bool, len(bound)+2)
+	for name := range bound {
+		inner[name] = true
+	}
+	inner[n.name], inner["loop"] = true, true
+	for _, node := range n.body {
+		node.variables(inner, names)
+	}
+	for _, node := range n.els {
+		node.variables(bound, names)
+	}
+}
+
+func (p *templatePipeline) evaluate(state *templateState) interface{} {
+	value := p.operand.evaluate(state)
+	for _, call := range p.filters {
+		args := make([]interface{}, len(call.args))
+		for i, arg := range call.args {
+			args[i] = arg.evaluate(state)
+		}
+		value = templateFilters[call.name].apply(value, args)
+	}
+	return value
+}
+
+func (p *templatePipeline) hasFilter(name string) bool {
+	for _, call := range p.filters {
+		if call.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *templatePipeline) variables(bound map[string]bool, names map[string]bool) {
+	operands := []*templateOperand{p.operand}
+	for _, call := range p.filters {
+		operands = append(operands, call.args...)
+	}
+	for _, operand := range operands {
+		if operand.path != nil && !bound[operand.path[0]] {
+			names[operand.path[0]] = true
+		}
+	}
+}
+
+func (c *templateCondition) evaluate(state *templateState) bool {
+	var result bool
+	if c.right == nil {
+		result = isTruthyTemplateValue(c.left.evaluate(state))
+	} else {
+		equal := strings.EqualFold(templateString(c.left.evaluate(state)), templateString(c.right.evaluate(state)))
+		result = equal == (c.compare == tokenEqual)
+	}
+	return result != c.negate
+}
+
+func (o *templateOperand) evaluate(state *templateState) interface{} {
+	if o.path == nil {
+		return o.literal
+	}
+	return state.lookup(o.path)
+}
+
+// lookup resolves a variable, innermost loop first, then following its keys
+// into map values. It returns nil if there is no such variable.
+func (s *templateState) lookup(path []string) interface{} {
+	var value interface{}
+	found := false
+	for i := len(s.scopes) - 1; i >= 0 && !found; i-- {
+		value, found = s.scopes[i][path[0]]
+	}
+	if !found {
+		value = s.data[path[0]]
+	}
+
+	for _, key := range path[1:] {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value, ok = fields[key]
+		if !ok {
+			value = nil
+			for name, field := range fields {
+				if strings.EqualFold(name, key) {
+					value = field
+					break
+				}
+			}
+		}
+	}
+	return value
+}
+
+// Template values
+
+// templateString writes out a value: numbers without trailing zeros, and lists joined with commas
+func templateString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}, []string:
+		return joinTemplateList(v, ", ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// templateList returns the items of a list; any other non-empty value is a list of itself
+func templateList(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		return v
+	case []string:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = item
+		}
+		return items
+	}
+	if isEmptyTemplateValue(value) {
+		return nil
+	}
+	return []interface{}{value}
+}
+
+func joinTemplateList(value interface{}, sep string) string {
+	items := templateList(value)
+	parts := make([]string, len(items))
+	for i, item := range items {
+		parts[i] = templateString(item)
+	}
+	return strings.Join(parts, sep)
+}
+
+func isEmptyTemplateValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case []string:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// isTruthyTemplateValue decides conditions: empty values, false, 0 and the
+// strings "false", "no" and "0" are false
+func isTruthyTemplateValue(value interface{}) bool {
+	if isEmptyTemplateValue(value) {
+		return false
+	}
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "false", "no", "0":
+			return false
+		}
+	}
+	return true
+}
+
+// titleCase upper-cases the first letter of each word
+func titleCase(s string) string {
+	runes := []rune(s)
+	for i, r := range runes {
+		if i == 0 || !(unicode.IsLetter(runes[i-1]) || unicode.IsDigit(runes[i-1]) || runes[i-1] == '\'') {
+			runes[i] = unicode.ToUpper(r)
+		}
+	}
+	return string(runes)
+}
@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"errors"
+	"html"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTemplateExecute(t *testing.T) {
+	data := map[string]interface{}{
+		"name":    "Ada",
+		"plan":    "pro",
+		"empty":   "",
+		"items":   []interface{}{"a", "b", "c"},
+		"none":    []interface{}{},
+		"company": map[string]interface{}{"Name": "Acme"},
+		"html":    `<b>"hi"</b>`,
+		"count":   float64(3),
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"plain text", "Hello there", "Hello there"},
+		{"variable", "Hi {{name}}!", "Hi Ada!"},
+		{"case-insensitive variable", "Hi {{ NAME }}", "Hi Ada"},
+		{"map key", "{{company.name}}", "Acme"},
+		{"number", "{{count}} left", "3 left"},
+		{"filters", `{{name | upper}} {{"ada lovelace" | title}}`, "ADA Ada Lovelace"},
+		{"default", `Hi {{first_name | default "there"}}`, "Hi there"},
+		{"default keeps value", `Hi {{name | default "there"}}`, "Hi Ada"},
+
+		{"trim before", "a  \n {{- name}}", "aAda"},
+		{"trim after", "{{name -}} \n  b", "Adab"},
+		{"trim both", "x\n  {{- name -}}\n  y", "xAday"},
+		{"trim around blocks", "<ul>\n  {{- for i in items}}\n  <li>{{i}}</li>\n  {{- end}}\n</ul>", "<ul>\n  <li>a</li>\n  <li>b</li>\n  <li>c</li>\n</ul>"},
+		{"minus without space is a number", "{{-1}}", "-1"},
+
+		{"literal open braces", `{{"{{"}}name}}`, "{{name}}"},
+		{"literal close braces", `{{"}}"}}`, "}}"},
+		{"close braces in default", `{{ missing | default "}}" }}`, "}}"},
+		{"close braces in comparison", `{{if plan == "}}"}}yes{{else}}no{{end}}`, "no"},
+		{"escaped quote in string", `{{ missing | default "say \"}}\"" }}`, `say "}}"`},
+
+		{"if true", `{{if plan == "pro"}}Pro{{end}}`, "Pro"},
+		{"if case-insensitive compare", `{{if plan == "PRO"}}Pro{{end}}`, "Pro"},
+		{"if false", `{{if plan == "free"}}Free{{end}}`, ""},
+		{"if not equal", `{{if plan != "free"}}Paid{{end}}`, "Paid"},
+		{"if not", `{{if not empty}}empty{{end}}`, "empty"},
+		{"if missing variable", `{{if nobody}}x{{else}}y{{end}}`, "y"},
+		{"else", `{{if empty}}a{{else}}b{{end}}`, "b"},
+		{"else if first", `{{if plan == "pro"}}1{{else if plan == "team"}}2{{else}}3{{end}}`, "1"},
+		{"else if second", `{{if plan == "free"}}1{{else if plan == "pro"}}2{{else}}3{{end}}`, "2"},
+		{"else if fallback", `{{if plan == "free"}}1{{else if plan == "team"}}2{{else}}3{{end}}`, "3"},
+		{"else if without else", `{{if plan == "free"}}1{{else if plan == "team"}}2{{end}}`, ""},
+		{"nested if", `{{if name}}{{if plan == "pro"}}A{{else}}B{{end}}{{end}}`, "A"},
+
+		{"for", "{{for i in items}}{{i}}{{end}}", "abc"},
+		{"for loop index", "{{for i in items}}{{loop.index}}{{i}} {{end}}", "1a 2b 3c "},
+		{"for loop first and last", `{{for i in items}}{{if not loop.first}}, {{end}}{{i}}{{if loop.last}}.{{end}}{{end}}`, "a, b, c."},
+		{"for else on empty list", "{{for i in none}}{{i}}{{else}}nothing{{end}}", "nothing"},
+		{"for else on missing list", "{{for i in nobody}}{{i}}{{else}}nothing{{end}}", "nothing"},
+		{"for split", `{{for tag in "x, y" | split}}[{{tag}}]{{end}}`, "[x][y]"},
+		{"loop variable shadows data", "{{for name in items}}{{name}}{{end}}{{name}}", "abcAda"},
+		{"join", `{{items | join " / "}}`, "a / b / c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("ParseTemplate(%q): %v", tt.template, err)
+			}
+			got, err := tmpl.Execute(data, nil)
+			if err != nil {
+				t.Fatalf("Execute(%q): %v", tt.template, err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateEscape(t *testing.T) {
+	data := map[string]interface{}{"html": `<b>"hi"</b> & co`}
+
+	tests := []struct {
+		name     string
+		template string
+		escape   func(string) string
+		want     string
+	}{
+		{"escaped", "<p>{{html}}</p>", html.EscapeString, "<p>&lt;b&gt;&#34;hi&#34;&lt;/b&gt; &amp; co</p>"},
+		{"raw", "<p>{{html | raw}}</p>", html.EscapeString, `<p><b>"hi"</b> & co</p>`},
+		{"raw after other filters", "{{html | upper | raw}}", html.EscapeString, `<B>"HI"</B> & CO`},
+		{"default escaped", `{{missing | default "<none>"}}`, html.EscapeString, "&lt;none&gt;"},
+		{"template text not escaped", "<b>{{\"&\"}}</b>", html.EscapeString, "<b>&amp;</b>"},
+		{"no escape func", "{{html}}", nil, `<b>"hi"</b> & co`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("ParseTemplate(%q): %v", tt.template, err)
+			}
+			got, err := tmpl.Execute(data, tt.escape)
+			if err != nil {
+				t.Fatalf("Execute(%q): %v", tt.template, err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateMissingVariable(t *testing.T) {
+	tests := []struct {
+		name         string
+		template     string
+		variable     string
+		line, column int
+	}{
+		{"first line", "Hi {{name}}", "name", 1, 4},
+		{"later line", "Hello,\n\n  {{first_name}} from {{company}}", "first_name", 3, 3},
+		{"after multi-byte text", "Grüße {{name}}", "name", 1, 7},
+		{"map key", "{{company.name}}", "company.name", 1, 1},
+		{"inside if", "{{if plan}}\n{{name}}{{end}}", "name", 2, 1},
+		{"inside loop", "{{for i in items}}{{i.missing}}{{end}}", "i.missing", 1, 19},
+	}
+
+	data := map[string]interface{}{
+		"plan":  "pro",
+		"items": []interface{}{map[string]interface{}{"x": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("ParseTemplate(%q): %v", tt.template, err)
+			}
+			_, err = tmpl.Execute(data, nil)
+
+			var templateErr *TemplateError
+			if !errors.As(err, &templateErr) {
+				t.Fatalf("Execute(%q) error = %v, want a *TemplateError", tt.template, err)
+			}
+			if templateErr.Variable != tt.variable || templateErr.Line != tt.line || templateErr.Column != tt.column {
+				t.Errorf("Execute(%q) error = %q for %q, want %q at line %d, column %d",
+					tt.template, templateErr, templateErr.Variable, tt.variable, tt.line, tt.column)
+			}
+		})
+	}
+}
+
+func TestTemplateSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		template     string
+		line, column int
+		message      string
+	}{
+		{"unclosed action", "Hi {{name", 1, 4, "not closed with }}"},
+		{"unclosed string", `{{name | default "x}}`, 1, 1, "not closed with }}"},
+		{"empty action", "a\n {{ }}", 2, 2, "empty"},
+		{"unknown filter", "{{name | shout}}", 1, 1, `unknown filter "shout"`},
+		{"filter arguments", "{{name | upper 1}}", 1, 1, "upper takes no arguments"},
+		{"if not closed", "{{if name}}x", 1, 1, "{{if}} is not closed with {{end}}"},
+		{"for not closed", "\n{{for i in items}}x", 2, 1, "{{for}} is not closed with {{end}}"},
+		{"stray end", "x{{end}}", 1, 2, "{{end}} without {{if}} or {{for}}"},
+		{"stray else", "{{else}}", 1, 1, "{{else}} without {{if}} or {{for}}"},
+		{"second else", "{{if a}}1{{else}}2{{else}}3{{end}}", 1, 19, "unexpected {{else}}"},
+		{"else if after for", "{{for i in items}}{{else if a}}{{end}}", 1, 19, "unexpected if after else"},
+		{"bad for", "{{for items}}{{end}}", 1, 1, "{{for item in items}}"},
+		{"keyword as loop variable", "{{for loop in items}}{{end}}", 1, 1, "loop cannot be used as a loop variable"},
+		{"missing filter", "{{name |}}", 1, 1, "| must be followed by a filter"},
+		{"unexpected character", "{{name + 1}}", 1, 1, "unexpected '+'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTemplate(tt.template)
+
+			var templateErr *TemplateError
+			if !errors.As(err, &templateErr) {
+				t.Fatalf("ParseTemplate(%q) error = %v, want a *TemplateError", tt.template, err)
+			}
+			if templateErr.Line != tt.line || templateErr.Column != tt.column || !strings.Contains(templateErr.Message, tt.message) {
+				t.Errorf("ParseTemplate(%q) error = %q, want line %d, column %d containing %q",
+					tt.template, templateErr, tt.line, tt.column, tt.message)
+			}
+		})
+	}
+}
+
+func TestTemplateVariables(t *testing.T) {
+	tmpl, err := ParseTemplate(`{{Name}} {{if plan == tier}}{{for i in items}}{{i}}{{loop.index}}{{company.name | default fallback}}{{end}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"company", "fallback", "items", "name", "plan", "tier"}
+	if got := tmpl.Variables(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Variables() = %v, want %v", got, want)
+	}
+}
+
+func TestNormalizeTemplateVariable(t *testing.T) {
+	tests := map[string]string{
+		"First Name":     "first_name",
+		"  email  ":      "email",
+		"Company-Name!":  "company_name",
+		"ZIP code (US)":  "zip_code_us",
+		"__already_ok__": "already_ok",
+	}
+	for in, want := range tests {
+		if got := NormalizeTemplateVariable(in); got != want {
+			t.Errorf("NormalizeTemplateVariable(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff computes exponentially growing retry delays with full jitter, so
+// concurrent senders that hit a limit together do not retry in lockstep
+type Backoff struct {
+	Base time.Duration // Upper bound of the first delay
+	Max  time.Duration // Cap on the upper bound of any delay
+}
+
+// Delay returns a random delay between 0 and Base*2^attempt, capped at Max.
+// attempt counts from 0 for the first retry.
+func (b Backoff) Delay(attempt int) time.Duration {
+	ceiling := b.Max
+	if attempt < 32 {
+		if d := b.Base << uint(attempt); d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// DelayFor returns the delay before retrying after err. A Retry-After hint
+// from Gmail takes precedence when it asks for a longer wait, up to Max.
+func (b Backoff) DelayFor(err error, attempt int) time.Duration {
+	delay := b.Delay(attempt)
+	if retryAfter := RetryAfter(err); retryAfter > delay {
+		delay = retryAfter
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	return delay
+}
+
+// Sleep waits for d or until ctx is done, and returns ctx's error in the latter case
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AdaptiveLimiter bounds the number of concurrent calls and adapts the bound
+// to the quota errors observed (additive increase, multiplicative decrease):
+// every success raises the limit by a fraction, every throttled call halves it.
+type AdaptiveLimiter struct {
+	mu           sync.Mutex
+	limit        float64
+	min, max     float64
+	inFlight     int
+	lastDecrease time.Time
+	changed      chan struct{}
+}
+
+// limiterCooldown keeps one burst of quota errors from halving the limit more than once
+const limiterCooldown = time.Second
+
+// NewAdaptiveLimiter creates a limiter starting at initial concurrent calls, kept between min and max
+func NewAdaptiveLimiter(initial, min, max int) *AdaptiveLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if initial < min || initial > max {
+		initial = min
+	}
+	return &AdaptiveLimiter{
+		limit:   float64(initial),
+		min:     float64(min),
+		max:     float64(max),
+		changed: make(chan struct{}),
+	}
+}
+
+// Acquire waits until a call may start or ctx is done. Every successful
+// Acquire must be followed by a Release.
+func (l *AdaptiveLimiter) Acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inFlight < int(l.limit) {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release ends a call started with Acquire
+func (l *AdaptiveLimiter) Release() {
+	l.mu.Lock()
+	l.inFlight--
+	l.notify()
+	l.mu.Unlock()
+}
+
+// Success records a call that was not throttled and raises the limit slightly
+func (l *AdaptiveLimiter) Success() {
+	l.mu.Lock()
+	previous := int(l.limit)
+	l.limit += 1 / l.limit
+	if l.limit > l.max {
+		l.limit = l.max
+	}
+	if int(l.limit) > previous {
+		l.notify()
+	}
+	l.mu.Unlock()
+}
+
+// Throttled records a quota error and halves the limit
+func (l *AdaptiveLimiter) Throttled() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.lastDecrease) < limiterCooldown {
+		return
+	}
+	l.lastDecrease = time.Now()
+	l.limit /= 2
+	if l.limit < l.min {
+		l.limit = l.min
+	}
+}
+
+// Limit returns the current number of concurrent calls allowed
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// notify wakes the callers waiting in Acquire; l.mu must be held
+func (l *AdaptiveLimiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}